@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"time"
+)
+
+const (
+	adoptPollInterval = time.Second
+	// processStartSlack absorbs the one-second resolution of process start
+	// times on both Linux (via btime) and macOS (ps lstart).
+	processStartSlack = 2 * time.Second
+)
+
+func (inst *Instance) PID() int {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	if inst.proc == nil {
+		return 0
+	}
+	return inst.proc.Pid
+}
+
+// adoptProcesses reattaches to llama-servers that a previous manager left
+// running, instead of restarting them. The returned instances are already
+// supervised.
+func (m *Manager) adoptProcesses() map[*Instance]bool {
+	adopted := make(map[*Instance]bool)
+	for name, p := range m.leftover {
+		inst := m.Get(name)
+		if inst == nil {
+			continue
+		}
+		logger := instanceLogger(name)
+		if reason := inst.adoptable(p); reason != "" {
+			logger.Info("not adopting previous process", "event", "adopt_skipped", "pid", p.PID, "reason", reason)
+			continue
+		}
+		exitCh := inst.adopt(p)
+		logger.Info("adopted running process", "event", "process_adopted", "pid", p.PID, "port", inst.Port())
+		m.supervise(inst, exitCh)
+		adopted[inst] = true
+	}
+	m.leftover = nil
+	return adopted
+}
+
+// adoptable explains why the process in p can't be adopted, or returns "" if
+// it is the same process and still runs the command the current config would.
+func (inst *Instance) adoptable(p persistedInstance) string {
+	if !processAlive(p.PID) {
+		return "process is gone"
+	}
+	started, err := processStartTime(p.PID)
+	if err != nil {
+		return err.Error()
+	}
+	if d := started.Sub(*p.ProcessStart); d > processStartSlack || d < -processStartSlack {
+		return "PID belongs to a different process"
+	}
+	conf := inst.conf
+	if conf.GPUIDs.Auto() {
+		conf.GPUIDs = p.GPUs
+	}
+	if conf.Port == 0 {
+		conf.Port = p.Port
+	}
+	lc := buildArgs(inst.cfg, conf)
+	args, err := processArgs(p.PID)
+	if err != nil {
+		return err.Error()
+	}
+	if !isServerProcess(args, lc.Binary, conf.Port) || len(args) < len(lc.Args) ||
+		!slices.Equal(args[len(args)-len(lc.Args):], lc.Args) {
+		return "command line differs from the current config"
+	}
+	return ""
+}
+
+// adopt takes over supervision of a running process that isn't our child:
+// its exit is detected by polling and its earlier output is not available.
+func (inst *Instance) adopt(p persistedInstance) <-chan struct{} {
+	proc, _ := os.FindProcess(p.PID)
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	inst.runningLocked(proc, *p.ProcessStart, *p.ProcessStart)
+	if inst.conf.GPUIDs.Auto() {
+		inst.assignedGPUs = p.GPUs
+	}
+	if inst.conf.Port == 0 {
+		inst.cfg.claimPort(inst.conf.Name, p.Port)
+	}
+
+	exitCh := make(chan struct{})
+	inst.exited = exitCh
+	go func() {
+		for processAlive(proc.Pid) {
+			time.Sleep(adoptPollInterval)
+		}
+		inst.processExited(nil, nil)
+		close(exitCh)
+	}()
+	return exitCh
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditMemorySize   = 1000
+	auditDefaultLimit = 100
+	// auditMaxFileSize is how large the audit file grows before it is moved
+	// aside to audit_file.1.
+	auditMaxFileSize = 10 << 20
+)
+
+// AuditEntry records one mutating API call: who made it, from where, what it
+// did and how it ended.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	Role       string    `json:"role,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Action     string    `json:"action"`
+	Instance   string    `json:"instance,omitempty"`
+	Tag        string    `json:"tag,omitempty"`
+	Status     int       `json:"status"`
+}
+
+// AuditLog appends entries to the audit file as JSON lines and keeps the most
+// recent ones in memory for when no file is configured. The file is the one
+// configured at startup; an imported audit_file applies on restart.
+type AuditLog struct {
+	path   string
+	mu     sync.Mutex
+	recent []AuditEntry
+}
+
+func NewAuditLog(cfg *Config) *AuditLog {
+	return &AuditLog{path: cfg.AuditPath()}
+}
+
+func (a *AuditLog) Record(e AuditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.recent = append(a.recent, e)
+	if len(a.recent) > auditMemorySize {
+		a.recent = a.recent[len(a.recent)-auditMemorySize:]
+	}
+	path := a.path
+	if path == "" {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err == nil {
+		err = rotateAuditFile(path, len(data)+1)
+	}
+	if err == nil {
+		err = appendLine(path, data)
+	}
+	if err != nil {
+		slog.Warn("could not write audit log", "event", "audit_write_failed", "path", path, "error", err)
+	}
+}
+
+// rotateAuditFile moves the audit file to path.1, replacing the previous one,
+// when n more bytes would take it past auditMaxFileSize.
+func rotateAuditFile(path string, n int) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size()+int64(n) <= auditMaxFileSize {
+		return nil
+	}
+	return os.Rename(path, path+".1")
+}
+
+func appendLine(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type AuditFilter struct {
+	Actor    string
+	Action   string
+	Instance string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+func (f AuditFilter) match(e AuditEntry) bool {
+	return (f.Actor == "" || e.Actor == f.Actor) &&
+		(f.Action == "" || e.Action == f.Action) &&
+		(f.Instance == "" || e.Instance == f.Instance) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// Query returns the newest entries matching f, newest first, from the audit
+// file and its rotated predecessor when there is one.
+func (a *AuditLog) Query(f AuditFilter) ([]AuditEntry, error) {
+	path := a.path
+	if path == "" {
+		a.mu.Lock()
+		entries := slices.Clone(a.recent)
+		a.mu.Unlock()
+		out := []AuditEntry{}
+		for i := len(entries) - 1; i >= 0 && len(out) < f.Limit; i-- {
+			if f.match(entries[i]) {
+				out = append(out, entries[i])
+			}
+		}
+		return out, nil
+	}
+	// Record only ever appends whole lines, so the file is read without
+	// holding a.mu; a line still being written fails to parse and is skipped.
+	var tail []AuditEntry
+	for _, p := range []string{path + ".1", path} {
+		err := scanAuditFile(p, func(e AuditEntry) {
+			if !f.match(e) {
+				return
+			}
+			tail = append(tail, e)
+			if len(tail) >= 2*f.Limit {
+				tail = slices.Clone(tail[len(tail)-f.Limit:])
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(tail) > f.Limit {
+		tail = tail[len(tail)-f.Limit:]
+	}
+	out := make([]AuditEntry, len(tail))
+	for i, e := range tail {
+		out[len(tail)-1-i] = e
+	}
+	return out, nil
+}
+
+// scanAuditFile calls fn for each entry in the audit file at path, oldest
+// first. A missing file has no entries.
+func scanAuditFile(path string, fn func(AuditEntry)) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(sc.Bytes(), &e) == nil {
+			fn(e)
+		}
+	}
+	return sc.Err()
+}
+
+// auditable reports whether r changes something worth recording. Proxied
+// inference calls and config validation are left out.
+func auditable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return !isProxyPath(r.URL.Path) && r.URL.Path != "/api/config/validate"
+}
+
+// auditAction names what a request to path does and the instance or tag it
+// targets.
+func auditAction(method, path string) (action, instance, tag string) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(path, "/api/"), "/"), "/")
+	switch {
+	case parts[0] == "instances" && len(parts) >= 3 && (parts[1] == "all" || parts[1] == "batch"):
+		return parts[2] + "_" + parts[1], "", ""
+	case parts[0] == "instances" && len(parts) >= 4 && parts[1] == "tag":
+		return parts[3] + "_tag", "", parts[2]
+	case parts[0] == "instances" && len(parts) >= 3:
+		return parts[2], parts[1], ""
+	case parts[0] == "config" && len(parts) >= 2 && parts[1] == "instances":
+		switch {
+		case len(parts) == 2:
+			return "config_add", "", ""
+		case len(parts) >= 4:
+			return "config_" + parts[3], parts[2], ""
+		case method == http.MethodDelete:
+			return "config_delete", parts[2], ""
+		default:
+			return "config_update", parts[2], ""
+		}
+	}
+	switch p := strings.Join(parts, "/"); p {
+	case "models/download":
+		return "download", "", ""
+	case "models/download/stop":
+		return "download_stop", "", ""
+	case "models/download/history":
+		return "download_history_clear", "", ""
+	case "models/download/queue":
+		return "download_queue_clear", "", ""
+	case "settings":
+		return "settings_update", "", ""
+	default:
+		if strings.HasPrefix(p, "models/download/queue/") {
+			if method == http.MethodDelete {
+				return "download_queue_remove", "", ""
+			}
+			return "download_queue_move", "", ""
+		}
+		return strings.ReplaceAll(p, "/", "_"), "", ""
+	}
+}
+
+// auditRecorder captures the response status; handlers may also set who
+// when the caller's identity is only known from the body (login).
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	who    *identity
+}
+
+func (rec *auditRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *auditRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *auditRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func setAuditIdentity(w http.ResponseWriter, id identity) {
+	if rec, ok := w.(*auditRecorder); ok {
+		rec.who = &id
+	}
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (ws *WebServer) serveAudited(w http.ResponseWriter, r *http.Request) {
+	id := ws.requestIdentity(r)
+	rec := &auditRecorder{ResponseWriter: w}
+	ws.serve(rec, r)
+	if rec.who != nil {
+		id = *rec.who
+	}
+	action, instance, tag := auditAction(r.Method, r.URL.Path)
+	e := AuditEntry{
+		Time:       time.Now(),
+		Actor:      id.actor,
+		RemoteAddr: remoteIP(r),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Action:     action,
+		Instance:   instance,
+		Tag:        tag,
+		Status:     rec.status,
+	}
+	if ws.cfg.AuthRequired() {
+		e.Role = id.role.String()
+	}
+	if e.Status == 0 {
+		e.Status = http.StatusOK
+	}
+	ws.audit.Record(e)
+}
+
+func (ws *WebServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	f := AuditFilter{
+		Actor:    q.Get("actor"),
+		Action:   q.Get("action"),
+		Instance: q.Get("instance"),
+		Limit:    auditDefaultLimit,
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > auditMemorySize {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(auditMemorySize))
+			return
+		}
+		f.Limit = n
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := parseTimeParam(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, p.name+" must be an RFC 3339 time or a duration like 24h")
+			return
+		}
+		*p.dst = t
+	}
+	entries, err := ws.audit.Query(f)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "reading audit log: "+err.Error())
+		return
+	}
+	writeJSONStatus(w, http.StatusOK, entries)
+}
+
+// parseTimeParam accepts an RFC 3339 time or a duration meaning that long ago.
+func parseTimeParam(v string) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestAuditQueryReadsRotatedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a := NewAuditLog(testConfig(t, "audit_file: "+path+"\n"))
+	for _, action := range []string{"a1", "a2", "a3"} {
+		a.Record(AuditEntry{Action: action})
+	}
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range []string{"a4", "a5"} {
+		a.Record(AuditEntry{Action: action})
+	}
+
+	entries, err := a.Query(AuditFilter{Limit: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Action)
+	}
+	if want := []string{"a5", "a4", "a3", "a2"}; !slices.Equal(got, want) {
+		t.Errorf("Query = %v, want %v", got, want)
+	}
+}
+
+func TestRotateAuditFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := rotateAuditFile(path, 100); err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := rotateAuditFile(path, 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("rotated a small file: %v", err)
+	}
+	if err := rotateAuditFile(path, auditMaxFileSize); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("audit file still there after rotation: %v", err)
+	}
+	if data, err := os.ReadFile(path + ".1"); err != nil || string(data) != "old\n" {
+		t.Errorf("rotated file = %q, %v", data, err)
+	}
+}
+
+func TestAuditAction(t *testing.T) {
+	tests := []struct {
+		method, path          string
+		action, instance, tag string
+	}{
+		{"POST", "/api/instances/chat/restart", "restart", "chat", ""},
+		{"POST", "/api/instances/all/stop", "stop_all", "", ""},
+		{"POST", "/api/instances/batch/start", "start_batch", "", ""},
+		{"POST", "/api/instances/tag/prod/rolling-restart", "rolling-restart_tag", "", "prod"},
+		{"DELETE", "/api/config/instances/chat", "config_delete", "chat", ""},
+		{"POST", "/api/models/download", "download", "", ""},
+	}
+	for _, tt := range tests {
+		action, instance, tag := auditAction(tt.method, tt.path)
+		if action != tt.action || instance != tt.instance || tag != tt.tag {
+			t.Errorf("auditAction(%s %s) = %q, %q, %q, want %q, %q, %q", tt.method, tt.path, action, instance, tag, tt.action, tt.instance, tt.tag)
+		}
+	}
+}
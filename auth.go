@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	sessionCookie = "llama_manager_session"
+	sessionTTL    = 12 * time.Hour
+)
+
+// Role is what a request may do; each role includes the ones below it.
+type Role int
+
+const (
+	roleNone Role = iota
+	roleViewer
+	roleOperator
+	roleAdmin
+)
+
+var roleNames = map[Role]string{roleNone: "none", roleViewer: "viewer", roleOperator: "operator", roleAdmin: "admin"}
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+func parseRole(s string) (Role, bool) {
+	for role, name := range roleNames {
+		if name == s {
+			return role, true
+		}
+	}
+	return roleNone, false
+}
+
+// APIKey is an api_keys entry; a plain string is an admin key.
+type APIKey struct {
+	Key  string `yaml:"key"`
+	Role string `yaml:"role,omitempty"`
+	Name string `yaml:"name,omitempty"`
+}
+
+func (k *APIKey) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		k.Key = value.Value
+		return nil
+	}
+	type rawKey APIKey
+	return value.Decode((*rawKey)(k))
+}
+
+func (k APIKey) MarshalYAML() (interface{}, error) {
+	if k.Name == "" && (k.Role == "" || k.Role == "admin") {
+		return k.Key, nil
+	}
+	type rawKey APIKey
+	return rawKey(k), nil
+}
+
+func (k APIKey) role() Role {
+	if k.Role == "" {
+		return roleAdmin
+	}
+	role, _ := parseRole(k.Role)
+	return role
+}
+
+// label names the key in the audit log without revealing it.
+func (k APIKey) label() string {
+	if k.Name != "" {
+		return k.Name
+	}
+	sum := sha256.Sum256([]byte(k.Key))
+	return "key:" + hex.EncodeToString(sum[:4])
+}
+
+func validateAPIKeys(keys []APIKey, anonymous string) []error {
+	var errs []error
+	for i, k := range keys {
+		if strings.TrimSpace(k.Key) == "" || strings.ContainsAny(k.Key, " \t\r\n") {
+			errs = append(errs, fmt.Errorf("api_keys[%d] must be non-empty and contain no whitespace", i))
+		}
+		if role, ok := parseRole(k.Role); k.Role != "" && (!ok || role == roleNone) {
+			errs = append(errs, fmt.Errorf("api_keys[%d]: role must be one of: viewer, operator, admin", i))
+		}
+	}
+	if role, ok := parseRole(anonymous); anonymous != "" && (!ok || role == roleAdmin) {
+		errs = append(errs, fmt.Errorf("anonymous_role must be one of: none, viewer, operator"))
+	}
+	return errs
+}
+
+func (cfg *Config) AuthRequired() bool {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return len(cfg.APIKeys) > 0
+}
+
+// lookupAPIKey compares key against every configured key in constant time.
+func (cfg *Config) lookupAPIKey(key string) (APIKey, bool) {
+	if key == "" {
+		return APIKey{}, false
+	}
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	var found APIKey
+	ok := false
+	for _, k := range cfg.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+			found, ok = k, true
+		}
+	}
+	return found, ok
+}
+
+func (cfg *Config) anonymousRole() Role {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	if cfg.AnonymousRole == "" {
+		return roleViewer
+	}
+	role, _ := parseRole(cfg.AnonymousRole)
+	return role
+}
+
+type session struct {
+	expires time.Time
+	role    Role
+	actor   string
+}
+
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]session
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]session)}
+}
+
+func (s *sessionStore) create(role Role, actor string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, sess := range s.sessions {
+		if now.After(sess.expires) {
+			delete(s.sessions, k)
+		}
+	}
+	s.sessions[id] = session{expires: now.Add(sessionTTL), role: role, actor: actor}
+	return id, nil
+}
+
+func (s *sessionStore) lookup(id string) (session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if ok && time.Now().After(sess.expires) {
+		delete(s.sessions, id)
+		return session{}, false
+	}
+	return sess, ok
+}
+
+func (s *sessionStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+func (s *sessionStore) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.sessions)
+}
+
+func requestAPIKey(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+type identity struct {
+	actor         string
+	role          Role
+	authenticated bool
+}
+
+// requestIdentity returns who r acts as: its API key or UI session, or an
+// anonymous caller with anonymous_role when it carries neither.
+func (ws *WebServer) requestIdentity(r *http.Request) identity {
+	if k, ok := ws.cfg.lookupAPIKey(requestAPIKey(r)); ok {
+		return identity{actor: k.label(), role: k.role(), authenticated: true}
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if sess, ok := ws.sessions.lookup(c.Value); ok {
+			return identity{actor: sess.actor, role: sess.role, authenticated: true}
+		}
+	}
+	return identity{actor: "anonymous", role: ws.cfg.anonymousRole()}
+}
+
+func (ws *WebServer) requestRole(r *http.Request) (role Role, authenticated bool) {
+	id := ws.requestIdentity(r)
+	return id.role, id.authenticated
+}
+
+// requiredRole is the role r needs when api_keys are set. Reads need viewer;
+// instance control, downloads and proxied inference need operator; config,
+// settings, the config export (which holds the keys) and the audit log need
+// admin.
+func requiredRole(r *http.Request) Role {
+	path := r.URL.Path
+	switch path {
+	case "/", "/healthz", "/api/login", "/api/logout", "/api/auth":
+		return roleNone
+	case "/api/config/export", "/api/audit":
+		return roleAdmin
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+		return roleViewer
+	}
+	if strings.HasPrefix(path, "/api/config/") || path == "/api/settings" {
+		return roleAdmin
+	}
+	return roleOperator
+}
+
+// authorize rejects r when its role is below what the path needs.
+func (ws *WebServer) authorize(w http.ResponseWriter, r *http.Request) bool {
+	need := requiredRole(r)
+	role, authenticated := ws.requestRole(r)
+	if role >= need {
+		return true
+	}
+	if !authenticated {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="llama-manager"`)
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized: a valid API key is required")
+		return false
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="llama-manager", error="insufficient_scope"`)
+	writeJSONError(w, http.StatusForbidden, fmt.Sprintf("forbidden: this needs the %s role, the key has %s", need, role))
+	return false
+}
+
+func (ws *WebServer) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		Key string `json:"key"`
+	}
+	if !ws.decodeJSONBody(w, r, &req) {
+		return
+	}
+	k, ok := ws.cfg.lookupAPIKey(req.Key)
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "invalid API key")
+		return
+	}
+	setAuditIdentity(w, identity{actor: k.label(), role: k.role(), authenticated: true})
+	id, err := ws.sessions.create(k.role(), k.label())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(sessionTTL / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	writeJSONStatus(w, http.StatusOK, map[string]string{"status": "ok", "role": k.role().String()})
+}
+
+func (ws *WebServer) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		ws.sessions.remove(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	writeJSONStatus(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (ws *WebServer) handleAuthStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	required := ws.cfg.AuthRequired()
+	role, authenticated := ws.requestRole(r)
+	if !required {
+		role, authenticated = roleAdmin, true
+	}
+	writeJSONStatus(w, http.StatusOK, map[string]interface{}{
+		"auth_required": required,
+		"authenticated": authenticated,
+		"role":          role.String(),
+	})
+}
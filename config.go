@@ -1,9 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,38 +18,126 @@ import (
 )
 
 type Config struct {
-	ServerBin           string         `yaml:"server_bin" json:"server_bin"`
-	ManagerPort         int            `yaml:"manager_port" json:"manager_port"`
-	RestartDelay        duration       `yaml:"restart_delay" json:"restart_delay"`
-	MaxRestarts         int            `yaml:"max_restarts" json:"max_restarts"`
-	HealthCheckInterval duration       `yaml:"health_check_interval" json:"health_check_interval"`
-	GPUBackend          string         `yaml:"gpu_backend" json:"gpu_backend"`
-	Host                string         `yaml:"host" json:"host"`
-	NGL                 int            `yaml:"ngl" json:"ngl"`
-	MainGPU             int            `yaml:"main_gpu" json:"main_gpu"`
-	ContextLength       int            `yaml:"context_length" json:"context_length"`
-	CacheTypeK          string         `yaml:"cache_type_k" json:"cache_type_k"`
-	CacheTypeV          string         `yaml:"cache_type_v" json:"cache_type_v"`
-	Instances           []InstanceConf `yaml:"instances" json:"instances"`
-
-	mu   sync.RWMutex `yaml:"-" json:"-"`
-	path string       `yaml:"-" json:"-"`
+	ServerBin             string            `yaml:"server_bin" json:"server_bin"`
+	ManagerHost           string            `yaml:"manager_host,omitempty" json:"manager_host,omitempty"`
+	ManagerPort           int               `yaml:"manager_port" json:"manager_port"`
+	ReadOnly              bool              `yaml:"read_only,omitempty" json:"read_only,omitempty"`
+	AllowedOrigins        []string          `yaml:"allowed_origins,omitempty" json:"allowed_origins,omitempty"`
+	APIKeys               []APIKey          `yaml:"api_keys,omitempty" json:"-"`
+	AnonymousRole         string            `yaml:"anonymous_role,omitempty" json:"anonymous_role,omitempty"`
+	TLSCert               string            `yaml:"tls_cert,omitempty" json:"tls_cert,omitempty"`
+	TLSKey                string            `yaml:"tls_key,omitempty" json:"tls_key,omitempty"`
+	TLSSelfSigned         bool              `yaml:"tls_self_signed,omitempty" json:"tls_self_signed,omitempty"`
+	RestartDelay          duration          `yaml:"restart_delay" json:"restart_delay"`
+	MaxRestarts           int               `yaml:"max_restarts" json:"max_restarts"`
+	RestartOnOOM          bool              `yaml:"restart_on_oom" json:"restart_on_oom"`
+	HealthCheckInterval   duration          `yaml:"health_check_interval" json:"health_check_interval"`
+	GPUBackend            string            `yaml:"gpu_backend" json:"gpu_backend"`
+	GPUEnvVarName         string            `yaml:"gpu_env_var,omitempty" json:"gpu_env_var,omitempty"`
+	Host                  string            `yaml:"host" json:"host"`
+	NGL                   int               `yaml:"ngl" json:"ngl"`
+	MainGPU               int               `yaml:"main_gpu" json:"main_gpu"`
+	ContextLength         int               `yaml:"context_length" json:"context_length"`
+	CacheTypeK            string            `yaml:"cache_type_k" json:"cache_type_k"`
+	CacheTypeV            string            `yaml:"cache_type_v" json:"cache_type_v"`
+	FlashAttn             bool              `yaml:"flash_attn" json:"flash_attn"`
+	Parallel              int               `yaml:"parallel,omitempty" json:"parallel,omitempty"`
+	BatchSize             int               `yaml:"batch_size,omitempty" json:"batch_size,omitempty"`
+	UBatchSize            int               `yaml:"ubatch_size,omitempty" json:"ubatch_size,omitempty"`
+	Threads               int               `yaml:"threads,omitempty" json:"threads,omitempty"`
+	Timeout               int               `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	LogFormat             string            `yaml:"log_format,omitempty" json:"log_format,omitempty"`
+	LogBufferSize         int               `yaml:"log_buffer_size" json:"log_buffer_size"`
+	WebhookURL            string            `yaml:"webhook_url,omitempty" json:"webhook_url,omitempty"`
+	Notifications         NotificationsConf `yaml:"notifications,omitempty" json:"notifications,omitempty"`
+	HFToken               string            `yaml:"hf_token,omitempty" json:"-"`
+	DownloadDonePatterns  []string          `yaml:"download_done_patterns,omitempty" json:"download_done_patterns,omitempty"`
+	DownloadTimeout       duration          `yaml:"download_timeout" json:"download_timeout"`
+	RollingRestartTimeout duration          `yaml:"rolling_restart_timeout" json:"rolling_restart_timeout"`
+	DrainTimeout          duration          `yaml:"drain_timeout" json:"drain_timeout"`
+	StopTimeout           duration          `yaml:"stop_timeout" json:"stop_timeout"`
+	ShutdownTimeout       duration          `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+	DetachOnShutdown      bool              `yaml:"detach_on_shutdown" json:"detach_on_shutdown"`
+	DependencyTimeout     duration          `yaml:"dependency_timeout" json:"dependency_timeout"`
+	WakeTimeout           duration          `yaml:"wake_timeout" json:"wake_timeout"`
+	StartupTimeout        duration          `yaml:"startup_timeout" json:"startup_timeout"`
+	StartupConcurrency    int               `yaml:"startup_concurrency" json:"startup_concurrency"`
+	StartupStagger        duration          `yaml:"startup_stagger" json:"startup_stagger"`
+	ReadyHealthChecks     int               `yaml:"ready_health_checks" json:"ready_health_checks"`
+	UnhealthyThreshold    int               `yaml:"unhealthy_threshold" json:"unhealthy_threshold"`
+	Warmup                bool              `yaml:"warmup" json:"warmup"`
+	WarmupTimeout         duration          `yaml:"warmup_timeout" json:"warmup_timeout"`
+	StateFile             string            `yaml:"state_file,omitempty" json:"state_file,omitempty"`
+	AuditFile             string            `yaml:"audit_file,omitempty" json:"audit_file,omitempty"`
+	InstancesDir          string            `yaml:"instances_dir,omitempty" json:"instances_dir,omitempty"`
+	PortRangeStart        int               `yaml:"port_range_start" json:"port_range_start"`
+	PortRangeEnd          int               `yaml:"port_range_end" json:"port_range_end"`
+	GPUOverlap            string            `yaml:"gpu_overlap" json:"gpu_overlap"`
+	VRAMCheck             string            `yaml:"vram_check" json:"vram_check"`
+	ProxyBalance          string            `yaml:"proxy_balance" json:"proxy_balance"`
+	MetricsCacheTTL       duration          `yaml:"metrics_cache_ttl" json:"metrics_cache_ttl"`
+	MetricsInterval       duration          `yaml:"metrics_history_interval" json:"metrics_history_interval"`
+	MetricsRetention      duration          `yaml:"metrics_history_retention" json:"metrics_history_retention"`
+	MaxJSONBody           int64             `yaml:"max_json_body" json:"max_json_body"`
+	MaxUploadSize         int64             `yaml:"max_upload_size" json:"max_upload_size"`
+	Instances             []InstanceConf    `yaml:"instances" json:"instances"`
+
+	mu           sync.RWMutex      `yaml:"-" json:"-"`
+	path         string            `yaml:"-" json:"-"`
+	envTemplates map[string]string `yaml:"-" json:"-"`
+	// autoPorts holds the ports picked for port: auto instances.
+	autoPorts map[string]int `yaml:"-" json:"-"`
 }
 
 type InstanceConf struct {
-	Name          string  `yaml:"name" json:"name"`
-	Model         string  `yaml:"model" json:"model"`
-	Port          int     `yaml:"port" json:"port"`
-	GPUIDs        []int   `yaml:"gpu_ids" json:"gpu_ids"`
-	NGL           *int    `yaml:"ngl,omitempty" json:"ngl,omitempty"`
-	ContextLength *int    `yaml:"context_length,omitempty" json:"context_length,omitempty"`
-	CacheTypeK    *string `yaml:"cache_type_k,omitempty" json:"cache_type_k,omitempty"`
-	CacheTypeV    *string `yaml:"cache_type_v,omitempty" json:"cache_type_v,omitempty"`
+	Name               string          `yaml:"name" json:"name"`
+	Model              string          `yaml:"model" json:"model"`
+	Port               int             `yaml:"port" json:"port"`
+	GPUIDs             GPUList         `yaml:"gpu_ids" json:"gpu_ids"`
+	NGL                *int            `yaml:"ngl,omitempty" json:"ngl,omitempty"`
+	ContextLength      *int            `yaml:"context_length,omitempty" json:"context_length,omitempty"`
+	CacheTypeK         *string         `yaml:"cache_type_k,omitempty" json:"cache_type_k,omitempty"`
+	CacheTypeV         *string         `yaml:"cache_type_v,omitempty" json:"cache_type_v,omitempty"`
+	AutoStart          *bool           `yaml:"auto_start,omitempty" json:"auto_start,omitempty"`
+	TensorSplit        []float64       `yaml:"tensor_split,omitempty" json:"tensor_split,omitempty"`
+	FlashAttn          *bool           `yaml:"flash_attn,omitempty" json:"flash_attn,omitempty"`
+	LogBufferSize      *int            `yaml:"log_buffer_size,omitempty" json:"log_buffer_size,omitempty"`
+	Parallel           *int            `yaml:"parallel,omitempty" json:"parallel,omitempty"`
+	BatchSize          *int            `yaml:"batch_size,omitempty" json:"batch_size,omitempty"`
+	UBatchSize         *int            `yaml:"ubatch_size,omitempty" json:"ubatch_size,omitempty"`
+	Threads            *int            `yaml:"threads,omitempty" json:"threads,omitempty"`
+	Timeout            *int            `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Tags               []string        `yaml:"tags,omitempty" json:"tags,omitempty"`
+	GPUDevices         []string        `yaml:"gpu_devices,omitempty" json:"gpu_devices,omitempty"`
+	DependsOn          []string        `yaml:"depends_on,omitempty" json:"depends_on,omitempty"`
+	StartAfter         []string        `yaml:"start_after,omitempty" json:"start_after,omitempty"`
+	Aliases            []string        `yaml:"aliases,omitempty" json:"aliases,omitempty"`
+	OnDemand           bool            `yaml:"on_demand,omitempty" json:"on_demand,omitempty"`
+	IdleTimeout        *duration       `yaml:"idle_timeout,omitempty" json:"idle_timeout,omitempty"`
+	ExtraArgs          []string        `yaml:"extra_args,omitempty" json:"extra_args,omitempty"`
+	ServerBin          string          `yaml:"server_bin,omitempty" json:"server_bin,omitempty"`
+	GPUBackend         string          `yaml:"gpu_backend,omitempty" json:"gpu_backend,omitempty"`
+	GPUEnvVarName      string          `yaml:"gpu_env_var,omitempty" json:"gpu_env_var,omitempty"`
+	HealthPath         string          `yaml:"health_path,omitempty" json:"health_path,omitempty"`
+	HealthTimeout      *duration       `yaml:"health_timeout,omitempty" json:"health_timeout,omitempty"`
+	HealthProbe        string          `yaml:"health_probe,omitempty" json:"health_probe,omitempty"`
+	UnhealthyThreshold *int            `yaml:"unhealthy_threshold,omitempty" json:"unhealthy_threshold,omitempty"`
+	StartupTimeout     *duration       `yaml:"startup_timeout,omitempty" json:"startup_timeout,omitempty"`
+	MaxRestarts        *int            `yaml:"max_restarts,omitempty" json:"max_restarts,omitempty"`
+	RestartDelay       *duration       `yaml:"restart_delay,omitempty" json:"restart_delay,omitempty"`
+	Schedule           []ScheduleEntry `yaml:"schedule,omitempty" json:"schedule,omitempty"`
+
+	source string
 }
 
 func (ic *InstanceConf) UnmarshalYAML(value *yaml.Node) error {
 	type rawConf InstanceConf
 	var raw rawConf
+	for i := 0; i < len(value.Content)-1; i += 2 {
+		if v := value.Content[i+1]; value.Content[i].Value == "port" && v.Kind == yaml.ScalarNode && v.Value == "auto" {
+			v.Value, v.Tag = "0", "!!int"
+		}
+	}
 	if err := value.Decode(&raw); err != nil {
 		return err
 	}
@@ -55,7 +150,7 @@ func (ic *InstanceConf) UnmarshalYAML(value *yaml.Node) error {
 				if err != nil {
 					return fmt.Errorf("invalid gpu_id: %w", err)
 				}
-				ic.GPUIDs = []int{id}
+				ic.GPUIDs = GPUList{id}
 				break
 			}
 		}
@@ -64,8 +159,185 @@ func (ic *InstanceConf) UnmarshalYAML(value *yaml.Node) error {
 	return nil
 }
 
+// reservedInstanceNames are taken by the bulk routes under /api/instances/.
+var reservedInstanceNames = map[string]bool{"all": true, "batch": true, "tag": true}
+
+func (ic *InstanceConf) Validate() error {
+	if ic.Name == "" || ic.Model == "" {
+		return fmt.Errorf("name and model are required")
+	}
+	if reservedInstanceNames[ic.Name] {
+		return fmt.Errorf("name %q is reserved for /api/instances/%s/ actions", ic.Name, ic.Name)
+	}
+	if ic.GPUBackend != "" && !validGPUBackends[ic.GPUBackend] {
+		return fmt.Errorf("gpu_backend must be one of: vulkan, cuda, rocm, rocm_rocr, metal")
+	}
+	if ic.GPUEnvVarName != "" && !envVarNameRe.MatchString(ic.GPUEnvVarName) {
+		return fmt.Errorf("gpu_env_var %q is not a valid environment variable name", ic.GPUEnvVarName)
+	}
+	if ic.Port < 0 || ic.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535, or 0 to auto-assign")
+	}
+	if ic.GPUIDs.Auto() {
+		if len(ic.GPUDevices) > 0 || len(ic.TensorSplit) > 0 {
+			return fmt.Errorf("gpu_devices and tensor_split need explicit gpu_ids, not auto")
+		}
+	} else {
+		for _, id := range ic.GPUIDs {
+			if id < 0 {
+				return fmt.Errorf("gpu_ids must be >= 0, or auto")
+			}
+		}
+	}
+	if len(ic.GPUDevices) > 0 {
+		if len(ic.GPUDevices) != len(ic.GPUIDs) {
+			return fmt.Errorf("gpu_devices has %d values but gpu_ids has %d", len(ic.GPUDevices), len(ic.GPUIDs))
+		}
+		for _, d := range ic.GPUDevices {
+			if strings.TrimSpace(d) == "" || strings.Contains(d, ",") {
+				return fmt.Errorf("gpu_devices entries must be non-empty and must not contain commas")
+			}
+		}
+	}
+	if ic.LogBufferSize != nil && *ic.LogBufferSize <= 0 {
+		return fmt.Errorf("log_buffer_size must be > 0")
+	}
+	for _, a := range ic.Aliases {
+		if strings.TrimSpace(a) == "" || a == ic.Name {
+			return fmt.Errorf("aliases must be non-empty and differ from the instance name")
+		}
+	}
+	if ic.OnDemand && ic.AutoStart != nil && *ic.AutoStart {
+		return fmt.Errorf("on_demand instances cannot also auto_start")
+	}
+	if ic.IdleTimeout != nil {
+		if !ic.OnDemand {
+			return fmt.Errorf("idle_timeout requires on_demand")
+		}
+		if ic.IdleTimeout.Duration < 0 {
+			return fmt.Errorf("idle_timeout must be >= 0")
+		}
+	}
+	for _, knob := range ic.serverKnobs() {
+		if knob.value != nil && *knob.value <= 0 {
+			return fmt.Errorf("%s must be > 0", knob.name)
+		}
+	}
+	switch ic.HealthProbe {
+	case "", healthProbeHTTP:
+		if ic.HealthPath != "" && !strings.HasPrefix(ic.HealthPath, "/") {
+			return fmt.Errorf("health_path must start with /")
+		}
+	case healthProbeCompletion:
+		if ic.HealthPath != "" {
+			return fmt.Errorf("health_path is only used by the http health_probe")
+		}
+	default:
+		return fmt.Errorf("health_probe must be %q or %q", healthProbeHTTP, healthProbeCompletion)
+	}
+	if ic.HealthTimeout != nil && ic.HealthTimeout.Duration <= 0 {
+		return fmt.Errorf("health_timeout must be > 0")
+	}
+	if ic.UnhealthyThreshold != nil && *ic.UnhealthyThreshold < 0 {
+		return fmt.Errorf("unhealthy_threshold must be >= 0")
+	}
+	if ic.StartupTimeout != nil && ic.StartupTimeout.Duration < 0 {
+		return fmt.Errorf("startup_timeout must be >= 0")
+	}
+	if ic.MaxRestarts != nil && *ic.MaxRestarts < 0 {
+		return fmt.Errorf("max_restarts must be >= 0")
+	}
+	if ic.RestartDelay != nil && ic.RestartDelay.Duration <= 0 {
+		return fmt.Errorf("restart_delay must be > 0")
+	}
+	for _, e := range ic.Schedule {
+		if err := e.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, a := range ic.ExtraArgs {
+		if flag, _, _ := strings.Cut(a, "="); flag == "--port" || flag == "--host" {
+			return fmt.Errorf("extra_args cannot set %s; the manager needs it to reach the instance", flag)
+		}
+	}
+	if len(ic.TensorSplit) > 0 {
+		if len(ic.TensorSplit) != len(ic.GPUIDs) {
+			return fmt.Errorf("tensor_split has %d values but gpu_ids has %d", len(ic.TensorSplit), len(ic.GPUIDs))
+		}
+		for _, r := range ic.TensorSplit {
+			if r <= 0 {
+				return fmt.Errorf("tensor_split values must be > 0")
+			}
+		}
+	}
+	return nil
+}
+
+type serverKnob struct {
+	name  string
+	value *int
+}
+
+func (ic *InstanceConf) serverKnobs() []serverKnob {
+	return []serverKnob{
+		{"parallel", ic.Parallel},
+		{"batch_size", ic.BatchSize},
+		{"ubatch_size", ic.UBatchSize},
+		{"threads", ic.Threads},
+		{"timeout", ic.Timeout},
+	}
+}
+
+func (ic *InstanceConf) GPUDeviceList() string {
+	if ic.GPUIDs.Auto() {
+		return "auto"
+	}
+	if len(ic.GPUDevices) > 0 {
+		return strings.Join(ic.GPUDevices, ",")
+	}
+	return strings.Join(intsToStrings(ic.GPUIDs), ",")
+}
+
+func (ic *InstanceConf) HasTag(tag string) bool {
+	for _, t := range ic.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (ic *InstanceConf) ShouldAutoStart() bool {
+	if ic.OnDemand {
+		return false
+	}
+	return ic.AutoStart == nil || *ic.AutoStart
+}
+
+func (cfg *Config) ListenAddr() string {
+	return net.JoinHostPort(cfg.ManagerHost, strconv.Itoa(cfg.ManagerPort))
+}
+
+var validGPUBackends = map[string]bool{"vulkan": true, "cuda": true, "rocm": true, "rocm_rocr": true, "metal": true}
+
 func (cfg *Config) GPUEnvVar() string {
-	switch cfg.GPUBackend {
+	return gpuEnvVar(cfg.GPUBackend, cfg.GPUEnvVarName)
+}
+
+// instanceGPUEnvVar is GPUEnvVar for ic, whose own gpu_env_var or
+// gpu_backend (for a server_bin built for another backend) wins.
+func (cfg *Config) instanceGPUEnvVar(ic InstanceConf) string {
+	if ic.GPUEnvVarName != "" || ic.GPUBackend != "" {
+		return gpuEnvVar(ic.GPUBackend, ic.GPUEnvVarName)
+	}
+	return cfg.GPUEnvVar()
+}
+
+func gpuEnvVar(backend, override string) string {
+	if override != "" {
+		return override
+	}
+	switch backend {
 	case "cuda":
 		return "CUDA_VISIBLE_DEVICES"
 	case "rocm":
@@ -124,64 +396,400 @@ func loadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("reading config: %w", err)
 	}
 
+	cfg, err := parseConfig(data, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.loadInstancesDir(); err != nil {
+		return nil, err
+	}
+
+	if errs := validateConfig(cfg); len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) instancesDirLocked() string {
+	if cfg.InstancesDir == "" || filepath.IsAbs(cfg.InstancesDir) || cfg.path == "" {
+		return cfg.InstancesDir
+	}
+	return filepath.Join(filepath.Dir(cfg.path), cfg.InstancesDir)
+}
+
+func (cfg *Config) loadInstancesDir() error {
+	dir := cfg.instancesDirLocked()
+	if dir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return fmt.Errorf("listing instances_dir: %w", err)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("reading instance file: %w", err)
+		}
+		var ic InstanceConf
+		if err := yaml.Unmarshal(data, &ic); err != nil {
+			return fmt.Errorf("parsing %s: %w", file, err)
+		}
+		if err := cfg.expandInstanceEnv(&ic); err != nil {
+			return fmt.Errorf("expanding %s: %w", file, err)
+		}
+		ic.source = file
+		cfg.Instances = append(cfg.Instances, ic)
+	}
+	return nil
+}
+
+var (
+	unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+	envVarNameRe    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+func (cfg *Config) instanceFilePathLocked(name string) (string, error) {
+	dir := cfg.instancesDirLocked()
+	if dir == "" {
+		return "", nil
+	}
+	file := filepath.Join(dir, unsafeFileChars.ReplaceAllString(name, "_")+".yaml")
+	if _, err := os.Stat(file); err == nil {
+		return "", fmt.Errorf("instance file %s already exists", file)
+	}
+	return file, nil
+}
+
+func (cfg *Config) instanceFileLocked(name string) (string, error) {
+	file, err := cfg.instanceFilePathLocked(name)
+	if err != nil || file == "" {
+		return file, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return "", fmt.Errorf("creating instances_dir: %w", err)
+	}
+	return file, nil
+}
+
+func parseConfig(data []byte, path string) (*Config, error) {
 	cfg := &Config{
-		ManagerPort:         8080,
-		RestartDelay:        duration{5 * time.Second},
-		MaxRestarts:         10,
-		HealthCheckInterval: duration{30 * time.Second},
-		GPUBackend:          "vulkan",
-		Host:                "0.0.0.0",
-		NGL:                 99,
-		MainGPU:             0,
-		ContextLength:       16384,
-		CacheTypeK:          "q8_0",
-		CacheTypeV:          "q8_0",
-		path:                path,
+		ManagerPort:           8080,
+		RestartDelay:          duration{5 * time.Second},
+		MaxRestarts:           10,
+		RestartOnOOM:          true,
+		HealthCheckInterval:   duration{30 * time.Second},
+		GPUBackend:            "vulkan",
+		Host:                  "0.0.0.0",
+		NGL:                   99,
+		MainGPU:               0,
+		ContextLength:         16384,
+		CacheTypeK:            "q8_0",
+		CacheTypeV:            "q8_0",
+		LogFormat:             "text",
+		LogBufferSize:         logBufferSize,
+		RollingRestartTimeout: duration{5 * time.Minute},
+		PortRangeStart:        9090,
+		PortRangeEnd:          9199,
+		GPUOverlap:            gpuOverlapAdvisory,
+		VRAMCheck:             vramCheckAdvisory,
+		ProxyBalance:          balanceLeastBusy,
+		MetricsCacheTTL:       duration{2 * time.Second},
+		MetricsInterval:       duration{15 * time.Second},
+		MetricsRetention:      duration{24 * time.Hour},
+		ReadyHealthChecks:     1,
+		UnhealthyThreshold:    3,
+		WarmupTimeout:         duration{60 * time.Second},
+		DownloadTimeout:       duration{6 * time.Hour},
+		StopTimeout:           duration{10 * time.Second},
+		ShutdownTimeout:       duration{30 * time.Second},
+		DependencyTimeout:     duration{5 * time.Minute},
+		WakeTimeout:           duration{5 * time.Minute},
+		MaxJSONBody:           maxJSONBody,
+		MaxUploadSize:         maxUploadSize,
+		path:                  path,
 	}
 
 	if err := yaml.Unmarshal(data, cfg); err != nil {
 		return nil, fmt.Errorf("parsing config: %w", err)
 	}
+	if err := cfg.expandEnv(); err != nil {
+		return nil, fmt.Errorf("expanding config: %w", err)
+	}
+
+	return cfg, nil
+}
 
+func validateConfig(cfg *Config) []error {
+	var errs []error
 	if cfg.ServerBin == "" {
-		return nil, fmt.Errorf("server_bin is required")
+		errs = append(errs, fmt.Errorf("server_bin is required"))
+	}
+	if cfg.ManagerPort <= 0 || cfg.ManagerPort > 65535 {
+		errs = append(errs, fmt.Errorf("manager_port must be between 1 and 65535"))
+	} else if _, err := net.ResolveTCPAddr("tcp", cfg.ListenAddr()); err != nil {
+		errs = append(errs, fmt.Errorf("invalid manager_host %q: %w", cfg.ManagerHost, err))
+	}
+	if !validGPUBackends[cfg.GPUBackend] {
+		errs = append(errs, fmt.Errorf("gpu_backend must be one of: vulkan, cuda, rocm, rocm_rocr, metal"))
+	}
+	if cfg.GPUEnvVarName != "" && !envVarNameRe.MatchString(cfg.GPUEnvVarName) {
+		errs = append(errs, fmt.Errorf("gpu_env_var %q is not a valid environment variable name", cfg.GPUEnvVarName))
+	}
+	if cfg.ContextLength <= 0 {
+		errs = append(errs, fmt.Errorf("context_length must be > 0"))
+	}
+	if cfg.NGL < 0 {
+		errs = append(errs, fmt.Errorf("ngl must be >= 0"))
+	}
+	if cfg.MaxRestarts < 0 {
+		errs = append(errs, fmt.Errorf("max_restarts must be >= 0"))
+	}
+	for _, knob := range cfg.serverKnobDefaults() {
+		if *knob.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must be >= 0", knob.name))
+		}
+	}
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("log_format must be one of: text, json"))
+	}
+	if err := validatePortRange(cfg.PortRangeStart, cfg.PortRangeEnd); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.LogBufferSize <= 0 {
+		errs = append(errs, fmt.Errorf("log_buffer_size must be > 0"))
+	}
+	errs = append(errs, cfg.Notifications.validate()...)
+	if cfg.MaxJSONBody <= 0 {
+		errs = append(errs, fmt.Errorf("max_json_body must be > 0"))
+	}
+	if cfg.MaxUploadSize <= 0 {
+		errs = append(errs, fmt.Errorf("max_upload_size must be > 0"))
+	}
+	if cfg.DependencyTimeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("dependency_timeout must be > 0"))
+	}
+	if cfg.StartupTimeout.Duration < 0 {
+		errs = append(errs, fmt.Errorf("startup_timeout must be >= 0"))
+	}
+	if cfg.StartupConcurrency < 0 {
+		errs = append(errs, fmt.Errorf("startup_concurrency must be >= 0"))
+	}
+	if cfg.StartupStagger.Duration < 0 {
+		errs = append(errs, fmt.Errorf("startup_stagger must be >= 0"))
+	}
+	if cfg.WakeTimeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("wake_timeout must be > 0"))
+	}
+	if cfg.ReadyHealthChecks < 1 {
+		errs = append(errs, fmt.Errorf("ready_health_checks must be >= 1"))
+	}
+	if cfg.UnhealthyThreshold < 0 {
+		errs = append(errs, fmt.Errorf("unhealthy_threshold must be >= 0"))
+	}
+	if cfg.DrainTimeout.Duration < 0 {
+		errs = append(errs, fmt.Errorf("drain_timeout must be >= 0"))
+	}
+	if cfg.StopTimeout.Duration < 0 {
+		errs = append(errs, fmt.Errorf("stop_timeout must be >= 0"))
+	}
+	if cfg.ShutdownTimeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("shutdown_timeout must be > 0"))
+	}
+	if cfg.WarmupTimeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("warmup_timeout must be > 0"))
+	}
+	if cfg.MetricsCacheTTL.Duration < 0 {
+		errs = append(errs, fmt.Errorf("metrics_cache_ttl must be >= 0"))
+	}
+	if cfg.MetricsInterval.Duration < 0 {
+		errs = append(errs, fmt.Errorf("metrics_history_interval must be >= 0"))
+	} else if cfg.MetricsInterval.Duration > 0 && cfg.MetricsRetention.Duration < cfg.MetricsInterval.Duration {
+		errs = append(errs, fmt.Errorf("metrics_history_retention must be at least metrics_history_interval"))
+	}
+	if !validGPUOverlapMode(cfg.GPUOverlap) {
+		errs = append(errs, fmt.Errorf("gpu_overlap must be one of: advisory, strict"))
+	}
+	if !validVRAMCheckMode(cfg.VRAMCheck) {
+		errs = append(errs, fmt.Errorf("vram_check must be one of: advisory, strict, off"))
+	}
+	if !validBalanceMode(cfg.ProxyBalance) {
+		errs = append(errs, fmt.Errorf("proxy_balance must be one of: least_busy, round_robin"))
+	}
+	errs = append(errs, validateOrigins(cfg.AllowedOrigins)...)
+	errs = append(errs, validateAPIKeys(cfg.APIKeys, cfg.AnonymousRole)...)
+	errs = append(errs, validateTLS(cfg.TLSCert, cfg.TLSKey, cfg.TLSSelfSigned)...)
+	if cfg.DownloadTimeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("download_timeout must be > 0"))
+	}
+	if _, err := compileDonePatterns(cfg.DownloadDonePatterns); err != nil {
+		errs = append(errs, err)
 	}
 
-	return cfg, nil
+	names := make(map[string]bool)
+	ports := make(map[int]string)
+	for i, ic := range cfg.Instances {
+		label := ic.Name
+		if label == "" {
+			label = fmt.Sprintf("#%d", i)
+		}
+		if ic.source != "" {
+			label += " (" + filepath.Base(ic.source) + ")"
+		}
+		if err := ic.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("instance %q: %w", label, err))
+		} else if err := cfg.checkGPUIDs(ic); err != nil {
+			errs = append(errs, fmt.Errorf("instance %q: %w", label, err))
+		}
+		if ic.Name != "" {
+			if names[ic.Name] {
+				errs = append(errs, fmt.Errorf("duplicate instance name: %q in %s", ic.Name, label))
+			}
+			names[ic.Name] = true
+		}
+		if ic.Port != 0 {
+			if other, ok := ports[ic.Port]; ok {
+				errs = append(errs, fmt.Errorf("duplicate port: %d (%q and %q)", ic.Port, other, label))
+			} else {
+				ports[ic.Port] = label
+			}
+		}
+		if cfg.GPUOverlap == gpuOverlapStrict {
+			for _, o := range gpuOverlaps(cfg.Instances[:i], -1, ic) {
+				errs = append(errs, fmt.Errorf("instance %q: %s", label, o))
+			}
+		}
+	}
+	errs = append(errs, dependencyErrors(cfg.Instances)...)
+	errs = append(errs, aliasErrors(cfg.Instances)...)
+	return errs
 }
 
 type Settings struct {
-	ServerBin           string `json:"server_bin"`
-	ManagerPort         int    `json:"manager_port"`
-	RestartDelay        string `json:"restart_delay"`
-	MaxRestarts         int    `json:"max_restarts"`
-	HealthCheckInterval string `json:"health_check_interval"`
-	GPUBackend          string `json:"gpu_backend"`
-	Host                string `json:"host"`
-	NGL                 int    `json:"ngl"`
-	MainGPU             int    `json:"main_gpu"`
-	ContextLength       int    `json:"context_length"`
-	CacheTypeK          string `json:"cache_type_k"`
-	CacheTypeV          string `json:"cache_type_v"`
+	ServerBin             string `json:"server_bin"`
+	ManagerHost           string `json:"manager_host"`
+	ManagerPort           int    `json:"manager_port"`
+	RestartDelay          string `json:"restart_delay"`
+	MaxRestarts           int    `json:"max_restarts"`
+	HealthCheckInterval   string `json:"health_check_interval"`
+	GPUBackend            string `json:"gpu_backend"`
+	Host                  string `json:"host"`
+	NGL                   int    `json:"ngl"`
+	MainGPU               int    `json:"main_gpu"`
+	ContextLength         int    `json:"context_length"`
+	CacheTypeK            string `json:"cache_type_k"`
+	CacheTypeV            string `json:"cache_type_v"`
+	FlashAttn             bool   `json:"flash_attn"`
+	WebhookURL            string `json:"webhook_url"`
+	RollingRestartTimeout string `json:"rolling_restart_timeout"`
+	DrainTimeout          string `json:"drain_timeout"`
+	StopTimeout           string `json:"stop_timeout"`
+	Warmup                bool   `json:"warmup"`
+	RestartOnOOM          bool   `json:"restart_on_oom"`
+	PortRangeStart        int    `json:"port_range_start"`
+	PortRangeEnd          int    `json:"port_range_end"`
+	GPUOverlap            string `json:"gpu_overlap"`
+	VRAMCheck             string `json:"vram_check"`
+	ProxyBalance          string `json:"proxy_balance"`
+	HFTokenSet            bool   `json:"hf_token_set"`
+	ReadOnly              bool   `json:"read_only"`
 }
 
 func (cfg *Config) GetSettings() Settings {
 	cfg.mu.RLock()
 	defer cfg.mu.RUnlock()
 	return Settings{
-		ServerBin:           cfg.ServerBin,
-		ManagerPort:         cfg.ManagerPort,
-		RestartDelay:        cfg.RestartDelay.Duration.String(),
-		MaxRestarts:         cfg.MaxRestarts,
-		HealthCheckInterval: cfg.HealthCheckInterval.Duration.String(),
-		GPUBackend:          cfg.GPUBackend,
-		Host:                cfg.Host,
-		NGL:                 cfg.NGL,
-		MainGPU:             cfg.MainGPU,
-		ContextLength:       cfg.ContextLength,
-		CacheTypeK:          cfg.CacheTypeK,
-		CacheTypeV:          cfg.CacheTypeV,
+		ServerBin:             cfg.ServerBin,
+		ManagerHost:           cfg.ManagerHost,
+		ManagerPort:           cfg.ManagerPort,
+		RestartDelay:          cfg.RestartDelay.Duration.String(),
+		MaxRestarts:           cfg.MaxRestarts,
+		HealthCheckInterval:   cfg.HealthCheckInterval.Duration.String(),
+		GPUBackend:            cfg.GPUBackend,
+		Host:                  cfg.Host,
+		NGL:                   cfg.NGL,
+		MainGPU:               cfg.MainGPU,
+		ContextLength:         cfg.ContextLength,
+		CacheTypeK:            cfg.CacheTypeK,
+		CacheTypeV:            cfg.CacheTypeV,
+		FlashAttn:             cfg.FlashAttn,
+		WebhookURL:            cfg.WebhookURL,
+		RollingRestartTimeout: cfg.RollingRestartTimeout.Duration.String(),
+		DrainTimeout:          cfg.DrainTimeout.Duration.String(),
+		StopTimeout:           cfg.StopTimeout.Duration.String(),
+		Warmup:                cfg.Warmup,
+		RestartOnOOM:          cfg.RestartOnOOM,
+		PortRangeStart:        cfg.PortRangeStart,
+		PortRangeEnd:          cfg.PortRangeEnd,
+		GPUOverlap:            cfg.GPUOverlap,
+		VRAMCheck:             cfg.VRAMCheck,
+		ProxyBalance:          cfg.ProxyBalance,
+		HFTokenSet:            cfg.hfTokenLocked() != "",
+		ReadOnly:              cfg.ReadOnly,
+	}
+}
+
+func (cfg *Config) IsReadOnly() bool {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.ReadOnly
+}
+
+func (cfg *Config) StatePath() string {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	if cfg.StateFile != "" {
+		return cfg.StateFile
+	}
+	if cfg.path == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(cfg.path), "llama-manager.state.json")
+}
+
+func (cfg *Config) AuditPath() string {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	if cfg.AuditFile != "" {
+		return cfg.AuditFile
+	}
+	if cfg.path == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(cfg.path), "llama-manager.audit.jsonl")
+}
+
+func (cfg *Config) BodyLimits() (jsonBody, upload int64) {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.MaxJSONBody, cfg.MaxUploadSize
+}
+
+// DownloadSettings returns download_timeout and the compiled
+// download_done_patterns, read per download so an imported config applies to
+// the next one.
+func (cfg *Config) DownloadSettings() (time.Duration, []*regexp.Regexp, error) {
+	cfg.mu.RLock()
+	timeout, patterns := cfg.DownloadTimeout.Duration, cfg.DownloadDonePatterns
+	cfg.mu.RUnlock()
+	done, err := compileDonePatterns(patterns)
+	return timeout, done, err
+}
+
+func (cfg *Config) HuggingFaceToken() string {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.hfTokenLocked()
+}
+
+func (cfg *Config) hfTokenLocked() string {
+	if cfg.HFToken != "" {
+		return cfg.HFToken
 	}
+	return os.Getenv("HF_TOKEN")
 }
 
 func (cfg *Config) UpdateSettings(s Settings) error {
@@ -200,10 +808,27 @@ func (cfg *Config) UpdateSettings(s Settings) error {
 	if s.ContextLength <= 0 {
 		return fmt.Errorf("context_length must be > 0")
 	}
-	if s.GPUBackend != "" {
-		validBackends := map[string]bool{"vulkan": true, "cuda": true, "rocm": true, "rocm_rocr": true, "metal": true}
-		if !validBackends[s.GPUBackend] {
-			return fmt.Errorf("gpu_backend must be one of: vulkan, cuda, rocm, rocm_rocr")
+	if s.GPUBackend != "" && !validGPUBackends[s.GPUBackend] {
+		return fmt.Errorf("gpu_backend must be one of: vulkan, cuda, rocm, rocm_rocr, metal")
+	}
+	if s.PortRangeStart != 0 || s.PortRangeEnd != 0 {
+		if err := validatePortRange(s.PortRangeStart, s.PortRangeEnd); err != nil {
+			return err
+		}
+	}
+	if s.GPUOverlap != "" && !validGPUOverlapMode(s.GPUOverlap) {
+		return fmt.Errorf("gpu_overlap must be one of: advisory, strict")
+	}
+	if s.VRAMCheck != "" && !validVRAMCheckMode(s.VRAMCheck) {
+		return fmt.Errorf("vram_check must be one of: advisory, strict, off")
+	}
+	if s.ProxyBalance != "" && !validBalanceMode(s.ProxyBalance) {
+		return fmt.Errorf("proxy_balance must be one of: least_busy, round_robin")
+	}
+	if s.WebhookURL != "" {
+		u, err := url.Parse(s.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook_url must be an http or https URL")
 		}
 	}
 
@@ -230,6 +855,36 @@ func (cfg *Config) UpdateSettings(s Settings) error {
 		}
 		cfg.HealthCheckInterval = duration{d}
 	}
+	if s.RollingRestartTimeout != "" {
+		d, err := time.ParseDuration(s.RollingRestartTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid rolling_restart_timeout: %w", err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("rolling_restart_timeout must be > 0")
+		}
+		cfg.RollingRestartTimeout = duration{d}
+	}
+	if s.DrainTimeout != "" {
+		d, err := time.ParseDuration(s.DrainTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid drain_timeout: %w", err)
+		}
+		if d < 0 {
+			return fmt.Errorf("drain_timeout must be >= 0")
+		}
+		cfg.DrainTimeout = duration{d}
+	}
+	if s.StopTimeout != "" {
+		d, err := time.ParseDuration(s.StopTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid stop_timeout: %w", err)
+		}
+		if d < 0 {
+			return fmt.Errorf("stop_timeout must be >= 0")
+		}
+		cfg.StopTimeout = duration{d}
+	}
 	cfg.MaxRestarts = s.MaxRestarts
 	if s.GPUBackend != "" {
 		cfg.GPUBackend = s.GPUBackend
@@ -246,10 +901,133 @@ func (cfg *Config) UpdateSettings(s Settings) error {
 	if s.CacheTypeV != "" {
 		cfg.CacheTypeV = s.CacheTypeV
 	}
+	cfg.FlashAttn = s.FlashAttn
+	cfg.Warmup = s.Warmup
+	cfg.RestartOnOOM = s.RestartOnOOM
+	cfg.WebhookURL = s.WebhookURL
+	if s.GPUOverlap != "" {
+		cfg.GPUOverlap = s.GPUOverlap
+	}
+	if s.VRAMCheck != "" {
+		cfg.VRAMCheck = s.VRAMCheck
+	}
+	if s.ProxyBalance != "" {
+		cfg.ProxyBalance = s.ProxyBalance
+	}
+	if s.PortRangeStart != 0 || s.PortRangeEnd != 0 {
+		cfg.PortRangeStart = s.PortRangeStart
+		cfg.PortRangeEnd = s.PortRangeEnd
+	}
 
 	return cfg.saveLocked()
 }
 
+// applyImportedLocked takes every setting from an imported config, already
+// defaulted by parseConfig, so what the file says is what runs and what the
+// next save writes back. Instances and the settings listed by
+// restartOnlyChangesLocked are still kept but only take effect on restart.
+// The caller holds cfg.mu.
+func (cfg *Config) applyImportedLocked(src *Config) {
+	cfg.ServerBin = src.ServerBin
+	cfg.ManagerHost = src.ManagerHost
+	cfg.ManagerPort = src.ManagerPort
+	cfg.TLSCert = src.TLSCert
+	cfg.TLSKey = src.TLSKey
+	cfg.TLSSelfSigned = src.TLSSelfSigned
+	cfg.StateFile = src.StateFile
+	cfg.AuditFile = src.AuditFile
+	cfg.InstancesDir = src.InstancesDir
+	cfg.ReadOnly = src.ReadOnly
+	cfg.AllowedOrigins = src.AllowedOrigins
+	cfg.APIKeys = src.APIKeys
+	cfg.AnonymousRole = src.AnonymousRole
+	cfg.RestartDelay = src.RestartDelay
+	cfg.MaxRestarts = src.MaxRestarts
+	cfg.RestartOnOOM = src.RestartOnOOM
+	cfg.HealthCheckInterval = src.HealthCheckInterval
+	cfg.GPUBackend = src.GPUBackend
+	cfg.GPUEnvVarName = src.GPUEnvVarName
+	cfg.Host = src.Host
+	cfg.NGL = src.NGL
+	cfg.MainGPU = src.MainGPU
+	cfg.ContextLength = src.ContextLength
+	cfg.CacheTypeK = src.CacheTypeK
+	cfg.CacheTypeV = src.CacheTypeV
+	cfg.FlashAttn = src.FlashAttn
+	cfg.Parallel = src.Parallel
+	cfg.BatchSize = src.BatchSize
+	cfg.UBatchSize = src.UBatchSize
+	cfg.Threads = src.Threads
+	cfg.Timeout = src.Timeout
+	cfg.LogFormat = src.LogFormat
+	cfg.LogBufferSize = src.LogBufferSize
+	cfg.WebhookURL = src.WebhookURL
+	cfg.Notifications = src.Notifications
+	cfg.HFToken = src.HFToken
+	cfg.DownloadDonePatterns = src.DownloadDonePatterns
+	cfg.DownloadTimeout = src.DownloadTimeout
+	cfg.RollingRestartTimeout = src.RollingRestartTimeout
+	cfg.DrainTimeout = src.DrainTimeout
+	cfg.StopTimeout = src.StopTimeout
+	cfg.ShutdownTimeout = src.ShutdownTimeout
+	cfg.DetachOnShutdown = src.DetachOnShutdown
+	cfg.DependencyTimeout = src.DependencyTimeout
+	cfg.WakeTimeout = src.WakeTimeout
+	cfg.StartupTimeout = src.StartupTimeout
+	cfg.StartupConcurrency = src.StartupConcurrency
+	cfg.StartupStagger = src.StartupStagger
+	cfg.ReadyHealthChecks = src.ReadyHealthChecks
+	cfg.UnhealthyThreshold = src.UnhealthyThreshold
+	cfg.Warmup = src.Warmup
+	cfg.WarmupTimeout = src.WarmupTimeout
+	cfg.PortRangeStart = src.PortRangeStart
+	cfg.PortRangeEnd = src.PortRangeEnd
+	cfg.GPUOverlap = src.GPUOverlap
+	cfg.VRAMCheck = src.VRAMCheck
+	cfg.ProxyBalance = src.ProxyBalance
+	cfg.MetricsCacheTTL = src.MetricsCacheTTL
+	cfg.MetricsInterval = src.MetricsInterval
+	cfg.MetricsRetention = src.MetricsRetention
+	cfg.MaxJSONBody = src.MaxJSONBody
+	cfg.MaxUploadSize = src.MaxUploadSize
+	// A setting that is now a literal must lose its old ${VAR} template, or
+	// the next save would write the template back. Instances aren't replaced
+	// until restart, so they keep their own.
+	templates := make(map[string]string)
+	for key, tmpl := range src.envTemplates {
+		if !strings.HasPrefix(key, "instances.") {
+			templates[key] = tmpl
+		}
+	}
+	for key, tmpl := range cfg.envTemplates {
+		if strings.HasPrefix(key, "instances.") {
+			templates[key] = tmpl
+		}
+	}
+	cfg.envTemplates = templates
+}
+
+// restartOnlyChangesLocked names the settings src changes that are only read
+// at startup: the listener, its certificate, and the files the manager opens.
+// The caller holds cfg.mu.
+func (cfg *Config) restartOnlyChangesLocked(src *Config) []string {
+	var names []string
+	changed := func(name string, differs bool) {
+		if differs {
+			names = append(names, name)
+		}
+	}
+	changed("manager_host", cfg.ManagerHost != src.ManagerHost)
+	changed("manager_port", cfg.ManagerPort != src.ManagerPort)
+	changed("tls_cert", cfg.TLSCert != src.TLSCert)
+	changed("tls_key", cfg.TLSKey != src.TLSKey)
+	changed("tls_self_signed", cfg.TLSSelfSigned != src.TLSSelfSigned)
+	changed("instances_dir", cfg.InstancesDir != src.InstancesDir)
+	changed("state_file", cfg.StateFile != src.StateFile)
+	changed("audit_file", cfg.AuditFile != src.AuditFile)
+	return names
+}
+
 func (cfg *Config) GetInstances() []InstanceConf {
 	cfg.mu.RLock()
 	defer cfg.mu.RUnlock()
@@ -258,60 +1036,429 @@ func (cfg *Config) GetInstances() []InstanceConf {
 	return out
 }
 
-func (cfg *Config) AddInstance(ic InstanceConf) error {
+func (cfg *Config) GetInstance(name string) (InstanceConf, error) {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	for _, ic := range cfg.Instances {
+		if ic.Name == name {
+			return ic, nil
+		}
+	}
+	return InstanceConf{}, fmt.Errorf("%w: %q", errInstanceNotFound, name)
+}
+
+type EffectiveInstance struct {
+	NGL                int      `json:"ngl"`
+	ContextLength      int      `json:"context_length"`
+	CacheTypeK         string   `json:"cache_type_k"`
+	CacheTypeV         string   `json:"cache_type_v"`
+	FlashAttn          bool     `json:"flash_attn"`
+	AutoStart          bool     `json:"auto_start"`
+	LogBufferSize      int      `json:"log_buffer_size"`
+	Parallel           int      `json:"parallel,omitempty"`
+	BatchSize          int      `json:"batch_size,omitempty"`
+	UBatchSize         int      `json:"ubatch_size,omitempty"`
+	Threads            int      `json:"threads,omitempty"`
+	Timeout            int      `json:"timeout,omitempty"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold"`
+	MaxRestarts        int      `json:"max_restarts"`
+	RestartDelay       duration `json:"restart_delay"`
+}
+
+func (cfg *Config) serverKnobDefaults() []serverKnob {
+	return []serverKnob{
+		{"parallel", &cfg.Parallel},
+		{"batch_size", &cfg.BatchSize},
+		{"ubatch_size", &cfg.UBatchSize},
+		{"threads", &cfg.Threads},
+		{"timeout", &cfg.Timeout},
+	}
+}
+
+func (eff EffectiveInstance) serverArgs() []string {
+	var args []string
+	for _, a := range []struct {
+		flag  string
+		value int
+	}{
+		{"-np", eff.Parallel},
+		{"-b", eff.BatchSize},
+		{"-ub", eff.UBatchSize},
+		{"-t", eff.Threads},
+		{"--timeout", eff.Timeout},
+	} {
+		if a.value > 0 {
+			args = append(args, a.flag, strconv.Itoa(a.value))
+		}
+	}
+	return args
+}
+
+// serverSwitches returns the llama-server flags for the on/off settings that
+// are on. Settings that are off add nothing, leaving llama-server's default.
+func (eff EffectiveInstance) serverSwitches() []string {
+	var args []string
+	for _, s := range []struct {
+		args []string
+		on   bool
+	}{
+		{[]string{"--flash-attn", "on"}, eff.FlashAttn},
+	} {
+		if s.on {
+			args = append(args, s.args...)
+		}
+	}
+	return args
+}
+
+func intOverride(def int, override *int) int {
+	if override != nil {
+		return *override
+	}
+	return def
+}
+
+func (cfg *Config) Effective(ic InstanceConf) EffectiveInstance {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.effectiveLocked(ic)
+}
+
+func (cfg *Config) effectiveLocked(ic InstanceConf) EffectiveInstance {
+	eff := EffectiveInstance{
+		NGL:           cfg.NGL,
+		ContextLength: cfg.ContextLength,
+		CacheTypeK:    cfg.CacheTypeK,
+		CacheTypeV:    cfg.CacheTypeV,
+		FlashAttn:     cfg.FlashAttn,
+		AutoStart:     ic.ShouldAutoStart(),
+		LogBufferSize: cfg.LogBufferSize,
+	}
+	if ic.NGL != nil {
+		eff.NGL = *ic.NGL
+	}
+	if ic.ContextLength != nil {
+		eff.ContextLength = *ic.ContextLength
+	}
+	if ic.CacheTypeK != nil {
+		eff.CacheTypeK = *ic.CacheTypeK
+	}
+	if ic.CacheTypeV != nil {
+		eff.CacheTypeV = *ic.CacheTypeV
+	}
+	if ic.FlashAttn != nil {
+		eff.FlashAttn = *ic.FlashAttn
+	}
+	if ic.LogBufferSize != nil {
+		eff.LogBufferSize = *ic.LogBufferSize
+	}
+	eff.Parallel = intOverride(cfg.Parallel, ic.Parallel)
+	eff.BatchSize = intOverride(cfg.BatchSize, ic.BatchSize)
+	eff.UBatchSize = intOverride(cfg.UBatchSize, ic.UBatchSize)
+	eff.Threads = intOverride(cfg.Threads, ic.Threads)
+	eff.Timeout = intOverride(cfg.Timeout, ic.Timeout)
+	eff.UnhealthyThreshold = intOverride(cfg.UnhealthyThreshold, ic.UnhealthyThreshold)
+	eff.MaxRestarts = intOverride(cfg.MaxRestarts, ic.MaxRestarts)
+	eff.RestartDelay = cfg.RestartDelay
+	if ic.RestartDelay != nil {
+		eff.RestartDelay = *ic.RestartDelay
+	}
+	if eff.LogBufferSize <= 0 {
+		eff.LogBufferSize = logBufferSize
+	}
+	return eff
+}
+
+// checkGPUIDs requires gpu_ids when the backend selects GPUs through an
+// environment variable. Metal and CPU-only setups can leave them out.
+func (cfg *Config) checkGPUIDs(ic InstanceConf) error {
+	if len(ic.GPUIDs) == 0 && cfg.instanceGPUEnvVar(ic) != "" {
+		return fmt.Errorf("gpu_ids must contain at least one GPU ID")
+	}
+	return nil
+}
+
+func (cfg *Config) checkNewInstanceLocked(ic InstanceConf) (InstanceConf, []string, error) {
+	if err := cfg.checkGPUIDs(ic); err != nil {
+		return ic, nil, err
+	}
+	for _, existing := range cfg.Instances {
+		if existing.Name == ic.Name {
+			return ic, nil, fmt.Errorf("duplicate instance name: %q", ic.Name)
+		}
+		if ic.Port != 0 && existing.Port == ic.Port {
+			return ic, nil, fmt.Errorf("duplicate port: %d", ic.Port)
+		}
+	}
+	all := append(append([]InstanceConf{}, cfg.Instances...), ic)
+	if errs := append(dependencyErrors(all), aliasErrors(all)...); len(errs) > 0 {
+		return ic, nil, errors.Join(errs...)
+	}
+	warnings, err := cfg.checkGPUOverlapLocked(-1, ic)
+	if err != nil {
+		return ic, nil, err
+	}
+	if _, err := cfg.instanceFilePathLocked(ic.Name); err != nil {
+		return ic, nil, err
+	}
+	if w := modelWarning(ic.Model); w != "" {
+		warnings = append(warnings, w)
+	}
+	return ic, warnings, nil
+}
+
+func (cfg *Config) CheckInstance(ic InstanceConf) (InstanceConf, []string, error) {
+	if err := ic.Validate(); err != nil {
+		return ic, nil, err
+	}
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.checkNewInstanceLocked(ic)
+}
+
+func (cfg *Config) AddInstance(ic InstanceConf) (InstanceConf, []string, error) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	ic, warnings, err := cfg.checkNewInstanceLocked(ic)
+	if err != nil {
+		return ic, nil, err
+	}
+	ic.source, err = cfg.instanceFileLocked(ic.Name)
+	if err != nil {
+		return ic, nil, err
+	}
+	cfg.Instances = append(cfg.Instances, ic)
+	return ic, warnings, cfg.saveLocked()
+}
+
+// CloneOptions says how a clone differs from its source. A zero Port gives
+// the clone port: auto.
+type CloneOptions struct {
+	Name   string `json:"name"`
+	Port   int    `json:"port,omitempty"`
+	GPUIDs []int  `json:"gpu_ids,omitempty"`
+}
+
+func (ic InstanceConf) clone() InstanceConf {
+	c := ic
+	c.GPUIDs = append([]int(nil), ic.GPUIDs...)
+	c.TensorSplit = append([]float64(nil), ic.TensorSplit...)
+	c.Tags = append([]string(nil), ic.Tags...)
+	c.GPUDevices = append([]string(nil), ic.GPUDevices...)
+	c.DependsOn = append([]string(nil), ic.DependsOn...)
+	c.StartAfter = append([]string(nil), ic.StartAfter...)
+	c.Schedule = append([]ScheduleEntry(nil), ic.Schedule...)
+	c.Aliases = append([]string(nil), ic.Aliases...)
+	c.ExtraArgs = append([]string(nil), ic.ExtraArgs...)
+	if ic.IdleTimeout != nil {
+		d := *ic.IdleTimeout
+		c.IdleTimeout = &d
+	}
+	if ic.HealthTimeout != nil {
+		d := *ic.HealthTimeout
+		c.HealthTimeout = &d
+	}
+	if ic.UnhealthyThreshold != nil {
+		n := *ic.UnhealthyThreshold
+		c.UnhealthyThreshold = &n
+	}
+	if ic.StartupTimeout != nil {
+		d := *ic.StartupTimeout
+		c.StartupTimeout = &d
+	}
+	if ic.MaxRestarts != nil {
+		n := *ic.MaxRestarts
+		c.MaxRestarts = &n
+	}
+	if ic.RestartDelay != nil {
+		d := *ic.RestartDelay
+		c.RestartDelay = &d
+	}
+	c.source = ""
+	return c
+}
+
+func (opts CloneOptions) Validate(source string) error {
+	if opts.Name == "" || opts.Name == source {
+		return fmt.Errorf("clone needs a new name different from %q", source)
+	}
+	if opts.Port < 0 || opts.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535, or 0 to auto-assign")
+	}
+	return nil
+}
+
+// CloneInstance copies the named instance's config, applies opts and adds the
+// result through the same checks as AddInstance.
+func (cfg *Config) CloneInstance(source string, opts CloneOptions) (InstanceConf, []string, error) {
 	cfg.mu.Lock()
 	defer cfg.mu.Unlock()
+	var ic InstanceConf
+	found := false
 	for _, existing := range cfg.Instances {
-		if existing.Name == ic.Name {
-			return fmt.Errorf("duplicate instance name: %q", ic.Name)
+		if existing.Name == source {
+			ic, found = existing.clone(), true
+			break
 		}
-		if existing.Port == ic.Port {
-			return fmt.Errorf("duplicate port: %d", ic.Port)
+	}
+	if !found {
+		return InstanceConf{}, nil, errInstanceNotFound
+	}
+	ic.Name = opts.Name
+	ic.Port = opts.Port
+	ic.Aliases = nil
+	if len(opts.GPUIDs) > 0 {
+		ic.GPUIDs = append([]int(nil), opts.GPUIDs...)
+		ic.GPUDevices = nil
+		if len(ic.TensorSplit) != len(ic.GPUIDs) {
+			ic.TensorSplit = nil
+		}
+	}
+	if err := ic.Validate(); err != nil {
+		return ic, nil, err
+	}
+	ic, warnings, err := cfg.checkNewInstanceLocked(ic)
+	if err != nil {
+		return ic, nil, err
+	}
+	ic.source, err = cfg.instanceFileLocked(ic.Name)
+	if err != nil {
+		return ic, nil, err
+	}
+	for field := range ic.envFields() {
+		if tmpl, ok := cfg.envTemplates[instanceEnvKey(source, field)]; ok {
+			cfg.envTemplates[instanceEnvKey(ic.Name, field)] = tmpl
 		}
 	}
 	cfg.Instances = append(cfg.Instances, ic)
-	return cfg.saveLocked()
+	return ic, warnings, cfg.saveLocked()
 }
 
-func (cfg *Config) UpdateInstance(name string, ic InstanceConf) error {
+func (cfg *Config) UpdateInstance(name string, ic InstanceConf) (InstanceConf, []string, error) {
 	cfg.mu.Lock()
 	defer cfg.mu.Unlock()
 	for i, existing := range cfg.Instances {
 		if existing.Name == name {
+			if err := cfg.checkGPUIDs(ic); err != nil {
+				return ic, nil, err
+			}
 			for j, other := range cfg.Instances {
-				if i != j && other.Port == ic.Port {
-					return fmt.Errorf("duplicate port: %d", ic.Port)
+				if i != j && ic.Port != 0 && other.Port == ic.Port {
+					return ic, nil, fmt.Errorf("duplicate port: %d", ic.Port)
 				}
 				if i != j && other.Name == ic.Name {
-					return fmt.Errorf("duplicate instance name: %q", ic.Name)
+					return ic, nil, fmt.Errorf("duplicate instance name: %q", ic.Name)
 				}
 			}
+			updated := append([]InstanceConf{}, cfg.Instances...)
+			updated[i] = ic
+			if errs := append(dependencyErrors(updated), aliasErrors(updated)...); len(errs) > 0 {
+				return ic, nil, errors.Join(errs...)
+			}
+			warnings, err := cfg.checkGPUOverlapLocked(i, ic)
+			if err != nil {
+				return ic, nil, err
+			}
+			ic.source = existing.source
 			cfg.Instances[i] = ic
-			return cfg.saveLocked()
+			return ic, warnings, cfg.saveLocked()
 		}
 	}
-	return fmt.Errorf("instance %q not found", name)
+	return ic, nil, fmt.Errorf("instance %q not found", name)
 }
 
 func (cfg *Config) DeleteInstance(name string) error {
 	cfg.mu.Lock()
 	defer cfg.mu.Unlock()
+	for _, other := range cfg.Instances {
+		for _, dep := range other.DependsOn {
+			if dep == name {
+				return fmt.Errorf("instance %q is a dependency of %q", name, other.Name)
+			}
+		}
+		for _, dep := range other.StartAfter {
+			if dep == name {
+				return fmt.Errorf("instance %q must start before %q", name, other.Name)
+			}
+		}
+	}
 	for i, existing := range cfg.Instances {
 		if existing.Name == name {
 			cfg.Instances = append(cfg.Instances[:i], cfg.Instances[i+1:]...)
+			delete(cfg.autoPorts, name)
+			if existing.source != "" {
+				if err := os.Remove(existing.source); err != nil && !os.IsNotExist(err) {
+					return fmt.Errorf("removing instance file: %w", err)
+				}
+			}
 			return cfg.saveLocked()
 		}
 	}
-	return fmt.Errorf("instance %q not found", name)
+	return fmt.Errorf("%w: %q", errInstanceNotFound, name)
+}
+
+// createTemp is os.CreateTemp; tests replace it to make writes fail.
+var createTemp = os.CreateTemp
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	tmp, err := createTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
 
 func (cfg *Config) saveLocked() error {
 	if cfg.path == "" {
 		return nil
 	}
+	all := cfg.Instances
+	inline := []InstanceConf{}
+	for _, ic := range all {
+		cfg.unexpandInstanceLocked(&ic)
+		if ic.source == "" {
+			inline = append(inline, ic)
+			continue
+		}
+		data, err := yaml.Marshal(ic)
+		if err != nil {
+			return fmt.Errorf("marshaling instance %q: %w", ic.Name, err)
+		}
+		if err := writeFileAtomic(ic.source, data, 0644); err != nil {
+			return fmt.Errorf("writing instance file: %w", err)
+		}
+	}
+	cfg.Instances = inline
+	restore := cfg.unexpandLocked()
 	data, err := yaml.Marshal(cfg)
+	restore()
+	cfg.Instances = all
 	if err != nil {
 		return fmt.Errorf("marshaling config: %w", err)
 	}
-	return os.WriteFile(cfg.path, data, 0644)
+	if err := writeFileAtomic(cfg.path, data, 0644); err != nil {
+		return fmt.Errorf("writing config: %w", err)
+	}
+	return nil
 }
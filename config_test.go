@@ -0,0 +1,171 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGPUEnvVar(t *testing.T) {
+	tests := []struct {
+		backend  string
+		override string
+		want     string
+	}{
+		{"vulkan", "", "GGML_VK_VISIBLE_DEVICES"},
+		{"cuda", "", "CUDA_VISIBLE_DEVICES"},
+		{"rocm", "", "HIP_VISIBLE_DEVICES"},
+		{"rocm_rocr", "", "ROCR_VISIBLE_DEVICES"},
+		{"metal", "", ""},
+		{"vulkan", "GPU_DEVICES", "GPU_DEVICES"},
+		{"cuda", "GPU_DEVICES", "GPU_DEVICES"},
+		{"metal", "GPU_DEVICES", "GPU_DEVICES"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.backend+"/"+tt.override, func(t *testing.T) {
+			cfg := &Config{GPUBackend: tt.backend, GPUEnvVarName: tt.override}
+			if got := cfg.GPUEnvVar(); got != tt.want {
+				t.Errorf("GPUEnvVar() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGPUDeviceList(t *testing.T) {
+	tests := []struct {
+		name    string
+		ids     GPUList
+		devices []string
+		want    string
+	}{
+		{"indices", GPUList{0, 2}, nil, "0,2"},
+		{"device strings used verbatim", GPUList{0, 1}, []string{"GPU-1a2b", "GPU-3c4d"}, "GPU-1a2b,GPU-3c4d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ic := InstanceConf{GPUIDs: tt.ids, GPUDevices: tt.devices}
+			if got := ic.GPUDeviceList(); got != tt.want {
+				t.Errorf("GPUDeviceList() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomicKeepsOriginalOnFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte("original"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Hand back the temp file opened read-only, so writing to it fails.
+	createTemp = func(dir, pattern string) (*os.File, error) {
+		f, err := os.CreateTemp(dir, pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		return os.Open(f.Name())
+	}
+	t.Cleanup(func() { createTemp = os.CreateTemp })
+
+	if err := writeFileAtomic(path, []byte("replacement"), 0644); err == nil {
+		t.Fatal("writeFileAtomic succeeded, want the write error")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "original" {
+		t.Errorf("config = %q after a failed write, want %q", data, "original")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("dir has %d entries, want only the config (temp file left behind?)", len(entries))
+	}
+}
+
+func TestWriteFileAtomicKeepsMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("original"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte("replacement"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+	}
+	if data, _ := os.ReadFile(path); string(data) != "replacement" {
+		t.Errorf("config = %q, want %q", data, "replacement")
+	}
+}
+
+func TestGPUIDsRequiredOnlyWithGPUEnvVar(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		envVar  string
+		wantErr bool
+	}{
+		{name: "cuda", backend: "cuda", wantErr: true},
+		{name: "vulkan", backend: "vulkan", wantErr: true},
+		{name: "metal", backend: "metal"},
+		{name: "metal with gpu_env_var", backend: "metal", envVar: "MY_DEVICES", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := "gpu_backend: " + tt.backend + "\n"
+			if tt.envVar != "" {
+				data += "gpu_env_var: " + tt.envVar + "\n"
+			}
+			cfg := testConfig(t, data+"instances:\n  - name: a\n    model: /models/a.gguf\n    port: 9000\n")
+			errs := validateConfig(cfg)
+			if gotErr := len(errs) > 0; gotErr != tt.wantErr {
+				t.Errorf("validateConfig = %v, want error: %v", errs, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReservedInstanceNames(t *testing.T) {
+	for _, name := range []string{"all", "batch", "tag"} {
+		ic := InstanceConf{Name: name, Model: "/models/a.gguf", Port: 9000, GPUIDs: GPUList{0}}
+		if err := ic.Validate(); err == nil {
+			t.Errorf("instance named %q validated", name)
+		}
+	}
+}
+
+func TestInstanceGPUEnvVarOverride(t *testing.T) {
+	cfg := testConfig(t, "gpu_backend: vulkan\n")
+	tests := []struct {
+		name    string
+		backend string
+		envVar  string
+		want    string
+	}{
+		{name: "global", want: "GGML_VK_VISIBLE_DEVICES"},
+		{name: "instance backend", backend: "cuda", want: "CUDA_VISIBLE_DEVICES"},
+		{name: "instance env var", envVar: "MY_DEVICES", want: "MY_DEVICES"},
+		{name: "instance metal", backend: "metal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := InstanceConf{Name: "a", Model: "/models/a.gguf", Port: 9000, GPUIDs: GPUList{1}, GPUBackend: tt.backend, GPUEnvVarName: tt.envVar}
+			lc := buildArgs(cfg, conf)
+			if lc.GPUEnvVar != tt.want {
+				t.Errorf("GPUEnvVar = %q, want %q", lc.GPUEnvVar, tt.want)
+			}
+			if tt.want != "" && lc.Env[tt.want] != "1" {
+				t.Errorf("env = %v, want %s=1", lc.Env, tt.want)
+			}
+		})
+	}
+}
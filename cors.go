@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	corsAllowMethods = "GET, POST, PUT, DELETE, OPTIONS"
+	corsAllowHeaders = "Content-Type, Authorization, X-API-Key"
+	corsMaxAge       = "600"
+)
+
+func validateOrigins(origins []string) []error {
+	var errs []error
+	for _, o := range origins {
+		if o == "*" {
+			if len(origins) > 1 {
+				errs = append(errs, fmt.Errorf("allowed_origins: \"*\" must be the only entry"))
+			}
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			errs = append(errs, fmt.Errorf("allowed_origins: %q must look like https://host[:port]", o))
+		}
+	}
+	return errs
+}
+
+func (cfg *Config) corsOrigin(origin string) string {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	for _, o := range cfg.AllowedOrigins {
+		if o == "*" {
+			return "*"
+		}
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+func sameOrigin(r *http.Request, origin string) bool {
+	return origin == "http://"+r.Host || origin == "https://"+r.Host
+}
+
+// applyCORS sets the CORS response headers for allowed cross-origin requests
+// and answers preflights. It reports whether the origin is allowed and whether
+// the request has been fully handled.
+func (ws *WebServer) applyCORS(w http.ResponseWriter, r *http.Request, origin string) (allowed, handled bool) {
+	allow := ws.cfg.corsOrigin(origin)
+	w.Header().Add("Vary", "Origin")
+	if allow == "" {
+		return false, false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", allow)
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+		w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		w.WriteHeader(http.StatusNoContent)
+		return true, true
+	}
+	return true, false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	crashHistorySize = 10
+	crashLogLines    = 50
+)
+
+// CrashSnapshot is what an instance looked like when its process died: how
+// it exited and the last lines it wrote.
+type CrashSnapshot struct {
+	Time     time.Time `json:"time"`
+	ExitCode *int      `json:"exit_code,omitempty"`
+	Signal   string    `json:"signal,omitempty"`
+	Error    string    `json:"error"`
+	Uptime   string    `json:"uptime,omitempty"`
+	OOM      bool      `json:"oom,omitempty"`
+	Logs     []string  `json:"logs"`
+}
+
+// exitStatus returns the exit code or terminating signal of a finished
+// process. Both are unknown for an adopted process, which isn't our child.
+func exitStatus(ps *os.ProcessState) (code *int, signal string) {
+	if ps == nil {
+		return nil, ""
+	}
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return nil, ws.Signal().String()
+	}
+	c := ps.ExitCode()
+	return &c, ""
+}
+
+func (inst *Instance) recordCrashLocked(code *int, signal string) {
+	lines := inst.logs.Lines()
+	if len(lines) > crashLogLines {
+		lines = lines[len(lines)-crashLogLines:]
+	}
+	now := time.Now()
+	c := CrashSnapshot{
+		Time:     now,
+		ExitCode: code,
+		Signal:   signal,
+		Error:    inst.lastError,
+		OOM:      inst.oom,
+		Logs:     lines,
+	}
+	if !inst.startedAt.IsZero() {
+		c.Uptime = now.Sub(inst.startedAt).Truncate(time.Second).String()
+	}
+	inst.crashes = append(inst.crashes, c)
+	if len(inst.crashes) > crashHistorySize {
+		inst.crashes = inst.crashes[len(inst.crashes)-crashHistorySize:]
+	}
+}
+
+// Crashes returns the snapshots of the instance's last crashes, oldest
+// first.
+func (inst *Instance) Crashes() []CrashSnapshot {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	out := make([]CrashSnapshot, len(inst.crashes))
+	copy(out, inst.crashes)
+	return out
+}
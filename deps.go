@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const dependencyPollInterval = time.Second
+
+func dependencyErrors(instances []InstanceConf) []error {
+	var errs []error
+	byName := make(map[string]InstanceConf, len(instances))
+	for _, ic := range instances {
+		byName[ic.Name] = ic
+	}
+	for _, ic := range instances {
+		for _, dep := range ic.DependsOn {
+			if dep == ic.Name {
+				errs = append(errs, fmt.Errorf("instance %q depends on itself", ic.Name))
+			} else if _, ok := byName[dep]; !ok {
+				errs = append(errs, fmt.Errorf("instance %q depends on unknown instance %q", ic.Name, dep))
+			}
+		}
+		for _, dep := range ic.StartAfter {
+			if dep == ic.Name {
+				errs = append(errs, fmt.Errorf("instance %q starts after itself", ic.Name))
+			} else if _, ok := byName[dep]; !ok {
+				errs = append(errs, fmt.Errorf("instance %q starts after unknown instance %q", ic.Name, dep))
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int, len(instances))
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			start := 0
+			for i, n := range path {
+				if n == name {
+					start = i
+					break
+				}
+			}
+			cycle := append(append([]string{}, path[start:]...), name)
+			return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range byName[name].predecessors() {
+			if _, ok := byName[dep]; !ok || dep == name {
+				continue
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+		return nil
+	}
+	for _, ic := range instances {
+		if state[ic.Name] == unvisited {
+			if err := visit(ic.Name); err != nil {
+				errs = append(errs, err)
+				path = nil
+			}
+		}
+	}
+	return errs
+}
+
+// predecessors lists the instances that must be started before ic, whether
+// they have to be running (depends_on) or only tried first (start_after).
+func (ic InstanceConf) predecessors() []string {
+	return slices.Concat(ic.DependsOn, ic.StartAfter)
+}
+
+func (m *Manager) waitForDependencies(inst *Instance, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(dependencyPollInterval)
+	defer ticker.Stop()
+	for {
+		var pending []string
+		for _, dep := range inst.conf.DependsOn {
+			d := m.Get(dep)
+			if d == nil {
+				return fmt.Errorf("dependency %q no longer exists", dep)
+			}
+			if d.State() != StateRunning {
+				pending = append(pending, dep)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return fmt.Errorf("dependencies not running after %s: %s", timeout, strings.Join(pending, ", "))
+		case <-m.stopCh:
+			return fmt.Errorf("manager shutting down")
+		}
+	}
+}
+
+// waitStartAfter waits until the start_after instances that this StartAll is
+// starting have finished loading, successfully or not, for up to timeout. It
+// reports false if the manager is shutting down.
+func (m *Manager) waitStartAfter(inst *Instance, loaded map[string]chan struct{}, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for _, name := range inst.conf.StartAfter {
+		done := loaded[name]
+		if done == nil {
+			continue
+		}
+		select {
+		case <-done:
+		case <-deadline:
+			instanceLogger(inst.conf.Name).Warn("start_after instances still loading, starting anyway", "event", "start_after_timeout", "start_after", strings.Join(inst.conf.StartAfter, ","))
+			return true
+		case <-m.stopCh:
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Manager) startAfterDependencies(inst *Instance, gate *startupGate, loaded map[string]chan struct{}) {
+	m.cfg.mu.RLock()
+	timeout := m.cfg.DependencyTimeout.Duration
+	m.cfg.mu.RUnlock()
+
+	log := instanceLogger(inst.conf.Name)
+	log.Info("waiting for dependencies", "event", "dependencies_waiting", "depends_on", strings.Join(inst.conf.DependsOn, ","), "start_after", strings.Join(inst.conf.StartAfter, ","))
+	done := loaded[inst.conf.Name]
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		if done != nil {
+			defer close(done)
+		}
+		if !m.waitStartAfter(inst, loaded, timeout) {
+			return
+		}
+		if err := m.waitForDependencies(inst, timeout); err != nil {
+			log.Error("not starting, dependencies never came up", "event", "dependencies_failed", "error", err)
+			inst.SetLastError(err.Error())
+			return
+		}
+		log.Info("dependencies running", "event", "dependencies_ready")
+		m.startGated(inst, gate, done != nil)
+	}()
+}
@@ -2,62 +2,195 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	searchDefaultLimit  = 20
+	searchMaxLimit      = 100
+	downloadHistorySize = 50
+)
+
+var (
+	errHFRateLimited  = errors.New("HuggingFace API rate limit exceeded, try again later")
+	errDownloadActive = errors.New("download already in progress")
+	errDownloadQueued = errors.New("download already queued")
+	errNotQueued      = errors.New("download is not queued")
+)
+
+// llama-server prints these once the model file is on disk.
+var defaultDonePatterns = []string{
+	`listening on`,
+	`server is listening`,
+	`all slots are idle`,
+	`llama_model_loader: loaded meta data`,
+	`load_tensors:`,
+}
+
+func compileDonePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		patterns = defaultDonePatterns
+	}
+	out := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile("(?i)" + p)
+		if err != nil {
+			return nil, fmt.Errorf("download_done_patterns: invalid pattern %q: %w", p, err)
+		}
+		out = append(out, re)
+	}
+	return out, nil
+}
+
+type hfRateLimitError struct {
+	RetryAfter string
+}
+
+func (e *hfRateLimitError) Error() string {
+	if e.RetryAfter != "" {
+		return errHFRateLimited.Error() + " (retry after " + e.RetryAfter + ")"
+	}
+	return errHFRateLimited.Error()
+}
+
+func (e *hfRateLimitError) Is(target error) bool {
+	return target == errHFRateLimited
+}
+
 type DownloadManager struct {
+	cfg       *Config
 	serverBin string
+	notifier  *Notifier
 	mu        sync.Mutex
 	active    *DownloadJob
+	queue     []QueuedDownload
+	nextID    int
+	history   []DownloadRecord
+}
+
+// QueuedDownload is a download waiting for the ones ahead of it. URL
+// downloads keep their file name in Repo, like DownloadJob.
+type QueuedDownload struct {
+	ID       string    `json:"id"`
+	Repo     string    `json:"repo"`
+	Quant    string    `json:"quant,omitempty"`
+	URL      string    `json:"url,omitempty"`
+	Queued   time.Time `json:"queued"`
+	Position int       `json:"position"`
+}
+
+func (d QueuedDownload) label() string {
+	if d.URL != "" {
+		return d.URL
+	}
+	return d.Repo + ":" + d.Quant
+}
+
+type DownloadRecord struct {
+	Repo     string    `json:"repo"`
+	Quant    string    `json:"quant,omitempty"`
+	URL      string    `json:"url,omitempty"`
+	Status   string    `json:"status"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Duration string    `json:"duration"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Error    string    `json:"error,omitempty"`
 }
 
 type DownloadJob struct {
-	Repo    string `json:"repo"`
-	Quant   string `json:"quant"`
-	Status  string `json:"status"` // "downloading", "done", "failed", "stopped"
-	Logs    []string `json:"logs"`
-	Started time.Time `json:"started"`
-	cmd     *exec.Cmd
-	mu      sync.Mutex
+	Repo       string    `json:"repo"`
+	Quant      string    `json:"quant"`
+	URL        string    `json:"url,omitempty"`
+	Status     string    `json:"status"` // "downloading", "done", "failed", "stopped"
+	Logs       []string  `json:"logs"`
+	Started    time.Time `json:"started"`
+	BytesDone  int64     `json:"bytes_done"`
+	BytesTotal int64     `json:"bytes_total"`
+	cmd        *exec.Cmd
+	cancel     context.CancelFunc
+	lastError  string
+	done       []*regexp.Regexp
+	exited     bool // set by finish; until then the job holds the download slot
+	mu         sync.Mutex
 }
 
 type DownloadStatus struct {
-	Active  bool     `json:"active"`
-	Repo    string   `json:"repo,omitempty"`
-	Quant   string   `json:"quant,omitempty"`
-	Status  string   `json:"status,omitempty"`
-	Logs    []string `json:"logs,omitempty"`
-	Elapsed string   `json:"elapsed,omitempty"`
+	Active     bool     `json:"active"`
+	Repo       string   `json:"repo,omitempty"`
+	Quant      string   `json:"quant,omitempty"`
+	URL        string   `json:"url,omitempty"`
+	Status     string   `json:"status,omitempty"`
+	Logs       []string `json:"logs,omitempty"`
+	Elapsed    string   `json:"elapsed,omitempty"`
+	BytesDone  int64    `json:"bytes_done,omitempty"`
+	BytesTotal int64    `json:"bytes_total,omitempty"`
+	Percent    float64  `json:"percent,omitempty"`
+	Queued     int      `json:"queued,omitempty"`
 }
 
-func NewDownloadManager(serverBin string) *DownloadManager {
-	return &DownloadManager{serverBin: serverBin}
+func NewDownloadManager(cfg *Config, serverBin string, notifier *Notifier) *DownloadManager {
+	return &DownloadManager{cfg: cfg, serverBin: serverBin, notifier: notifier}
 }
 
-func (dm *DownloadManager) Start(repo, quant string) error {
-	dm.mu.Lock()
-	defer dm.mu.Unlock()
+func setHFAuth(req *http.Request, token string) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
 
-	if dm.active != nil && dm.active.Status == "downloading" {
-		return fmt.Errorf("download already in progress: %s:%s", dm.active.Repo, dm.active.Quant)
+func redactToken(err error, token string) error {
+	if err == nil || token == "" || !strings.Contains(err.Error(), token) {
+		return err
 	}
+	return errors.New(strings.ReplaceAll(err.Error(), token, "[REDACTED]"))
+}
 
-	model := repo
+// Start downloads a HuggingFace model, or queues it behind the active
+// download. It returns the queue entry when the download was queued.
+func (dm *DownloadManager) Start(repo, quant string) (*QueuedDownload, error) {
+	spec := parseModelSpec(repo)
+	if spec.Local {
+		return nil, fmt.Errorf("repo must be a HuggingFace owner/repo id, not a local path")
+	}
 	if quant != "" {
-		model = repo + ":" + quant
+		spec.Quant = quant
 	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	return dm.enqueue(QueuedDownload{Repo: spec.Repo, Quant: spec.Quant})
+}
 
+func (dm *DownloadManager) startLocked(spec ModelSpec) error {
+	repo, quant := spec.Repo, spec.Quant
+	model := spec.String()
+	timeout, donePatterns, err := dm.cfg.DownloadSettings()
+	if err != nil {
+		return err
+	}
 	cmd := exec.Command(dm.serverBin, "-hf", model, "--port", "0")
+	if token := dm.cfg.HuggingFaceToken(); token != "" {
+		cmd.Env = append(os.Environ(), "HF_TOKEN="+token)
+	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -81,50 +214,403 @@ func (dm *DownloadManager) Start(repo, quant string) error {
 		Status:  "downloading",
 		Started: time.Now(),
 		cmd:     cmd,
+		done:    donePatterns,
 	}
 	dm.active = job
 
-	log.Printf("[download] started: %s", model)
+	timer := time.AfterFunc(timeout, func() {
+		job.mu.Lock()
+		defer job.mu.Unlock()
+		if job.Status != "downloading" {
+			return
+		}
+		job.Status = "failed"
+		job.lastError = fmt.Sprintf("download timed out after %s", timeout)
+		job.addLog(job.lastError)
+		slog.Error("download timed out", "event", "download_timeout", "model", model, "timeout", timeout.String())
+		cmd.Process.Kill()
+	})
+
+	slog.Info("download started", "event", "download_started", "model", model)
 
 	go job.captureOutput(stdout)
 	go job.captureOutput(stderr)
 
 	go func() {
 		err := cmd.Wait()
+		timer.Stop()
 		job.mu.Lock()
-		defer job.mu.Unlock()
-		if job.Status == "stopped" {
-			return
-		}
-		if err != nil {
+		switch {
+		case job.Status != "downloading":
+		case err != nil:
 			job.Status = "failed"
+			job.lastError = err.Error()
 			job.addLog("process exited: " + err.Error())
-			log.Printf("[download] failed: %s - %v", model, err)
-		} else {
+			slog.Error("download failed", "event", "download_failed", "model", model, "error", err)
+		default:
 			job.Status = "done"
 			job.addLog("download complete")
-			log.Printf("[download] completed: %s", model)
+			slog.Info("download completed", "event", "download_completed", "model", model)
 		}
+		rec := job.recordLocked()
+		job.mu.Unlock()
+		dm.finish(job, rec)
+		dm.notifier.NotifyDownload(rec)
+	}()
+
+	return nil
+}
+
+// StartURL downloads a .gguf file over http(s) into the cache dir, or queues
+// it like Start.
+func (dm *DownloadManager) StartURL(rawURL, fileName string) (*QueuedDownload, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url must be an http or https URL")
+	}
+	if fileName == "" {
+		fileName = path.Base(u.Path)
+	}
+	fileName = filepath.Base(fileName)
+	if !strings.HasSuffix(fileName, ".gguf") {
+		return nil, fmt.Errorf("cannot derive a .gguf file name from url, set file_name")
+	}
+	return dm.enqueue(QueuedDownload{Repo: fileName, URL: rawURL})
+}
+
+func (dm *DownloadManager) startURLLocked(rawURL, fileName string) error {
+	dir := getCacheDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating cache dir: %w", err)
+	}
+
+	timeout, _, err := dm.cfg.DownloadSettings()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	job := &DownloadJob{
+		Repo:    fileName,
+		URL:     rawURL,
+		Status:  "downloading",
+		Started: time.Now(),
+		cancel:  cancel,
+	}
+	dm.active = job
+
+	slog.Info("download started", "event", "download_started", "url", rawURL, "file", fileName)
+	go func() {
+		job.fetchURL(ctx, rawURL, filepath.Join(dir, fileName))
+		cancel()
+		job.mu.Lock()
+		rec := job.recordLocked()
+		job.mu.Unlock()
+		dm.finish(job, rec)
+		dm.notifier.NotifyDownload(rec)
 	}()
+	return nil
+}
+
+// enqueue starts d right away when nothing is downloading, and otherwise
+// appends it to the queue.
+func (dm *DownloadManager) enqueue(d QueuedDownload) (*QueuedDownload, error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	busy := dm.busyLocked()
+	if busy && dm.active.label() == d.label() {
+		return nil, fmt.Errorf("%w: %s", errDownloadActive, d.label())
+	}
+	for _, q := range dm.queue {
+		if q.label() == d.label() {
+			return nil, fmt.Errorf("%w: %s", errDownloadQueued, d.label())
+		}
+	}
+	if !busy && len(dm.queue) == 0 {
+		return nil, dm.launchLocked(d)
+	}
+
+	dm.nextID++
+	d.ID = strconv.Itoa(dm.nextID)
+	d.Queued = time.Now()
+	dm.queue = append(dm.queue, d)
+	d.Position = len(dm.queue)
+	slog.Info("download queued", "event", "download_queued", "download", d.label(), "position", d.Position)
+	dm.startNextLocked()
+	return &d, nil
+}
+
+func (dm *DownloadManager) launchLocked(d QueuedDownload) error {
+	if d.URL != "" {
+		return dm.startURLLocked(d.URL, d.Repo)
+	}
+	return dm.startLocked(ModelSpec{Repo: d.Repo, Quant: d.Quant})
+}
+
+func (dm *DownloadManager) busyLocked() bool {
+	if dm.active == nil {
+		return false
+	}
+	dm.active.mu.Lock()
+	defer dm.active.mu.Unlock()
+	return !dm.active.exited
+}
+
+// startNextLocked launches queued downloads in order until one is running;
+// those that fail to launch are recorded as failed.
+func (dm *DownloadManager) startNextLocked() {
+	for len(dm.queue) > 0 && !dm.busyLocked() {
+		d := dm.queue[0]
+		dm.queue = dm.queue[1:]
+		err := dm.launchLocked(d)
+		if err == nil {
+			return
+		}
+		slog.Error("download failed", "event", "download_failed", "download", d.label(), "error", err)
+		now := time.Now()
+		rec := DownloadRecord{
+			Repo:     d.Repo,
+			Quant:    d.Quant,
+			URL:      d.URL,
+			Status:   "failed",
+			Started:  now,
+			Finished: now,
+			Duration: formatDuration(0),
+			Error:    err.Error(),
+		}
+		dm.recordLocked(rec)
+		go dm.notifier.NotifyDownload(rec)
+	}
+}
 
+// Queue returns the queued downloads, next first.
+func (dm *DownloadManager) Queue() []QueuedDownload {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	out := make([]QueuedDownload, len(dm.queue))
+	for i, d := range dm.queue {
+		d.Position = i + 1
+		out[i] = d
+	}
+	return out
+}
+
+// MoveQueued moves a queued download to position, counted from 1 for the
+// next one to start.
+func (dm *DownloadManager) MoveQueued(id string, position int) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	i := slices.IndexFunc(dm.queue, func(d QueuedDownload) bool { return d.ID == id })
+	if i < 0 {
+		return errNotQueued
+	}
+	d := dm.queue[i]
+	dm.queue = slices.Delete(dm.queue, i, i+1)
+	position = min(max(position, 1), len(dm.queue)+1)
+	dm.queue = slices.Insert(dm.queue, position-1, d)
+	return nil
+}
+
+func (dm *DownloadManager) RemoveQueued(id string) error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	i := slices.IndexFunc(dm.queue, func(d QueuedDownload) bool { return d.ID == id })
+	if i < 0 {
+		return errNotQueued
+	}
+	dm.queue = slices.Delete(dm.queue, i, i+1)
 	return nil
 }
 
+func (dm *DownloadManager) ClearQueue() {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.queue = nil
+}
+
+func (job *DownloadJob) fetchURL(ctx context.Context, rawURL, dest string) {
+	partPath := dest + ".part"
+	err := job.copyURL(ctx, rawURL, partPath)
+	if err == nil {
+		if !isValidGGUF(partPath) {
+			err = fmt.Errorf("downloaded file is not a valid GGUF file")
+		} else {
+			err = os.Rename(partPath, dest)
+		}
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.Status == "stopped" {
+		job.addLog("partial download kept for resume: " + partPath)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		job.Status = "failed"
+		job.lastError = "download timed out, partial download kept for resume: " + partPath
+		job.addLog(job.lastError)
+		slog.Error("download timed out", "event", "download_timeout", "url", rawURL)
+		return
+	}
+	if err != nil {
+		os.Remove(partPath)
+		job.Status = "failed"
+		job.lastError = err.Error()
+		job.addLog("download failed: " + err.Error())
+		slog.Error("download failed", "event", "download_failed", "url", rawURL, "error", err)
+		return
+	}
+	job.Status = "done"
+	job.addLog("download complete: " + dest)
+	slog.Info("download completed", "event", "download_completed", "url", rawURL, "file", dest)
+}
+
+func (job *DownloadJob) copyURL(ctx context.Context, rawURL, partPath string) error {
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil {
+		offset = info.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+		job.mu.Lock()
+		job.addLog(fmt.Sprintf("resuming partial download at %d bytes", offset))
+		job.mu.Unlock()
+	case http.StatusOK:
+		flags |= os.O_TRUNC
+		offset = 0
+	default:
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	f, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	job.mu.Lock()
+	job.BytesDone = offset
+	if resp.ContentLength > 0 {
+		job.BytesTotal = offset + resp.ContentLength
+	}
+	job.mu.Unlock()
+
+	buf := make([]byte, 256*1024)
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := f.Write(buf[:n]); err != nil {
+				return err
+			}
+			job.mu.Lock()
+			job.BytesDone += int64(n)
+			job.mu.Unlock()
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	return f.Sync()
+}
+
 func (dm *DownloadManager) Stop() {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
 
-	if dm.active == nil || dm.active.cmd == nil || dm.active.cmd.Process == nil {
+	if dm.active == nil {
+		return
+	}
+	job := dm.active
+	if job.cancel == nil && (job.cmd == nil || job.cmd.Process == nil) {
 		return
 	}
 
-	dm.active.mu.Lock()
-	dm.active.Status = "stopped"
-	dm.active.addLog("download stopped by user")
-	dm.active.mu.Unlock()
+	job.mu.Lock()
+	job.Status = "stopped"
+	job.addLog("download stopped by user")
+	job.mu.Unlock()
+
+	if job.cancel != nil {
+		job.cancel()
+	} else {
+		job.cmd.Process.Kill()
+	}
+	slog.Info("download stopped by user", "event", "download_stopped")
+}
+
+func (job *DownloadJob) label() string {
+	if job.URL != "" {
+		return job.URL
+	}
+	return job.Repo + ":" + job.Quant
+}
 
-	dm.active.cmd.Process.Kill()
-	log.Printf("[download] stopped by user")
+func (job *DownloadJob) recordLocked() DownloadRecord {
+	now := time.Now()
+	return DownloadRecord{
+		Repo:     job.Repo,
+		Quant:    job.Quant,
+		URL:      job.URL,
+		Status:   job.Status,
+		Started:  job.Started,
+		Finished: now,
+		Duration: formatDuration(now.Sub(job.Started)),
+		Bytes:    job.BytesDone,
+		Error:    job.lastError,
+	}
+}
+
+// finish records a finished download and starts the next queued one.
+func (dm *DownloadManager) finish(job *DownloadJob, rec DownloadRecord) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	job.mu.Lock()
+	job.exited = true
+	job.mu.Unlock()
+	dm.recordLocked(rec)
+	dm.startNextLocked()
+}
+
+func (dm *DownloadManager) recordLocked(rec DownloadRecord) {
+	dm.history = append(dm.history, rec)
+	if len(dm.history) > downloadHistorySize {
+		dm.history = dm.history[len(dm.history)-downloadHistorySize:]
+	}
+}
+
+func (dm *DownloadManager) History() []DownloadRecord {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	out := make([]DownloadRecord, len(dm.history))
+	for i, rec := range dm.history {
+		out[len(out)-1-i] = rec
+	}
+	return out
+}
+
+func (dm *DownloadManager) ClearHistory() {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.history = nil
 }
 
 func (dm *DownloadManager) GetStatus() DownloadStatus {
@@ -132,7 +618,7 @@ func (dm *DownloadManager) GetStatus() DownloadStatus {
 	defer dm.mu.Unlock()
 
 	if dm.active == nil {
-		return DownloadStatus{Active: false}
+		return DownloadStatus{Active: false, Queued: len(dm.queue)}
 	}
 
 	dm.active.mu.Lock()
@@ -141,14 +627,22 @@ func (dm *DownloadManager) GetStatus() DownloadStatus {
 	logs := make([]string, len(dm.active.Logs))
 	copy(logs, dm.active.Logs)
 
-	return DownloadStatus{
-		Active:  dm.active.Status == "downloading",
-		Repo:    dm.active.Repo,
-		Quant:   dm.active.Quant,
-		Status:  dm.active.Status,
-		Logs:    logs,
-		Elapsed: formatDuration(time.Since(dm.active.Started)),
+	s := DownloadStatus{
+		Active:     dm.active.Status == "downloading",
+		Repo:       dm.active.Repo,
+		Quant:      dm.active.Quant,
+		URL:        dm.active.URL,
+		Status:     dm.active.Status,
+		Logs:       logs,
+		Elapsed:    formatDuration(time.Since(dm.active.Started)),
+		BytesDone:  dm.active.BytesDone,
+		BytesTotal: dm.active.BytesTotal,
+		Queued:     len(dm.queue),
+	}
+	if s.BytesTotal > 0 {
+		s.Percent = float64(s.BytesDone) / float64(s.BytesTotal) * 100
 	}
+	return s
 }
 
 func (job *DownloadJob) captureOutput(r io.Reader) {
@@ -158,7 +652,7 @@ func (job *DownloadJob) captureOutput(r io.Reader) {
 		line := scanner.Text()
 		job.mu.Lock()
 		job.addLog(line)
-		if strings.Contains(line, "listening on") || strings.Contains(line, "all slots are idle") {
+		if job.Status == "downloading" && job.downloadFinished(line) {
 			if job.cmd != nil && job.cmd.Process != nil {
 				job.Status = "done"
 				job.addLog("model downloaded, stopping server")
@@ -169,6 +663,15 @@ func (job *DownloadJob) captureOutput(r io.Reader) {
 	}
 }
 
+func (job *DownloadJob) downloadFinished(line string) bool {
+	for _, re := range job.done {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
 func (job *DownloadJob) addLog(line string) {
 	job.Logs = append(job.Logs, line)
 	if len(job.Logs) > 500 {
@@ -176,15 +679,47 @@ func (job *DownloadJob) addLog(line string) {
 	}
 }
 
-func FetchQuants(repo string) ([]string, error) {
-	url := fmt.Sprintf("https://huggingface.co/api/models/%s", repo)
+type QuantInfo struct {
+	Quant     string `json:"quant"`
+	FileName  string `json:"file_name"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+var (
+	quantRe = regexp.MustCompile(`-([A-Za-z0-9_]+)\.gguf$`)
+	shardRe = regexp.MustCompile(`-\d{5}-of-\d{5}\.gguf$`)
+)
+
+func newQuantsRequest(repo, token string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://huggingface.co/api/models/%s?blobs=true", repo), nil)
+	if err != nil {
+		return nil, err
+	}
+	setHFAuth(req, token)
+	return req, nil
+}
+
+func FetchQuants(repo, token string) ([]QuantInfo, error) {
+	req, err := newQuantsRequest(repo, token)
+	if err != nil {
+		return nil, err
+	}
 	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Get(url)
+	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("fetching repo info: %w", err)
+		return nil, redactToken(fmt.Errorf("fetching repo info: %w", err), token)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, &hfRateLimitError{RetryAfter: resp.Header.Get("Retry-After")}
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		if token == "" {
+			return nil, fmt.Errorf("HuggingFace API returned %d, repo may be gated or private: set hf_token or HF_TOKEN", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("HuggingFace API returned %d, token has no access to this repo", resp.StatusCode)
+	}
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("HuggingFace API returned %d", resp.StatusCode)
 	}
@@ -192,31 +727,99 @@ func FetchQuants(repo string) ([]string, error) {
 	var result struct {
 		Siblings []struct {
 			RFilename string `json:"rfilename"`
+			Size      int64  `json:"size"`
 		} `json:"siblings"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, fmt.Errorf("decoding response: %w", err)
 	}
 
-	quantRe := regexp.MustCompile(`-([A-Za-z0-9_]+)\.gguf$`)
-	quants := []string{}
-	seen := make(map[string]bool)
+	quants := []QuantInfo{}
+	index := make(map[string]int)
 
 	for _, s := range result.Siblings {
 		if !strings.HasSuffix(s.RFilename, ".gguf") {
 			continue
 		}
-		matches := quantRe.FindStringSubmatch(s.RFilename)
+		base := shardRe.ReplaceAllString(s.RFilename, ".gguf")
+		matches := quantRe.FindStringSubmatch(base)
 		if len(matches) < 2 {
 			continue
 		}
 		q := matches[1]
-		if !seen[q] {
-			seen[q] = true
-			quants = append(quants, q)
+		i, ok := index[q]
+		if !ok {
+			index[q] = len(quants)
+			quants = append(quants, QuantInfo{Quant: q, FileName: s.RFilename, SizeBytes: s.Size})
+			continue
+		}
+		quants[i].SizeBytes += s.Size
+		if s.RFilename < quants[i].FileName {
+			quants[i].FileName = s.RFilename
 		}
 	}
 
-	sort.Strings(quants)
+	sort.Slice(quants, func(i, j int) bool { return quants[i].Quant < quants[j].Quant })
 	return quants, nil
 }
+
+type ModelSearchResult struct {
+	Repo         string    `json:"repo"`
+	Downloads    int64     `json:"downloads"`
+	Likes        int64     `json:"likes"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+func SearchModels(query, token string, limit int) ([]ModelSearchResult, error) {
+	if limit <= 0 {
+		limit = searchDefaultLimit
+	}
+	if limit > searchMaxLimit {
+		limit = searchMaxLimit
+	}
+	params := url.Values{}
+	params.Set("search", query)
+	params.Set("filter", "gguf")
+	params.Set("sort", "downloads")
+	params.Set("direction", "-1")
+	params.Set("limit", strconv.Itoa(limit))
+	req, err := http.NewRequest(http.MethodGet, "https://huggingface.co/api/models?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	setHFAuth(req, token)
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, redactToken(fmt.Errorf("searching models: %w", err), token)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, &hfRateLimitError{RetryAfter: resp.Header.Get("Retry-After")}
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("HuggingFace API returned %d", resp.StatusCode)
+	}
+
+	var hits []struct {
+		ID           string    `json:"id"`
+		Downloads    int64     `json:"downloads"`
+		Likes        int64     `json:"likes"`
+		LastModified time.Time `json:"lastModified"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&hits); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+
+	results := make([]ModelSearchResult, 0, len(hits))
+	for _, h := range hits {
+		results = append(results, ModelSearchResult{
+			Repo:         h.ID,
+			Downloads:    h.Downloads,
+			Likes:        h.Likes,
+			LastModified: h.LastModified,
+		})
+	}
+	return results, nil
+}
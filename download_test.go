@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestNewQuantsRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"with token", "hf_abc", "Bearer hf_abc"},
+		{"without token", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := newQuantsRequest("org/model-GGUF", tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := req.Header.Get("Authorization"); got != tt.want {
+				t.Errorf("Authorization = %q, want %q", got, tt.want)
+			}
+			if _, ok := req.Header["Authorization"]; ok != (tt.want != "") {
+				t.Errorf("Authorization header present = %v, want %v", ok, tt.want != "")
+			}
+			if got, want := req.URL.String(), "https://huggingface.co/api/models/org/model-GGUF?blobs=true"; got != want {
+				t.Errorf("URL = %q, want %q", got, want)
+			}
+		})
+	}
+}
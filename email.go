@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	emailTimeout     = 30 * time.Second
+	defaultSMTPPort  = 587
+	smtpImplicitPort = 465
+)
+
+// defaultEmailEvents are the failures that need someone to step in.
+var defaultEmailEvents = []string{notifyGaveUp, notifyDownloadFailed}
+
+// EmailConf sends notification events by mail. Port 465 uses implicit TLS;
+// otherwise STARTTLS is used when the server offers it.
+type EmailConf struct {
+	Host     string   `yaml:"smtp_host" json:"smtp_host"`
+	Port     int      `yaml:"smtp_port,omitempty" json:"smtp_port,omitempty"`
+	Username string   `yaml:"username,omitempty" json:"username,omitempty"`
+	Password string   `yaml:"password,omitempty" json:"-"`
+	From     string   `yaml:"from" json:"from"`
+	To       []string `yaml:"to" json:"to"`
+	Events   []string `yaml:"events,omitempty" json:"events,omitempty"`
+}
+
+func (e *EmailConf) port() int {
+	if e.Port == 0 {
+		return defaultSMTPPort
+	}
+	return e.Port
+}
+
+func (e *EmailConf) wants(event string) bool {
+	if len(e.Events) == 0 {
+		return slices.Contains(defaultEmailEvents, event)
+	}
+	return slices.Contains(e.Events, event)
+}
+
+func (e *EmailConf) validate() []error {
+	var errs []error
+	if e.Host == "" {
+		errs = append(errs, fmt.Errorf("notifications.email: smtp_host is required"))
+	}
+	if e.Port < 0 || e.Port > 65535 {
+		errs = append(errs, fmt.Errorf("notifications.email: smtp_port must be between 1 and 65535"))
+	}
+	if _, err := mail.ParseAddress(e.From); err != nil {
+		errs = append(errs, fmt.Errorf("notifications.email: invalid from address %q", e.From))
+	}
+	if len(e.To) == 0 {
+		errs = append(errs, fmt.Errorf("notifications.email: to needs at least one address"))
+	}
+	for _, to := range e.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			errs = append(errs, fmt.Errorf("notifications.email: invalid to address %q", to))
+		}
+	}
+	for _, ev := range e.Events {
+		if !slices.Contains(notifyEvents, ev) {
+			errs = append(errs, fmt.Errorf("notifications.email: unknown event %q", ev))
+		}
+	}
+	return errs
+}
+
+// message renders payload as a plain-text mail.
+func (e *EmailConf) message(payload WebhookPayload) []byte {
+	from, _ := mail.ParseAddress(e.From)
+	hostname := hostName()
+	subject := fmt.Sprintf("[llama-manager] %s: %s %s", hostname, payloadSubject(payload), payload.Event)
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Event:    %s\nHost:     %s\nTime:     %s\n", payload.Event, hostname, payload.Timestamp.Format(time.RFC1123))
+	if payload.Instance != "" {
+		fmt.Fprintf(&body, "Instance: %s\nState:    %s\nRestarts: %d\n", payload.Instance, payload.State, payload.RestartCount)
+	}
+	if d := payload.Download; d != nil {
+		fmt.Fprintf(&body, "Download: %s\n", d.Repo)
+		if d.Quant != "" {
+			fmt.Fprintf(&body, "Quant:    %s\n", d.Quant)
+		}
+		if d.URL != "" {
+			fmt.Fprintf(&body, "URL:      %s\n", d.URL)
+		}
+	}
+	if payload.LastError != "" {
+		fmt.Fprintf(&body, "\n%s\n", payload.LastError)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", oneLine(subject)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", payload.Timestamp.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body.String(), "\n", "\r\n"))
+	return []byte(msg.String())
+}
+
+func payloadSubject(payload WebhookPayload) string {
+	if payload.Instance != "" {
+		return payload.Instance
+	}
+	if payload.Download != nil {
+		return payload.Download.Repo
+	}
+	return ""
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func hostName() string {
+	host, _ := os.Hostname()
+	return host
+}
+
+func (e *EmailConf) send(payload WebhookPayload) error {
+	addr := net.JoinHostPort(e.Host, strconv.Itoa(e.port()))
+	dialer := &net.Dialer{Timeout: emailTimeout}
+	tlsConf := &tls.Config{ServerName: e.Host}
+	var conn net.Conn
+	var err error
+	if e.port() == smtpImplicitPort {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConf)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(emailTimeout))
+	c, err := smtp.NewClient(conn, e.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok && e.port() != smtpImplicitPort {
+		if err := c.StartTLS(tlsConf); err != nil {
+			return err
+		}
+	}
+	if e.Username != "" {
+		// PlainAuth refuses to send the password over an unencrypted
+		// connection to anything but localhost.
+		if err := c.Auth(smtp.PlainAuth("", e.Username, e.Password, e.Host)); err != nil {
+			return err
+		}
+	}
+	from, _ := mail.ParseAddress(e.From)
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range e.To {
+		addr, _ := mail.ParseAddress(to)
+		if err := c.Rcpt(addr.Address); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(e.message(payload)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
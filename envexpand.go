@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+func expandEnv(s string) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var missing []string
+	out := os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("undefined environment variable %s", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
+func (cfg *Config) globalEnvFields() map[string]*string {
+	fields := map[string]*string{
+		"server_bin":    &cfg.ServerBin,
+		"manager_host":  &cfg.ManagerHost,
+		"host":          &cfg.Host,
+		"hf_token":      &cfg.HFToken,
+		"webhook_url":   &cfg.WebhookURL,
+		"state_file":    &cfg.StateFile,
+		"audit_file":    &cfg.AuditFile,
+		"instances_dir": &cfg.InstancesDir,
+		"tls_cert":      &cfg.TLSCert,
+		"tls_key":       &cfg.TLSKey,
+	}
+	for i := range cfg.Notifications.Webhooks {
+		fields[fmt.Sprintf("notifications.webhooks.%d.url", i)] = &cfg.Notifications.Webhooks[i].URL
+	}
+	if e := cfg.Notifications.Email; e != nil {
+		fields["notifications.email.smtp_host"] = &e.Host
+		fields["notifications.email.username"] = &e.Username
+		fields["notifications.email.password"] = &e.Password
+	}
+	return fields
+}
+
+func (ic *InstanceConf) envFields() map[string]*string {
+	return map[string]*string{
+		"model":      &ic.Model,
+		"server_bin": &ic.ServerBin,
+	}
+}
+
+func instanceEnvKey(name, field string) string {
+	return "instances." + name + "." + field
+}
+
+func (cfg *Config) expandField(key string, field *string) error {
+	expanded, err := expandEnv(*field)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	if expanded != *field {
+		if cfg.envTemplates == nil {
+			cfg.envTemplates = make(map[string]string)
+		}
+		cfg.envTemplates[key] = *field
+		*field = expanded
+	}
+	return nil
+}
+
+func (cfg *Config) expandEnv() error {
+	var errs []error
+	fields := cfg.globalEnvFields()
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := cfg.expandField(key, fields[key]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for i := range cfg.Instances {
+		if err := cfg.expandInstanceEnv(&cfg.Instances[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (cfg *Config) expandInstanceEnv(ic *InstanceConf) error {
+	var errs []error
+	for _, field := range []string{"model", "server_bin"} {
+		if err := cfg.expandField(instanceEnvKey(ic.Name, field), ic.envFields()[field]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (cfg *Config) unexpandInstanceLocked(ic *InstanceConf) {
+	for field, value := range ic.envFields() {
+		if tmpl, ok := cfg.envTemplates[instanceEnvKey(ic.Name, field)]; ok {
+			if expanded, err := expandEnv(tmpl); err == nil && expanded == *value {
+				*value = tmpl
+			}
+		}
+	}
+}
+
+func (cfg *Config) unexpandLocked() func() {
+	var restore []func()
+	for key, field := range cfg.globalEnvFields() {
+		tmpl, ok := cfg.envTemplates[key]
+		if !ok {
+			continue
+		}
+		if expanded, err := expandEnv(tmpl); err == nil && expanded == *field {
+			*field = tmpl
+			restore = append(restore, func() { *field = expanded })
+		}
+	}
+	return func() {
+		for _, fn := range restore {
+			fn()
+		}
+	}
+}
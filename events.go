@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	eventBufferSize    = 64
+	eventHistorySize   = 1000
+	eventDefaultLimit  = 100
+	eventHeartbeat     = 15 * time.Second
+	eventStateChanged  = "state_changed"
+	eventRestarted     = "restart_count"
+	eventConfigChanged = "config_changed"
+)
+
+// Change values of a config_changed event.
+const (
+	configChangeAdded    = "added"
+	configChangeUpdated  = "updated"
+	configChangeDeleted  = "deleted"
+	configChangeImported = "imported"
+	configChangeSettings = "settings"
+)
+
+type Event struct {
+	Type         string        `json:"type"`
+	Instance     string        `json:"instance"`
+	State        InstanceState `json:"state,omitempty"`
+	PrevState    InstanceState `json:"prev_state,omitempty"`
+	RestartCount int           `json:"restart_count"`
+	Error        string        `json:"error,omitempty"`
+	Change       string        `json:"change,omitempty"`
+	Time         time.Time     `json:"time"`
+}
+
+// Broadcaster fans events out to subscribers and keeps the most recent ones
+// for the event log.
+type Broadcaster struct {
+	mu     sync.Mutex
+	subs   map[chan Event]struct{}
+	recent []Event
+}
+
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{subs: make(map[chan Event]struct{})}
+}
+
+func (b *Broadcaster) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *Broadcaster) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.recent = append(b.recent, e)
+	if len(b.recent) > eventHistorySize {
+		b.recent = b.recent[len(b.recent)-eventHistorySize:]
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+type EventFilter struct {
+	Instance string
+	Type     string
+	Since    time.Time
+	Limit    int
+}
+
+func (f EventFilter) match(e Event) bool {
+	return (f.Instance == "" || e.Instance == f.Instance) &&
+		(f.Type == "" || e.Type == f.Type) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since))
+}
+
+// Query returns the newest recorded events matching f, newest first.
+func (b *Broadcaster) Query(f EventFilter) []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := []Event{}
+	for i := len(b.recent) - 1; i >= 0 && len(out) < f.Limit; i-- {
+		if f.match(b.recent[i]) {
+			out = append(out, b.recent[i])
+		}
+	}
+	return out
+}
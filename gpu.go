@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gpuQueryTimeout = 5 * time.Second
+	gpuCacheTTL     = 2 * time.Second
+)
+
+// GPUInfo is one device as the backend's tooling reports it. Fields the tool
+// does not provide (Vulkan and Metal have no usage counters) are omitted.
+type GPUInfo struct {
+	ID                 int      `json:"id"`
+	Name               string   `json:"name"`
+	MemoryUsedMB       *float64 `json:"memory_used_mb,omitempty"`
+	MemoryTotalMB      *float64 `json:"memory_total_mb,omitempty"`
+	UtilizationPercent *float64 `json:"utilization_percent,omitempty"`
+	TemperatureC       *float64 `json:"temperature_c,omitempty"`
+	Instances          []string `json:"instances"`
+}
+
+type GPUReport struct {
+	Backend string    `json:"backend"`
+	Source  string    `json:"source,omitempty"`
+	GPUs    []GPUInfo `json:"gpus"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// queryGPUs lists the devices visible to backend using its vendor tool.
+func queryGPUs(ctx context.Context, backend string) (source string, gpus []GPUInfo, err error) {
+	switch backend {
+	case "cuda":
+		source = "nvidia-smi"
+		out, err := runGPUTool(ctx, source, "--query-gpu=index,name,memory.used,memory.total,utilization.gpu,temperature.gpu", "--format=csv,noheader,nounits")
+		if err != nil {
+			return source, nil, err
+		}
+		gpus, err = parseNvidiaSMI(out)
+		return source, gpus, err
+	case "rocm", "rocm_rocr":
+		source = "rocm-smi"
+		out, err := runGPUTool(ctx, source, "--showproductname", "--showmeminfo", "vram", "--showuse", "--showtemp", "--json")
+		if err != nil {
+			return source, nil, err
+		}
+		gpus, err = parseROCmSMI(out)
+		return source, gpus, err
+	case "metal":
+		source = "system_profiler"
+		out, err := runGPUTool(ctx, source, "SPDisplaysDataType", "-json")
+		if err != nil {
+			return source, nil, err
+		}
+		gpus, err = parseSystemProfiler(out)
+		return source, gpus, err
+	default:
+		source = "vulkaninfo"
+		out, err := runGPUTool(ctx, source, "--summary")
+		if err != nil {
+			return source, nil, err
+		}
+		return source, parseVulkanInfo(out), nil
+	}
+}
+
+func runGPUTool(ctx context.Context, name string, args ...string) ([]byte, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s not found in PATH", name)
+	}
+	ctx, cancel := context.WithTimeout(ctx, gpuQueryTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.WaitDelay = time.Second
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("%s did not finish within %s", name, gpuQueryTimeout)
+	}
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			return nil, fmt.Errorf("%s failed: %v: %s", name, err, lastLine(strings.TrimSpace(string(ee.Stderr))))
+		}
+		return nil, fmt.Errorf("%s failed: %v", name, err)
+	}
+	return out, nil
+}
+
+// gpuNumber parses a tool's numeric field, treating "[N/A]" and the like as
+// unknown.
+func gpuNumber(s string) *float64 {
+	s = strings.TrimSpace(s)
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+// queryProcessVRAM returns the VRAM (MB) each process uses, summed over GPUs.
+func queryProcessVRAM(ctx context.Context, backend string) (map[int]float64, error) {
+	switch backend {
+	case "cuda":
+		out, err := runGPUTool(ctx, "nvidia-smi", "--query-compute-apps=pid,used_memory", "--format=csv,noheader,nounits")
+		if err != nil {
+			return nil, err
+		}
+		return parseNvidiaComputeApps(out), nil
+	case "rocm", "rocm_rocr":
+		out, err := runGPUTool(ctx, "rocm-smi", "--showpids", "--json")
+		if err != nil {
+			return nil, err
+		}
+		return parseROCmPids(out)
+	default:
+		return nil, fmt.Errorf("per-process VRAM is not available for the %s backend", backend)
+	}
+}
+
+func parseNvidiaComputeApps(out []byte) map[int]float64 {
+	used := make(map[int]float64)
+	for _, line := range strings.Split(string(out), "\n") {
+		pidField, mem, ok := strings.Cut(line, ",")
+		if !ok {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(pidField))
+		if v := gpuNumber(mem); err == nil && v != nil {
+			used[pid] += *v
+		}
+	}
+	return used
+}
+
+// parseROCmPids reads `rocm-smi --showpids --json`, which lists processes as
+// "PID<n>": "name, gpus, vram bytes, sdma bytes, cu occupancy".
+func parseROCmPids(out []byte) (map[int]float64, error) {
+	var data map[string]map[string]string
+	if err := json.Unmarshal(out, &data); err != nil {
+		return nil, fmt.Errorf("unexpected rocm-smi output: %v", err)
+	}
+	used := make(map[int]float64)
+	for key, v := range data["system"] {
+		pid, err := strconv.Atoi(strings.TrimPrefix(key, "PID"))
+		if !strings.HasPrefix(key, "PID") || err != nil {
+			continue
+		}
+		fields := strings.Split(v, ",")
+		if len(fields) < 3 {
+			continue
+		}
+		if b := gpuNumber(fields[2]); b != nil {
+			used[pid] += *b / (1 << 20)
+		}
+	}
+	return used, nil
+}
+
+func parseNvidiaSMI(out []byte) ([]GPUInfo, error) {
+	var gpus []GPUInfo
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		f := strings.Split(line, ",")
+		if len(f) != 6 {
+			return nil, fmt.Errorf("unexpected nvidia-smi output: %q", line)
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(f[0]))
+		if err != nil {
+			return nil, fmt.Errorf("unexpected nvidia-smi index %q", f[0])
+		}
+		gpus = append(gpus, GPUInfo{
+			ID:                 id,
+			Name:               strings.TrimSpace(f[1]),
+			MemoryUsedMB:       gpuNumber(f[2]),
+			MemoryTotalMB:      gpuNumber(f[3]),
+			UtilizationPercent: gpuNumber(f[4]),
+			TemperatureC:       gpuNumber(f[5]),
+		})
+	}
+	return gpus, nil
+}
+
+// parseROCmSMI reads `rocm-smi --json`, whose keys vary between releases, so
+// fields are matched by prefix.
+func parseROCmSMI(out []byte) ([]GPUInfo, error) {
+	var cards map[string]map[string]string
+	if err := json.Unmarshal(out, &cards); err != nil {
+		return nil, fmt.Errorf("unexpected rocm-smi output: %v", err)
+	}
+	var gpus []GPUInfo
+	for key, fields := range cards {
+		id, err := strconv.Atoi(strings.TrimPrefix(key, "card"))
+		if !strings.HasPrefix(key, "card") || err != nil {
+			continue
+		}
+		g := GPUInfo{ID: id}
+		for _, k := range []string{"Card Series", "Card series", "Card SKU", "Card Model", "Card model", "Device Name"} {
+			if v := strings.TrimSpace(fields[k]); v != "" {
+				g.Name = v
+				break
+			}
+		}
+		mb := func(bytes string) *float64 {
+			v := gpuNumber(bytes)
+			if v != nil {
+				*v /= 1 << 20
+			}
+			return v
+		}
+		g.MemoryUsedMB = mb(fields["VRAM Total Used Memory (B)"])
+		g.MemoryTotalMB = mb(fields["VRAM Total Memory (B)"])
+		g.UtilizationPercent = gpuNumber(fields["GPU use (%)"])
+		for k, v := range fields {
+			if strings.HasPrefix(k, "Temperature") && (g.TemperatureC == nil || strings.Contains(k, "edge")) {
+				if t := gpuNumber(v); t != nil {
+					g.TemperatureC = t
+				}
+			}
+		}
+		gpus = append(gpus, g)
+	}
+	sort.Slice(gpus, func(i, j int) bool { return gpus[i].ID < gpus[j].ID })
+	return gpus, nil
+}
+
+var (
+	vulkanGPUHeader = regexp.MustCompile(`^GPU(\d+):`)
+	vulkanField     = regexp.MustCompile(`^\s*(\w+)\s*=\s*(.*)$`)
+)
+
+// parseVulkanInfo reads the device list from `vulkaninfo --summary`; its
+// GPU numbers are the indices GGML_VK_VISIBLE_DEVICES uses. CPU (llvmpipe)
+// devices are skipped.
+func parseVulkanInfo(out []byte) []GPUInfo {
+	var gpus []GPUInfo
+	var cur *GPUInfo
+	cpu := false
+	flush := func() {
+		if cur != nil && !cpu {
+			gpus = append(gpus, *cur)
+		}
+		cur, cpu = nil, false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if m := vulkanGPUHeader.FindStringSubmatch(line); m != nil {
+			flush()
+			id, _ := strconv.Atoi(m[1])
+			cur = &GPUInfo{ID: id}
+			continue
+		}
+		m := vulkanField.FindStringSubmatch(line)
+		if cur == nil || m == nil {
+			continue
+		}
+		switch m[1] {
+		case "deviceName":
+			cur.Name = strings.TrimSpace(m[2])
+		case "deviceType":
+			cpu = strings.Contains(m[2], "CPU")
+		}
+	}
+	flush()
+	return gpus
+}
+
+func parseSystemProfiler(out []byte) ([]GPUInfo, error) {
+	var data struct {
+		Displays []struct {
+			Model string `json:"sppci_model"`
+		} `json:"SPDisplaysDataType"`
+	}
+	if err := json.Unmarshal(out, &data); err != nil {
+		return nil, fmt.Errorf("unexpected system_profiler output: %v", err)
+	}
+	var gpus []GPUInfo
+	for i, d := range data.Displays {
+		gpus = append(gpus, GPUInfo{ID: i, Name: d.Model})
+	}
+	return gpus, nil
+}
+
+// GPUCache keeps the last inventory for a couple of seconds so polling UIs
+// don't spawn a vendor tool per request.
+type GPUCache struct {
+	cfg       *Config
+	mu        sync.Mutex
+	report    GPUReport
+	fetchedAt time.Time
+
+	procMu      sync.Mutex
+	procBackend string
+	procs       map[int]float64
+	procsAt     time.Time
+
+	resMu    sync.Mutex
+	reserved map[string]gpuReservation
+}
+
+func NewGPUCache(cfg *Config) *GPUCache {
+	return &GPUCache{cfg: cfg}
+}
+
+func (c *GPUCache) Get(ctx context.Context, refresh bool) GPUReport {
+	c.cfg.mu.RLock()
+	backend := c.cfg.GPUBackend
+	c.cfg.mu.RUnlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !refresh && c.report.Backend == backend && time.Since(c.fetchedAt) < gpuCacheTTL {
+		return c.report
+	}
+	report := GPUReport{Backend: backend, GPUs: []GPUInfo{}}
+	source, gpus, err := queryGPUs(ctx, backend)
+	report.Source = source
+	if err != nil {
+		report.Error = err.Error()
+	} else if gpus != nil {
+		report.GPUs = gpus
+	}
+	if ctx.Err() == nil {
+		c.report = report
+		c.fetchedAt = time.Now()
+	}
+	return report
+}
+
+// ProcessVRAM returns the VRAM (MB) used by pid, or false when the backend's
+// tool can't tell.
+func (c *GPUCache) ProcessVRAM(pid int) (float64, bool) {
+	c.cfg.mu.RLock()
+	backend := c.cfg.GPUBackend
+	c.cfg.mu.RUnlock()
+
+	c.procMu.Lock()
+	defer c.procMu.Unlock()
+	if c.procBackend != backend || time.Since(c.procsAt) >= gpuCacheTTL {
+		procs, err := queryProcessVRAM(context.Background(), backend)
+		if err != nil {
+			procs = nil
+		}
+		c.procBackend, c.procs, c.procsAt = backend, procs, time.Now()
+	}
+	if c.procs == nil {
+		return 0, false
+	}
+	return c.procs[pid], true
+}
+
+func (ws *WebServer) handleGPUs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	report := ws.gpus.Get(r.Context(), r.URL.Query().Get("refresh") == "true")
+	owners := make(map[int][]string)
+	for _, a := range ws.cfg.GPUAllocations() {
+		owners[a.GPUID] = a.Instances
+	}
+	gpus := make([]GPUInfo, len(report.GPUs))
+	for i, g := range report.GPUs {
+		g.Instances = owners[g.ID]
+		if g.Instances == nil {
+			g.Instances = []string{}
+		}
+		gpus[i] = g
+	}
+	report.GPUs = gpus
+	writeJSONStatus(w, http.StatusOK, report)
+}
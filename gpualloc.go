@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	gpuOverlapAdvisory = "advisory"
+	gpuOverlapStrict   = "strict"
+
+	gpuAutoID = -1
+
+	// gpuReservationTTL bounds how long an auto pick is held for a process
+	// that never reports its own VRAM use.
+	gpuReservationTTL = 5 * time.Minute
+)
+
+// gpuReservation is an auto pick whose process has not yet shown up in the
+// GPU inventory's used VRAM.
+type gpuReservation struct {
+	ids []int
+	mb  float64
+	at  time.Time
+}
+
+// gpuHold is what pending reservations hold on one GPU.
+type gpuHold struct {
+	mb    float64
+	picks int
+}
+
+// GPUList is an instance's gpu_ids: explicit device indices, or "auto" to
+// pick the GPUs with the most free VRAM each time the instance starts.
+type GPUList []int
+
+func (l GPUList) Auto() bool {
+	return len(l) == 1 && l[0] == gpuAutoID
+}
+
+func (l *GPUList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode && value.Value == "auto" {
+		*l = GPUList{gpuAutoID}
+		return nil
+	}
+	var ids []int
+	if err := value.Decode(&ids); err != nil {
+		return fmt.Errorf("gpu_ids must be a list of GPU IDs or \"auto\"")
+	}
+	*l = ids
+	return nil
+}
+
+func (l GPUList) MarshalYAML() (interface{}, error) {
+	if l.Auto() {
+		return "auto", nil
+	}
+	return []int(l), nil
+}
+
+func (l *GPUList) UnmarshalJSON(data []byte) error {
+	if string(data) == `"auto"` {
+		*l = GPUList{gpuAutoID}
+		return nil
+	}
+	var ids []int
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return fmt.Errorf("gpu_ids must be a list of GPU IDs or \"auto\"")
+	}
+	*l = ids
+	return nil
+}
+
+func (l GPUList) MarshalJSON() ([]byte, error) {
+	if l.Auto() {
+		return []byte(`"auto"`), nil
+	}
+	return json.Marshal([]int(l))
+}
+
+// pickGPUs chooses GPUs for an auto instance needing needMB: the fewest of
+// the GPUs with the most free VRAM that together fit it, or the single
+// emptiest GPU when nothing fits or the need is unknown. VRAM held by
+// pending picks counts as used; with the need unknown, GPUs with fewer
+// pending picks go first.
+func pickGPUs(report GPUReport, held map[int]gpuHold, needMB float64) ([]int, error) {
+	if report.Error != "" {
+		return nil, fmt.Errorf("gpu_ids auto: %s", report.Error)
+	}
+	type candidate struct {
+		id    int
+		free  float64
+		picks int
+	}
+	var gpus []candidate
+	for _, g := range report.GPUs {
+		if g.MemoryTotalMB != nil && g.MemoryUsedMB != nil {
+			h := held[g.ID]
+			gpus = append(gpus, candidate{g.ID, *g.MemoryTotalMB - *g.MemoryUsedMB - h.mb, h.picks})
+		}
+	}
+	if len(gpus) == 0 {
+		return nil, fmt.Errorf("gpu_ids auto needs free VRAM figures, which %s does not report", report.Source)
+	}
+	sort.SliceStable(gpus, func(i, j int) bool {
+		if needMB <= 0 && gpus[i].picks != gpus[j].picks {
+			return gpus[i].picks < gpus[j].picks
+		}
+		return gpus[i].free > gpus[j].free
+	})
+	var ids []int
+	free := 0.0
+	for _, g := range gpus {
+		ids = append(ids, g.id)
+		free += g.free
+		if free >= needMB {
+			sort.Ints(ids)
+			return ids, nil
+		}
+	}
+	return []int{gpus[0].id}, nil
+}
+
+type GPUAllocation struct {
+	GPUID     int      `json:"gpu_id"`
+	Instances []string `json:"instances"`
+	Shared    bool     `json:"shared"`
+}
+
+func gpuOverlaps(instances []InstanceConf, skip int, ic InstanceConf) []string {
+	claimed := make(map[int][]string)
+	for i, other := range instances {
+		if i == skip || other.GPUIDs.Auto() {
+			continue
+		}
+		for _, id := range other.GPUIDs {
+			claimed[id] = append(claimed[id], other.Name)
+		}
+	}
+	var overlaps []string
+	if ic.GPUIDs.Auto() {
+		return nil
+	}
+	for _, id := range ic.GPUIDs {
+		if names := claimed[id]; len(names) > 0 {
+			overlaps = append(overlaps, fmt.Sprintf("GPU %d is already used by %s", id, strings.Join(names, ", ")))
+		}
+	}
+	return overlaps
+}
+
+// assignGPUs returns the conf to launch with, resolving gpu_ids: auto against
+// the current GPU inventory and remembering the choice for Status.
+func (inst *Instance) assignGPUs() (InstanceConf, error) {
+	conf := inst.conf
+	if !conf.GPUIDs.Auto() {
+		return conf, nil
+	}
+	if inst.gpus == nil {
+		return conf, fmt.Errorf("gpu_ids auto: no GPU inventory")
+	}
+	need := 0.0
+	if est, err := estimateVRAM(inst.cfg, conf); err == nil {
+		need = est.RequiredMB
+	}
+	ids, err := inst.gpus.reserve(conf.Name, need)
+	if err != nil {
+		inst.mu.Lock()
+		inst.lastError = err.Error()
+		inst.mu.Unlock()
+		return conf, err
+	}
+	conf.GPUIDs = ids
+	inst.mu.Lock()
+	inst.assignedGPUs = ids
+	inst.mu.Unlock()
+	instanceLogger(conf.Name).Info("assigned GPUs", "event", "gpu_auto_assigned", "gpus", conf.GPUDeviceList(), "need_mb", math.Round(need))
+	return conf, nil
+}
+
+// reserve picks GPUs for the auto instance name and holds them until
+// release, so concurrent auto starts don't all read the same free VRAM
+// and land on the same GPU before any of them has loaded.
+func (c *GPUCache) reserve(name string, needMB float64) ([]int, error) {
+	c.resMu.Lock()
+	defer c.resMu.Unlock()
+	held := make(map[int]gpuHold)
+	for other, r := range c.reserved {
+		if other == name || time.Since(r.at) > gpuReservationTTL {
+			delete(c.reserved, other)
+			continue
+		}
+		for _, id := range r.ids {
+			h := held[id]
+			h.mb += r.mb / float64(len(r.ids))
+			h.picks++
+			held[id] = h
+		}
+	}
+	ids, err := pickGPUs(c.Get(context.Background(), true), held, needMB)
+	if err != nil {
+		return nil, err
+	}
+	if c.reserved == nil {
+		c.reserved = make(map[string]gpuReservation)
+	}
+	c.reserved[name] = gpuReservation{ids: ids, mb: needMB, at: time.Now()}
+	return ids, nil
+}
+
+// release drops name's pending pick once its process has loaded or exited.
+func (c *GPUCache) release(name string) {
+	if c == nil {
+		return
+	}
+	c.resMu.Lock()
+	delete(c.reserved, name)
+	c.resMu.Unlock()
+}
+
+// launchConf is the conf the last start used, for showing the command line.
+func (inst *Instance) launchConf() InstanceConf {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	conf := inst.conf
+	if conf.GPUIDs.Auto() && inst.assignedGPUs != nil {
+		conf.GPUIDs = inst.assignedGPUs
+	}
+	conf.Port = inst.portLocked()
+	return conf
+}
+
+func (cfg *Config) checkGPUOverlapLocked(skip int, ic InstanceConf) ([]string, error) {
+	overlaps := gpuOverlaps(cfg.Instances, skip, ic)
+	if len(overlaps) > 0 && cfg.GPUOverlap == gpuOverlapStrict {
+		return nil, fmt.Errorf("gpu overlap: %s", strings.Join(overlaps, "; "))
+	}
+	return overlaps, nil
+}
+
+func (cfg *Config) GPUAllocations() []GPUAllocation {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	byGPU := make(map[int][]string)
+	for _, ic := range cfg.Instances {
+		if ic.GPUIDs.Auto() {
+			continue
+		}
+		for _, id := range ic.GPUIDs {
+			byGPU[id] = append(byGPU[id], ic.Name)
+		}
+	}
+	result := make([]GPUAllocation, 0, len(byGPU))
+	for id, names := range byGPU {
+		result = append(result, GPUAllocation{GPUID: id, Instances: names, Shared: len(names) > 1})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].GPUID < result[j].GPUID })
+	return result
+}
+
+func validGPUOverlapMode(mode string) bool {
+	return mode == gpuOverlapAdvisory || mode == gpuOverlapStrict
+}
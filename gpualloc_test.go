@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestReserveSpreadsConcurrentAutoPicks(t *testing.T) {
+	dir := t.TempDir()
+	smi := "#!/bin/sh\necho '0, GPU A, 1000, 24000, 0, 40'\necho '1, GPU B, 2000, 24000, 0, 40'\n"
+	if err := os.WriteFile(filepath.Join(dir, "nvidia-smi"), []byte(smi), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	gpus := NewGPUCache(testConfig(t, "gpu_backend: cuda\n"))
+
+	first, err := gpus.reserve("a", 16000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := gpus.reserve("b", 16000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(first, []int{0}) || !slices.Equal(second, []int{1}) {
+		t.Fatalf("picks = %v, %v, want [0], [1]", first, second)
+	}
+
+	gpus.release("a")
+	again, err := gpus.reserve("c", 16000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(again, []int{0}) {
+		t.Fatalf("pick after release = %v, want [0]", again)
+	}
+
+	// With the need unknown nothing is held in MB, so the pick count decides.
+	gpus = NewGPUCache(gpus.cfg)
+	x, _ := gpus.reserve("x", 0)
+	y, _ := gpus.reserve("y", 0)
+	if !slices.Equal(x, []int{0}) || !slices.Equal(y, []int{1}) {
+		t.Fatalf("picks with unknown need = %v, %v, want [0], [1]", x, y)
+	}
+}
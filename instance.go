@@ -2,14 +2,20 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"net"
 	"net/http"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -21,44 +27,141 @@ const (
 	StateRunning    InstanceState = "running"
 	StateCrashed    InstanceState = "crashed"
 	StateRestarting InstanceState = "restarting"
+	StateUnhealthy  InstanceState = "unhealthy"
 )
 
-const logBufferSize = 200
+const (
+	logBufferSize          = 200
+	logStreamBuffer        = 256
+	restartHistorySize     = 20
+	resourceSampleInterval = 5 * time.Second
+	drainPollInterval      = 500 * time.Millisecond
+	defaultDrainTimeout    = 5 * time.Minute
+	restartSettleDelay     = 500 * time.Millisecond
+	defaultHealthPath      = "/health"
+	defaultHealthTimeout   = 5 * time.Second
+	startupErrorLines      = 3
+)
+
+const (
+	healthProbeHTTP       = "http"
+	healthProbeCompletion = "completion"
+)
 
 type Instance struct {
-	conf InstanceConf
-	cfg  *Config
+	conf   InstanceConf
+	cfg    *Config
+	events *Broadcaster
+	gpus   *GPUCache
 
-	mu           sync.Mutex
-	state        InstanceState
-	cmd          *exec.Cmd
-	startedAt    time.Time
-	restartCount int
-	lastError    string
-	logs         *ringBuffer
+	mu            sync.Mutex
+	state         InstanceState
+	proc          *os.Process
+	procStart     time.Time
+	exited        chan struct{}
+	startedAt     time.Time
+	restartCount  int
+	lastError     string
+	logs          *ringBuffer
+	logSubs       map[chan string]struct{}
+	history       []RestartEvent
+	crashes       []CrashSnapshot
+	usage         procSample
+	vramMB        *float64
+	paused        bool
+	draining      bool
+	probing       bool
+	healthStreak  int
+	failStreak    int
+	oomLine       string
+	errorLine     string
+	oom           bool
+	warmupLatency time.Duration
+	supervised    bool
+	assignedGPUs  []int
+	port          int
+	inflight      atomic.Int64
+	lastUsed      time.Time
 
-	stopCh chan struct{}
+	stopCh    chan struct{}
+	restartCh chan bool
 }
 
-func NewInstance(conf InstanceConf, cfg *Config) *Instance {
+func NewInstance(conf InstanceConf, cfg *Config, events *Broadcaster, gpus *GPUCache) *Instance {
+	cfg.mu.RLock()
+	size := cfg.LogBufferSize
+	cfg.mu.RUnlock()
+	if conf.LogBufferSize != nil {
+		size = *conf.LogBufferSize
+	}
+	if size <= 0 {
+		size = logBufferSize
+	}
 	return &Instance{
-		conf:  conf,
-		cfg:   cfg,
-		state: StateStopped,
-		logs:  newRingBuffer(logBufferSize),
+		conf:      conf,
+		cfg:       cfg,
+		events:    events,
+		gpus:      gpus,
+		state:     StateStopped,
+		logs:      newRingBuffer(size),
+		restartCh: make(chan bool, 1),
+	}
+}
+
+func (inst *Instance) setStateLocked(s InstanceState) {
+	if inst.state == s {
+		return
 	}
+	prev := inst.state
+	inst.state = s
+	inst.events.Publish(Event{
+		Type:         eventStateChanged,
+		Instance:     inst.conf.Name,
+		State:        s,
+		PrevState:    prev,
+		RestartCount: inst.restartCount,
+		Error:        inst.lastError,
+	})
 }
 
 type InstanceStatus struct {
 	Name         string        `json:"name"`
 	Model        string        `json:"model"`
 	Port         int           `json:"port"`
+	PortAuto     bool          `json:"port_auto,omitempty"`
 	GPUIDs       []int         `json:"gpu_ids"`
+	GPUAuto      bool          `json:"gpu_auto,omitempty"`
+	Tags         []string      `json:"tags,omitempty"`
+	OnDemand     bool          `json:"on_demand,omitempty"`
+	AutoStart    bool          `json:"auto_start"`
+	Paused       bool          `json:"paused"`
+	Draining     bool          `json:"draining,omitempty"`
 	State        InstanceState `json:"state"`
+	Live         bool          `json:"live"`
+	Ready        bool          `json:"ready"`
+	OOM          bool          `json:"oom,omitempty"`
+	WarmupMs     int64         `json:"warmup_ms,omitempty"`
+	Inflight     int64         `json:"proxy_inflight,omitempty"`
 	Uptime       string        `json:"uptime"`
 	UptimeSec    float64       `json:"uptime_sec"`
 	RestartCount int           `json:"restart_count"`
 	LastError    string        `json:"last_error,omitempty"`
+	MemoryMB     float64       `json:"memory_mb"`
+	VRAMMB       *float64      `json:"vram_mb,omitempty"`
+	CPUPercent   float64       `json:"cpu_percent"`
+}
+
+type procSample struct {
+	at         time.Time
+	cpuTime    time.Duration
+	rssBytes   int64
+	cpuPercent float64
+}
+
+type RestartEvent struct {
+	Time         time.Time `json:"time"`
+	Error        string    `json:"error"`
+	RestartCount int       `json:"restart_count"`
 }
 
 func (inst *Instance) Status() InstanceStatus {
@@ -68,12 +171,27 @@ func (inst *Instance) Status() InstanceStatus {
 	s := InstanceStatus{
 		Name:         inst.conf.Name,
 		Model:        inst.conf.Model,
-		Port:         inst.conf.Port,
+		Port:         inst.portLocked(),
+		PortAuto:     inst.conf.Port == 0,
 		GPUIDs:       inst.conf.GPUIDs,
+		GPUAuto:      inst.conf.GPUIDs.Auto(),
+		Tags:         inst.conf.Tags,
+		OnDemand:     inst.conf.OnDemand,
+		AutoStart:    inst.conf.ShouldAutoStart(),
+		Paused:       inst.paused,
+		Draining:     inst.draining,
 		State:        inst.state,
+		Live:         inst.healthStreak > 0,
+		Ready:        inst.state == StateRunning,
+		OOM:          inst.oom,
+		Inflight:     inst.inflight.Load(),
+		WarmupMs:     inst.warmupLatency.Milliseconds(),
 		RestartCount: inst.restartCount,
 		LastError:    inst.lastError,
 	}
+	if s.GPUAuto {
+		s.GPUIDs = inst.assignedGPUs
+	}
 
 	if inst.state == StateRunning || inst.state == StateStarting {
 		d := time.Since(inst.startedAt)
@@ -81,9 +199,45 @@ func (inst *Instance) Status() InstanceStatus {
 		s.Uptime = formatDuration(d)
 	}
 
+	if inst.proc != nil {
+		s.MemoryMB = float64(inst.usage.rssBytes) / (1024 * 1024)
+		s.CPUPercent = inst.usage.cpuPercent
+		s.VRAMMB = inst.vramMB
+	}
+
 	return s
 }
 
+func (inst *Instance) sampleResources() {
+	inst.mu.Lock()
+	if inst.proc == nil {
+		inst.mu.Unlock()
+		return
+	}
+	pid := inst.proc.Pid
+	prev := inst.usage
+	inst.mu.Unlock()
+
+	sample, err := sampleProcess(pid, prev)
+	if err != nil {
+		return
+	}
+	var vram *float64
+	if inst.gpus != nil {
+		if mb, ok := inst.gpus.ProcessVRAM(pid); ok {
+			vram = &mb
+			inst.gpus.release(inst.conf.Name)
+		}
+	}
+
+	inst.mu.Lock()
+	if inst.proc != nil && inst.proc.Pid == pid {
+		inst.usage = sample
+		inst.vramMB = vram
+	}
+	inst.mu.Unlock()
+}
+
 func (inst *Instance) State() InstanceState {
 	inst.mu.Lock()
 	defer inst.mu.Unlock()
@@ -96,60 +250,91 @@ func (inst *Instance) Logs() []string {
 	return inst.logs.Lines()
 }
 
-func (inst *Instance) Start() (<-chan struct{}, error) {
+// LogEntries returns the buffered output lines with the time each was read.
+func (inst *Instance) LogEntries() []logLine {
 	inst.mu.Lock()
 	defer inst.mu.Unlock()
+	return inst.logs.Entries()
+}
 
-	if inst.state == StateRunning || inst.state == StateStarting {
-		return nil, fmt.Errorf("instance %q is already %s", inst.conf.Name, inst.state)
+// SetLogBufferSize resizes the output buffer, keeping the newest lines.
+func (inst *Instance) SetLogBufferSize(size int) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	if size > 0 && size != inst.logs.size {
+		inst.logs.resize(size)
 	}
+}
 
-	inst.cfg.mu.RLock()
-	serverBin := inst.cfg.ServerBin
-	host := inst.cfg.Host
-	ngl := inst.cfg.NGL
-	mainGPU := inst.cfg.MainGPU
-	ctxLen := inst.cfg.ContextLength
-	cacheK := inst.cfg.CacheTypeK
-	cacheV := inst.cfg.CacheTypeV
-	gpuEnv := inst.cfg.GPUEnvVar()
-	inst.cfg.mu.RUnlock()
-
-	if inst.conf.NGL != nil {
-		ngl = *inst.conf.NGL
-	}
-	if inst.conf.ContextLength != nil {
-		ctxLen = *inst.conf.ContextLength
+// SubscribeLogs returns the last n buffered lines and a channel that receives
+// every line after them. A subscriber that falls behind is dropped by closing
+// its channel.
+func (inst *Instance) SubscribeLogs(n int) ([]string, <-chan string, func()) {
+	ch := make(chan string, logStreamBuffer)
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	lines := inst.logs.Lines()
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
 	}
-	if inst.conf.CacheTypeK != nil {
-		cacheK = *inst.conf.CacheTypeK
+	if inst.logSubs == nil {
+		inst.logSubs = make(map[chan string]struct{})
 	}
-	if inst.conf.CacheTypeV != nil {
-		cacheV = *inst.conf.CacheTypeV
+	inst.logSubs[ch] = struct{}{}
+	return lines, ch, func() {
+		inst.mu.Lock()
+		defer inst.mu.Unlock()
+		if _, ok := inst.logSubs[ch]; ok {
+			delete(inst.logSubs, ch)
+			close(ch)
+		}
 	}
+}
 
-	args := []string{}
-	if strings.HasPrefix(inst.conf.Model, "/") || strings.HasSuffix(inst.conf.Model, ".gguf") {
-		args = append(args, "-m", inst.conf.Model)
-	} else {
-		args = append(args, "-hf", inst.conf.Model)
+func (inst *Instance) History() []RestartEvent {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	out := make([]RestartEvent, len(inst.history))
+	copy(out, inst.history)
+	return out
+}
+
+type LaunchCommand struct {
+	Binary    string            `json:"binary"`
+	Args      []string          `json:"args"`
+	Env       map[string]string `json:"env"`
+	GPUEnvVar string            `json:"gpu_env_var,omitempty"`
+}
+
+func buildArgs(cfg *Config, conf InstanceConf) LaunchCommand {
+	cfg.mu.RLock()
+	serverBin := cfg.ServerBin
+	host := cfg.Host
+	mainGPU := cfg.MainGPU
+	gpuEnv := cfg.instanceGPUEnvVar(conf)
+	eff := cfg.effectiveLocked(conf)
+	cfg.mu.RUnlock()
+	if conf.ServerBin != "" {
+		serverBin = conf.ServerBin
 	}
+
+	ngl := eff.NGL
+	ctxLen := eff.ContextLength
+	cacheK := eff.CacheTypeK
+	cacheV := eff.CacheTypeV
+
+	args := parseModelSpec(conf.Model).Args()
 	args = append(args,
-		"--port", strconv.Itoa(inst.conf.Port),
+		"--port", strconv.Itoa(conf.Port),
 		"--host", host,
 		"-ngl", strconv.Itoa(ngl),
 		"-c", strconv.Itoa(ctxLen),
 	)
 
 	if gpuEnv != "" {
-		if len(inst.conf.GPUIDs) > 1 {
+		if len(conf.GPUIDs) > 1 {
 			args = append(args, "-mg", "0")
-			ratio := fmt.Sprintf("%.2f", 1.0/float64(len(inst.conf.GPUIDs)))
-			parts := make([]string, len(inst.conf.GPUIDs))
-			for i := range parts {
-				parts[i] = ratio
-			}
-			args = append(args, "--tensor-split", strings.Join(parts, ","))
+			args = append(args, "--tensor-split", tensorSplitArg(conf.GPUIDs, conf.TensorSplit))
 		} else {
 			args = append(args, "-mg", strconv.Itoa(mainGPU))
 		}
@@ -161,12 +346,68 @@ func (inst *Instance) Start() (<-chan struct{}, error) {
 	if cacheV != "" {
 		args = append(args, "-ctv", cacheV)
 	}
+	args = append(args, eff.serverArgs()...)
+	args = append(args, eff.serverSwitches()...)
 	args = append(args, "--metrics", "--log-verbosity", "2")
+	args = append(args, conf.ExtraArgs...)
 
-	cmd := exec.Command(serverBin, args...)
+	lc := LaunchCommand{
+		Binary:    serverBin,
+		Args:      args,
+		Env:       map[string]string{},
+		GPUEnvVar: gpuEnv,
+	}
 	if gpuEnv != "" {
-		gpuList := intsToStrings(inst.conf.GPUIDs)
-		cmd.Env = append(cmd.Environ(), fmt.Sprintf("%s=%s", gpuEnv, strings.Join(gpuList, ",")))
+		lc.Env[gpuEnv] = conf.GPUDeviceList()
+	}
+	return lc
+}
+
+func (inst *Instance) Start() (<-chan struct{}, error) {
+	if s := inst.State(); s == StateRunning || s == StateStarting || s == StateUnhealthy {
+		return nil, fmt.Errorf("%w: %q is %s", errInstanceActive, inst.conf.Name, s)
+	}
+	if err := inst.waitExited(); err != nil {
+		return nil, err
+	}
+	conf, err := inst.assignGPUs()
+	if err != nil {
+		return nil, err
+	}
+	started := false
+	defer func() {
+		if !started {
+			inst.gpus.release(inst.conf.Name)
+		}
+	}()
+	if conf, err = inst.assignPort(conf); err != nil {
+		return nil, err
+	}
+	if err := inst.checkPort(conf.Port); err != nil {
+		return nil, err
+	}
+	if err := inst.checkVRAM(conf); err != nil {
+		return nil, err
+	}
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	if inst.state == StateRunning || inst.state == StateStarting || inst.state == StateUnhealthy {
+		return nil, fmt.Errorf("%w: %q is %s", errInstanceActive, inst.conf.Name, inst.state)
+	}
+	if inst.proc != nil {
+		return nil, fmt.Errorf("%w: %q is still stopping", errInstanceActive, inst.conf.Name)
+	}
+
+	lc := buildArgs(inst.cfg, conf)
+	cmd := exec.Command(lc.Binary, lc.Args...)
+	// Its own process group, so stopping it also stops anything it spawned.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if len(lc.Env) > 0 {
+		cmd.Env = cmd.Environ()
+		for k, v := range lc.Env {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
 	}
 
 	stdout, err := cmd.StdoutPipe()
@@ -185,49 +426,126 @@ func (inst *Instance) Start() (<-chan struct{}, error) {
 		return nil, fmt.Errorf("starting process: %w", err)
 	}
 
-	inst.cmd = cmd
-	inst.state = StateStarting
-	inst.startedAt = time.Now()
-	inst.lastError = ""
-	inst.stopCh = make(chan struct{})
+	procStart, _ := processStartTime(cmd.Process.Pid)
+	inst.runningLocked(cmd.Process, procStart, time.Now())
 
-	if gpuEnv != "" {
-		log.Printf("[%s] process started (pid %d) on port %d, gpus %v (%s=%s)",
-			inst.conf.Name, cmd.Process.Pid, inst.conf.Port, inst.conf.GPUIDs, gpuEnv, strings.Join(intsToStrings(inst.conf.GPUIDs), ","))
+	logger := instanceLogger(inst.conf.Name)
+	if gpuEnv := lc.GPUEnvVar; gpuEnv != "" {
+		logger.Info("process started", "event", "process_started", "pid", cmd.Process.Pid, "port", conf.Port,
+			"gpus", conf.GPUDeviceList(), "gpu_env", gpuEnv)
 	} else {
-		log.Printf("[%s] process started (pid %d) on port %d (metal)",
-			inst.conf.Name, cmd.Process.Pid, inst.conf.Port)
+		logger.Info("process started", "event", "process_started", "pid", cmd.Process.Pid, "port", conf.Port, "gpu_env", "metal")
 	}
 
-	go inst.captureOutput(stdout)
-	go inst.captureOutput(stderr)
+	var capture sync.WaitGroup
+	capture.Add(2)
+	go func() {
+		defer capture.Done()
+		inst.captureOutput(stdout)
+	}()
+	go func() {
+		defer capture.Done()
+		inst.captureOutput(stderr)
+	}()
 
 	exitCh := make(chan struct{})
+	inst.exited = exitCh
 	go func() {
+		capture.Wait()
 		err := cmd.Wait()
-		inst.mu.Lock()
-		if inst.state != StateStopped {
-			inst.state = StateCrashed
-			if err != nil {
-				inst.lastError = err.Error()
-			} else {
-				inst.lastError = "process exited unexpectedly"
-			}
-			log.Printf("[%s] process exited: %s", inst.conf.Name, inst.lastError)
-			if inst.stopCh != nil {
-				close(inst.stopCh)
-				inst.stopCh = nil
-			}
-		}
-		inst.cmd = nil
-		inst.mu.Unlock()
+		inst.processExited(err, cmd.ProcessState)
 		close(exitCh)
 	}()
 
+	started = true
 	return exitCh, nil
 }
 
+// runningLocked resets the per-run state for a freshly started (or adopted)
+// process.
+func (inst *Instance) runningLocked(proc *os.Process, procStart, startedAt time.Time) {
+	inst.proc = proc
+	inst.procStart = procStart
+	inst.usage = procSample{}
+	inst.vramMB = nil
+	inst.startedAt = startedAt
+	inst.lastUsed = time.Now()
+	inst.healthStreak = 0
+	inst.failStreak = 0
+	inst.draining = false
+	inst.warmupLatency = 0
+	inst.oomLine = ""
+	inst.errorLine = ""
+	inst.oom = false
+	inst.lastError = ""
+	inst.setStateLocked(StateStarting)
+	inst.stopCh = make(chan struct{})
+}
+
+// processExited records that the process ended, as a crash unless it was
+// stopped. ps is nil for an adopted process.
+func (inst *Instance) processExited(err error, ps *os.ProcessState) {
+	inst.gpus.release(inst.conf.Name)
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	if inst.state != StateStopped && inst.state != StateRestarting {
+		switch {
+		case inst.state == StateUnhealthy:
+			// Killed by the manager; lastError already says why.
+		case inst.oomLine != "":
+			inst.oom = true
+			inst.lastError = "GPU out of memory: " + inst.oomLine
+		case err != nil:
+			inst.lastError = err.Error()
+		default:
+			inst.lastError = "process exited unexpectedly"
+		}
+		if inst.errorLine != "" && !inst.oom && inst.state != StateUnhealthy {
+			inst.lastError += ": " + inst.errorLine
+		}
+		inst.recordCrashLocked(exitStatus(ps))
+		inst.setStateLocked(StateCrashed)
+		instanceLogger(inst.conf.Name).Warn("process exited", "event", "process_exited", "error", inst.lastError)
+		if inst.stopCh != nil {
+			close(inst.stopCh)
+			inst.stopCh = nil
+		}
+	}
+	inst.proc = nil
+}
+
+// waitExited waits for a process that was stopped but is still within its
+// stop_timeout to exit, so a quick stop/start doesn't race it for the port.
+func (inst *Instance) waitExited() error {
+	inst.mu.Lock()
+	stopping, exited := inst.proc != nil, inst.exited
+	inst.mu.Unlock()
+	if !stopping {
+		return nil
+	}
+	inst.cfg.mu.RLock()
+	timeout := inst.cfg.StopTimeout.Duration + 5*time.Second
+	inst.cfg.mu.RUnlock()
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("%w: %q is still stopping", errInstanceActive, inst.conf.Name)
+	}
+}
+
 func (inst *Instance) Stop() error {
+	return inst.stop(StateStopped)
+}
+
+// stop sends the process group SIGTERM, killing it if it hasn't exited after
+// stop_timeout, and leaves the instance in next; a process stopped while
+// restarting is not reported as a crash.
+func (inst *Instance) stop(next InstanceState) error {
+	inst.cfg.mu.RLock()
+	timeout := inst.cfg.StopTimeout.Duration
+	inst.cfg.mu.RUnlock()
+
 	inst.mu.Lock()
 	defer inst.mu.Unlock()
 
@@ -235,30 +553,272 @@ func (inst *Instance) Stop() error {
 		return nil
 	}
 
-	inst.state = StateStopped
+	inst.setStateLocked(next)
 	if inst.stopCh != nil {
 		close(inst.stopCh)
 		inst.stopCh = nil
 	}
 
-	if inst.cmd == nil || inst.cmd.Process == nil {
+	return inst.terminateLocked(timeout)
+}
+
+// startupTimedOut marks an instance that has been starting for longer than
+// its startup_timeout as unhealthy, keeping the last output lines as the
+// error since they usually say where loading got stuck.
+func (inst *Instance) startupTimedOut() bool {
+	inst.cfg.mu.RLock()
+	timeout := inst.cfg.StartupTimeout.Duration
+	inst.cfg.mu.RUnlock()
+	if inst.conf.StartupTimeout != nil {
+		timeout = inst.conf.StartupTimeout.Duration
+	}
+
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	if timeout <= 0 || inst.state != StateStarting || time.Since(inst.startedAt) < timeout {
+		return false
+	}
+	inst.lastError = fmt.Sprintf("not ready after %s", timeout)
+	lines := inst.logs.Lines()
+	if len(lines) > startupErrorLines {
+		lines = lines[len(lines)-startupErrorLines:]
+	}
+	if len(lines) > 0 {
+		inst.lastError += "; last output: " + strings.Join(lines, " | ")
+	}
+	inst.setStateLocked(StateUnhealthy)
+	instanceLogger(inst.conf.Name).Warn("instance did not become ready in time, restarting", "event", "startup_timeout", "timeout", timeout.String())
+	return true
+}
+
+// terminate stops an unhealthy instance's process without changing its
+// state, so its exit is handled as a crash.
+func (inst *Instance) terminate() error {
+	inst.cfg.mu.RLock()
+	timeout := inst.cfg.StopTimeout.Duration
+	inst.cfg.mu.RUnlock()
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	return inst.terminateLocked(timeout)
+}
+
+func (inst *Instance) terminateLocked(timeout time.Duration) error {
+	if inst.proc == nil {
 		return nil
 	}
 
-	log.Printf("[%s] stopping process (pid %d)", inst.conf.Name, inst.cmd.Process.Pid)
-	return inst.cmd.Process.Kill()
+	logger := instanceLogger(inst.conf.Name)
+	proc := inst.proc
+	logger.Info("stopping process", "event", "process_stopping", "pid", proc.Pid, "timeout", timeout.String())
+	if timeout == 0 {
+		return signalGroup(proc, syscall.SIGKILL)
+	}
+	if err := signalGroup(proc, syscall.SIGTERM); err != nil {
+		return signalGroup(proc, syscall.SIGKILL)
+	}
+	time.AfterFunc(timeout, func() {
+		inst.mu.Lock()
+		defer inst.mu.Unlock()
+		if inst.proc == proc {
+			logger.Warn("process did not exit after SIGTERM, killing", "event", "process_killed", "pid", proc.Pid, "timeout", timeout.String())
+			signalGroup(proc, syscall.SIGKILL)
+		}
+	})
+	return nil
+}
+
+func (inst *Instance) Kill() {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	if inst.proc != nil {
+		signalGroup(inst.proc, syscall.SIGKILL)
+	}
+}
+
+// signalGroup sends sig to the process group p leads, falling back to p
+// alone if the group is already gone.
+func signalGroup(p *os.Process, sig syscall.Signal) error {
+	if err := syscall.Kill(-p.Pid, sig); err == nil {
+		return nil
+	}
+	return p.Signal(sig)
+}
+
+func (inst *Instance) Drain(timeout time.Duration) bool {
+	log := instanceLogger(inst.conf.Name)
+	deadline := time.Now().Add(timeout)
+	logged := false
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		m, err := inst.FetchMetrics(ctx)
+		cancel()
+		if err != nil || m.RequestsProcessing == 0 {
+			if logged {
+				log.Info("drain complete", "event", "drain_complete")
+			}
+			return true
+		}
+		if time.Now().After(deadline) {
+			log.Warn("drain timed out with requests still in flight", "event", "drain_timeout", "requests_processing", m.RequestsProcessing)
+			return false
+		}
+		if !logged {
+			log.Info("waiting for in-flight requests", "event", "drain_started", "requests_processing", m.RequestsProcessing, "timeout", timeout.String())
+			logged = true
+		}
+		time.Sleep(drainPollInterval)
+	}
 }
 
 func (inst *Instance) SetState(s InstanceState) {
 	inst.mu.Lock()
 	defer inst.mu.Unlock()
-	inst.state = s
+	inst.setStateLocked(s)
+}
+
+func (inst *Instance) SetLastError(msg string) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	inst.lastError = msg
+}
+
+// requestRestart hands a restart to the instance's supervisor and reports
+// whether one was running; if not, the caller becomes the supervisor. A running
+// instance that is to be drained first keeps its state until the drain is done.
+func (inst *Instance) requestRestart(force bool) bool {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	if force || inst.state != StateRunning {
+		inst.setStateLocked(StateRestarting)
+	}
+	if !inst.supervised {
+		inst.supervised = true
+		return false
+	}
+	select {
+	case inst.restartCh <- force:
+	default:
+	}
+	return true
+}
+
+func (inst *Instance) claimSupervisor() bool {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	if inst.supervised {
+		return false
+	}
+	inst.supervised = true
+	return true
+}
+
+// startedSince reports whether a process was launched for inst after t.
+func (inst *Instance) startedSince(t time.Time) bool {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	return inst.startedAt.After(t)
+}
+
+func (inst *Instance) isSupervised() bool {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	return inst.supervised
+}
+
+// releaseSupervisor ends supervision unless a restart request is still
+// pending, in which case the supervisor must handle it.
+func (inst *Instance) releaseSupervisor() (force, pending bool) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	select {
+	case force = <-inst.restartCh:
+		return force, true
+	default:
+	}
+	inst.supervised = false
+	return false, false
+}
+
+// afterExit reads a pending restart request and the stopped state together so
+// a restart racing a process exit is not mistaken for a crash.
+func (inst *Instance) afterExit() (restart, force, stopped bool) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	select {
+	case force = <-inst.restartCh:
+		return true, force, false
+	default:
+	}
+	return false, false, inst.state == StateStopped
+}
+
+func (inst *Instance) SetPaused(p bool) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	inst.paused = p
+}
+
+func (inst *Instance) Paused() bool {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	return inst.paused
+}
+
+// SetDraining takes a running instance out of proxy routing so its in-flight
+// requests can finish before it is stopped.
+func (inst *Instance) SetDraining(d bool) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	inst.draining = d
+}
+
+// setProbing marks readiness as probed by a rolling restart, which polls
+// faster than the health check loop; the loop leaves it alone meanwhile so
+// no probe is counted twice.
+func (inst *Instance) setProbing(p bool) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	inst.probing = p
+}
+
+func (inst *Instance) isProbing() bool {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	return inst.probing
+}
+
+func (inst *Instance) Draining() bool {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	return inst.draining
+}
+
+// serving reports whether the proxy may send new requests to inst.
+func (inst *Instance) serving() bool {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	return inst.state == StateRunning && !inst.draining
 }
 
 func (inst *Instance) IncrementRestarts() {
 	inst.mu.Lock()
 	defer inst.mu.Unlock()
 	inst.restartCount++
+	inst.events.Publish(Event{
+		Type:         eventRestarted,
+		Instance:     inst.conf.Name,
+		State:        inst.state,
+		RestartCount: inst.restartCount,
+		Error:        inst.lastError,
+	})
+	inst.history = append(inst.history, RestartEvent{
+		Time:         time.Now(),
+		Error:        inst.lastError,
+		RestartCount: inst.restartCount,
+	})
+	if len(inst.history) > restartHistorySize {
+		inst.history = inst.history[len(inst.history)-restartHistorySize:]
+	}
 }
 
 func (inst *Instance) RestartCount() int {
@@ -278,26 +838,190 @@ func (inst *Instance) captureOutput(r io.Reader) {
 	for scanner.Scan() {
 		line := scanner.Text()
 		inst.mu.Lock()
-		inst.logs.Add(line)
+		inst.logs.Add(logLine{At: time.Now(), Text: line})
+		if inst.oomLine == "" && isOOMLine(line) {
+			inst.oomLine = line
+		}
+		if inst.errorLine == "" && logLevel(line) == logLevelError {
+			inst.errorLine = line
+		}
+		for ch := range inst.logSubs {
+			select {
+			case ch <- line:
+			default:
+				delete(inst.logSubs, ch)
+				close(ch)
+			}
+		}
 		inst.mu.Unlock()
 	}
 }
 
-func (inst *Instance) CheckHealth() bool {
+var oomSignatures = []string{
+	"out of memory",
+	"cuda error",
+	"failed to allocate",
+	"ggml_vulkan: device memory allocation",
+}
+
+func isOOMLine(line string) bool {
+	lower := strings.ToLower(line)
+	for _, sig := range oomSignatures {
+		if strings.Contains(lower, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// Touch records proxy activity for the idle timeout.
+func (inst *Instance) Touch() {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	inst.lastUsed = time.Now()
+}
+
+func (inst *Instance) IdleFor() time.Duration {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	return time.Since(inst.lastUsed)
+}
+
+// Inflight is the number of proxied requests currently being served.
+func (inst *Instance) Inflight() int64 {
+	return inst.inflight.Load()
+}
+
+func (inst *Instance) OOM() bool {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	return inst.oom
+}
+
+// baseURL is the address the manager uses to reach the instance's server.
+func (inst *Instance) baseURL() string {
 	inst.cfg.mu.RLock()
 	host := inst.cfg.Host
 	inst.cfg.mu.RUnlock()
 	if host == "" || host == "0.0.0.0" || host == "::" {
 		host = "127.0.0.1"
 	}
-	url := fmt.Sprintf("http://%s:%d/health", host, inst.conf.Port)
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Get(url)
+	return fmt.Sprintf("http://%s", net.JoinHostPort(host, strconv.Itoa(inst.Port())))
+}
+
+// Port is the port the instance listens on: the configured one or, with
+// port: auto, the one it was last started on (0 before its first start).
+func (inst *Instance) Port() int {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	return inst.portLocked()
+}
+
+func (inst *Instance) portLocked() int {
+	if inst.conf.Port != 0 {
+		return inst.conf.Port
+	}
+	return inst.port
+}
+
+// CheckHealth runs the instance's health probe: GET health_path (a JSON
+// "status":"ok" also means the model is loaded) or, with the completion
+// probe, a 1-token completion.
+func (inst *Instance) CheckHealth() (ok, loaded bool) {
+	timeout := defaultHealthTimeout
+	if inst.conf.HealthTimeout != nil {
+		timeout = inst.conf.HealthTimeout.Duration
+	}
+	// With every slot busy the probe's completion would queue behind user
+	// requests and time out, so fall back to the plain health check.
+	if inst.conf.HealthProbe == healthProbeCompletion && !inst.slotsBusy() {
+		_, err := inst.warmUp(timeout)
+		return err == nil, err == nil
+	}
+	path := inst.conf.HealthPath
+	if path == "" {
+		path = defaultHealthPath
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(inst.baseURL() + path)
 	if err != nil {
+		return false, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, false
+	}
+	var body struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body); err != nil {
+		return true, false
+	}
+	return true, body.Status == "ok"
+}
+
+func (inst *Instance) UpdateReadiness() bool {
+	ok, loaded := inst.CheckHealth()
+	inst.cfg.mu.RLock()
+	threshold := inst.cfg.ReadyHealthChecks
+	unhealthyAfter := intOverride(inst.cfg.UnhealthyThreshold, inst.conf.UnhealthyThreshold)
+	warmup := inst.cfg.Warmup
+	warmupTimeout := inst.cfg.WarmupTimeout.Duration
+	inst.cfg.mu.RUnlock()
+
+	inst.mu.Lock()
+	if !ok {
+		inst.healthStreak = 0
+		inst.failStreak++
+		if inst.state == StateRunning && unhealthyAfter > 0 && inst.failStreak >= unhealthyAfter {
+			inst.lastError = fmt.Sprintf("health check failed %d times in a row", inst.failStreak)
+			inst.setStateLocked(StateUnhealthy)
+			instanceLogger(inst.conf.Name).Warn("instance unhealthy, restarting", "event", "instance_unhealthy", "failed_checks", inst.failStreak)
+		}
+		inst.mu.Unlock()
 		return false
 	}
+	inst.failStreak = 0
+	inst.healthStreak++
+	ready := inst.state == StateStarting && (loaded || inst.healthStreak >= threshold)
+	inst.mu.Unlock()
+
+	var warmupLatency time.Duration
+	if ready && warmup {
+		logger := instanceLogger(inst.conf.Name)
+		latency, err := inst.warmUp(warmupTimeout)
+		if err != nil {
+			logger.Warn("warm-up request failed, marking ready anyway", "event", "warmup_failed", "error", err)
+		} else {
+			warmupLatency = latency
+			logger.Info("warm-up completed", "event", "warmup_completed", "latency_ms", latency.Milliseconds())
+		}
+	}
+
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	if ready && inst.state == StateStarting {
+		inst.warmupLatency = warmupLatency
+		inst.setStateLocked(StateRunning)
+		instanceLogger(inst.conf.Name).Info("instance ready", "event", "instance_ready", "health_checks", inst.healthStreak, "model_loaded", loaded)
+	}
+	return inst.state == StateRunning
+}
+
+func (inst *Instance) warmUp(timeout time.Duration) (time.Duration, error) {
+	url := inst.baseURL() + "/completion"
+	client := &http.Client{Timeout: timeout}
+	start := time.Now()
+	resp, err := client.Post(url, "application/json", strings.NewReader(`{"prompt":"Hi","n_predict":1}`))
+	if err != nil {
+		return 0, err
+	}
 	defer resp.Body.Close()
-	return resp.StatusCode == http.StatusOK
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return time.Since(start), nil
 }
 
 type InstanceMetrics struct {
@@ -310,25 +1034,25 @@ type InstanceMetrics struct {
 	RequestsDeferred   float64 `json:"requests_deferred"`
 }
 
-func (inst *Instance) FetchMetrics() *InstanceMetrics {
+var errNotRunning = errors.New("not running")
+
+func (inst *Instance) FetchMetrics(ctx context.Context) (*InstanceMetrics, error) {
 	if inst.State() != StateRunning {
-		return nil
+		return nil, errNotRunning
 	}
-	inst.cfg.mu.RLock()
-	host := inst.cfg.Host
-	inst.cfg.mu.RUnlock()
-	if host == "" || host == "0.0.0.0" || host == "::" {
-		host = "127.0.0.1"
+	url := inst.baseURL() + "/metrics"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
 	}
-	url := fmt.Sprintf("http://%s:%d/metrics", host, inst.conf.Port)
 	client := &http.Client{Timeout: 3 * time.Second}
-	resp, err := client.Get(url)
+	resp, err := client.Do(req)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil
+		return nil, fmt.Errorf("metrics endpoint returned %s", resp.Status)
 	}
 	m := &InstanceMetrics{}
 	scanner := bufio.NewScanner(resp.Body)
@@ -366,11 +1090,11 @@ func (inst *Instance) FetchMetrics() *InstanceMetrics {
 			m.RequestsDeferred = val
 		}
 	}
-	return m
+	return m, nil
 }
 
 type ringBuffer struct {
-	lines []string
+	lines []logLine
 	size  int
 	pos   int
 	full  bool
@@ -378,12 +1102,12 @@ type ringBuffer struct {
 
 func newRingBuffer(size int) *ringBuffer {
 	return &ringBuffer{
-		lines: make([]string, size),
+		lines: make([]logLine, size),
 		size:  size,
 	}
 }
 
-func (rb *ringBuffer) Add(line string) {
+func (rb *ringBuffer) Add(line logLine) {
 	rb.lines[rb.pos] = line
 	rb.pos++
 	if rb.pos >= rb.size {
@@ -392,18 +1116,55 @@ func (rb *ringBuffer) Add(line string) {
 	}
 }
 
-func (rb *ringBuffer) Lines() []string {
+func (rb *ringBuffer) Entries() []logLine {
 	if !rb.full {
-		result := make([]string, rb.pos)
+		result := make([]logLine, rb.pos)
 		copy(result, rb.lines[:rb.pos])
 		return result
 	}
-	result := make([]string, rb.size)
+	result := make([]logLine, rb.size)
 	copy(result, rb.lines[rb.pos:])
 	copy(result[rb.size-rb.pos:], rb.lines[:rb.pos])
 	return result
 }
 
+func (rb *ringBuffer) Lines() []string {
+	entries := rb.Entries()
+	result := make([]string, len(entries))
+	for i, l := range entries {
+		result[i] = l.Text
+	}
+	return result
+}
+
+// resize changes the capacity to size, keeping the most recent lines that
+// still fit.
+func (rb *ringBuffer) resize(size int) {
+	entries := rb.Entries()
+	if len(entries) > size {
+		entries = entries[len(entries)-size:]
+	}
+	*rb = ringBuffer{lines: make([]logLine, size), size: size}
+	for _, l := range entries {
+		rb.Add(l)
+	}
+}
+
+func tensorSplitArg(gpuIDs []int, ratios []float64) string {
+	parts := make([]string, len(gpuIDs))
+	if len(ratios) == len(gpuIDs) {
+		for i, r := range ratios {
+			parts[i] = strconv.FormatFloat(r, 'f', -1, 64)
+		}
+		return strings.Join(parts, ",")
+	}
+	ratio := fmt.Sprintf("%.2f", 1.0/float64(len(gpuIDs)))
+	for i := range parts {
+		parts[i] = ratio
+	}
+	return strings.Join(parts, ",")
+}
+
 func intsToStrings(ids []int) []string {
 	out := make([]string, len(ids))
 	for i, id := range ids {
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func testConfig(t *testing.T, data string) *Config {
+	t.Helper()
+	cfg, err := parseConfig([]byte("server_bin: llama-server\n"+data), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// argValue returns the argument following flag, and whether flag was there.
+func argValue(args []string, flag string) (string, bool) {
+	i := slices.Index(args, flag)
+	if i < 0 || i+1 >= len(args) {
+		return "", i >= 0
+	}
+	return args[i+1], true
+}
+
+func TestBuildArgsTensorSplit(t *testing.T) {
+	tests := []struct {
+		name   string
+		gpus   GPUList
+		ratios []float64
+		want   string
+		wantOK bool
+	}{
+		{name: "single GPU", gpus: GPUList{0}},
+		{name: "single GPU ignores ratios", gpus: GPUList{1}, ratios: []float64{1}},
+		{name: "empty ratios split evenly", gpus: GPUList{0, 1}, want: "0.50,0.50", wantOK: true},
+		{name: "empty ratios split three ways", gpus: GPUList{0, 1, 2}, want: "0.33,0.33,0.33", wantOK: true},
+		{name: "custom ratios", gpus: GPUList{0, 1}, ratios: []float64{0.7, 0.3}, want: "0.7,0.3", wantOK: true},
+		{name: "mismatched ratios fall back to even", gpus: GPUList{0, 1}, ratios: []float64{1}, want: "0.50,0.50", wantOK: true},
+	}
+	cfg := testConfig(t, "gpu_backend: cuda\n")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := InstanceConf{Name: "a", Model: "/models/a.gguf", Port: 9000, GPUIDs: tt.gpus, TensorSplit: tt.ratios}
+			got, ok := argValue(buildArgs(cfg, conf).Args, "--tensor-split")
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("--tensor-split = %q (present %v), want %q (present %v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestBuildArgsFlashAttn(t *testing.T) {
+	on, off := true, false
+	tests := []struct {
+		name     string
+		global   string
+		instance *bool
+		want     bool
+	}{
+		{"unset", "", nil, false},
+		{"global on", "flash_attn: true\n", nil, true},
+		{"global off", "flash_attn: false\n", nil, false},
+		{"instance on", "", &on, true},
+		{"instance off", "", &off, false},
+		{"instance off overrides global on", "flash_attn: true\n", &off, false},
+		{"instance on overrides global off", "flash_attn: false\n", &on, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, tt.global)
+			conf := InstanceConf{Name: "a", Model: "/models/a.gguf", Port: 9000, GPUIDs: GPUList{0}, FlashAttn: tt.instance}
+			args := buildArgs(cfg, conf).Args
+			got, ok := argValue(args, "--flash-attn")
+			if ok != tt.want {
+				t.Fatalf("--flash-attn present = %v, want %v: %v", ok, tt.want, args)
+			}
+			if ok && got != "on" {
+				t.Errorf("--flash-attn %q, want on", got)
+			}
+			if slices.Contains(args, "-fa") {
+				t.Errorf("args have -fa: %v", args)
+			}
+		})
+	}
+}
+
+func TestRingBufferKeepsLastLines(t *testing.T) {
+	const size, extra = 5, 7
+	rb := newRingBuffer(size)
+	for i := range size + extra {
+		rb.Add(logLine{Text: strconv.Itoa(i)})
+	}
+	got := rb.Lines()
+	want := []string{"7", "8", "9", "10", "11"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Lines() = %v, want %v", got, want)
+	}
+
+	rb.resize(3)
+	if got, want := rb.Lines(), []string{"9", "10", "11"}; !slices.Equal(got, want) {
+		t.Errorf("after resize(3), Lines() = %v, want %v", got, want)
+	}
+	rb.Add(logLine{Text: "12"})
+	if got, want := rb.Lines(), []string{"10", "11", "12"}; !slices.Equal(got, want) {
+		t.Errorf("after resize and Add, Lines() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+func setupLogging(format string) error {
+	var h slog.Handler
+	switch format {
+	case "", "text":
+		h = slog.NewTextHandler(os.Stderr, nil)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, nil)
+	default:
+		return fmt.Errorf("log_format must be one of: text, json")
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+func instanceLogger(name string) *slog.Logger {
+	return slog.With("instance", name)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+type logLine struct {
+	At   time.Time
+	Text string
+}
+
+const (
+	logLevelError = "error"
+	logLevelWarn  = "warn"
+	logLevelInfo  = "info"
+)
+
+var (
+	// llama.cpp's --log-prefix marks each line with a level letter, after an
+	// optional timestamp.
+	logPrefixLevel = regexp.MustCompile(`^(?:\d+\.\d+\.\d+\.\d+ )?([EWID]) `)
+	logErrorWords  = regexp.MustCompile(`(?i)\b(error|errors|failed|failure|fatal|abort(ed)?|panic|exception|segmentation fault|terminate called|unable to|cannot)\b|GGML_ASSERT`)
+	logWarnWords   = regexp.MustCompile(`(?i)\b(warn|warning)\b`)
+)
+
+// logLevel guesses the severity of a llama-server output line.
+func logLevel(line string) string {
+	if m := logPrefixLevel.FindStringSubmatch(line); m != nil {
+		switch m[1] {
+		case "E":
+			return logLevelError
+		case "W":
+			return logLevelWarn
+		}
+	}
+	switch {
+	case isOOMLine(line) || logErrorWords.MatchString(line):
+		return logLevelError
+	case logWarnWords.MatchString(line):
+		return logLevelWarn
+	}
+	return logLevelInfo
+}
+
+// logFilter selects buffered lines for the logs endpoint. The zero value
+// matches everything.
+type logFilter struct {
+	grep  *regexp.Regexp
+	level string
+	since time.Time
+}
+
+func (f logFilter) match(l logLine) bool {
+	if !f.since.IsZero() && l.At.Before(f.since) {
+		return false
+	}
+	if f.grep != nil && !f.grep.MatchString(l.Text) {
+		return false
+	}
+	switch f.level {
+	case logLevelError:
+		return logLevel(l.Text) == logLevelError
+	case logLevelWarn:
+		return logLevel(l.Text) != logLevelInfo
+	}
+	return true
+}
+
+func (f logFilter) apply(entries []logLine) []logLine {
+	result := entries[:0:0]
+	for _, l := range entries {
+		if f.match(l) {
+			result = append(result, l)
+		}
+	}
+	return result
+}
+
+func parseLogLevel(v string) (string, bool) {
+	switch v = strings.ToLower(v); v {
+	case "", logLevelError, logLevelWarn:
+		return v, true
+	case "warning":
+		return logLevelWarn, true
+	}
+	return "", false
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 )
 
@@ -19,32 +24,88 @@ func main() {
 		log.Fatalf("failed to load config: %v", err)
 	}
 
-	log.Printf("loaded %d instance(s) from %s", len(cfg.Instances), *configPath)
+	if err := setupLogging(cfg.LogFormat); err != nil {
+		log.Fatalf("failed to set up logging: %v", err)
+	}
+
+	slog.Info("config loaded", "event", "config_loaded", "instances", len(cfg.Instances), "path", *configPath, "version", version)
+	if cfg.corsOrigin("*") == "*" {
+		slog.Warn("allowed_origins is \"*\": any website can call the API from a browser", "event", "cors_wildcard")
+	}
+
+	certFile, keyFile, useTLS := cfg.TLSFiles()
+	scheme := "http"
+	if useTLS {
+		if cfg.TLSSelfSigned {
+			if err := ensureSelfSigned(certFile, keyFile, cfg.ManagerHost); err != nil {
+				log.Fatalf("failed to create self-signed certificate: %v", err)
+			}
+		}
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			log.Fatalf("failed to load TLS certificate: %v", err)
+		}
+		scheme = "https"
+	}
+
+	// llama-servers inherit the ignored SIGPIPE, so one that outlives the
+	// manager isn't killed by its next log line into the closed pipe.
+	signal.Ignore(syscall.SIGPIPE)
 
 	mgr := NewManager(cfg)
 	mgr.StartAll()
 
-	dlm := NewDownloadManager(cfg.ServerBin)
+	dlm := NewDownloadManager(cfg, cfg.ServerBin, mgr.notifier)
 	srv := NewWebServer(mgr, cfg, dlm)
 	httpServer := &http.Server{
-		Addr:    fmt.Sprintf(":%d", cfg.ManagerPort),
+		Addr:    cfg.ListenAddr(),
 		Handler: srv,
 	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
+	httpServer.RegisterOnShutdown(srv.closeStreams)
+
+	forced := make(chan bool, 1)
 	go func() {
 		<-sigCh
-		log.Println("received shutdown signal")
-		mgr.Shutdown()
-		if err := httpServer.Close(); err != nil {
-			log.Printf("error closing http server: %v", err)
+		slog.Info("received shutdown signal", "event", "shutdown_signal")
+		cfg.mu.RLock()
+		timeout := cfg.ShutdownTimeout.Duration
+		cfg.mu.RUnlock()
+		unclean := false
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			slog.Error("http server did not shut down cleanly", "event", "http_shutdown_timeout", "error", err)
+			httpServer.Close()
+			unclean = true
 		}
+		if !mgr.Shutdown(timeout) {
+			unclean = true
+		}
+		forced <- unclean
 	}()
 
-	log.Printf("web UI available at http://localhost:%d", cfg.ManagerPort)
-	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+	if useTLS {
+		httpServer.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	uiHost := cfg.ManagerHost
+	if uiHost == "" || uiHost == "0.0.0.0" || uiHost == "::" {
+		uiHost = "localhost"
+	}
+	slog.Info("web UI available", "event", "http_listening", "addr", httpServer.Addr, "url", fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(uiHost, strconv.Itoa(cfg.ManagerPort))))
+	if useTLS {
+		err = httpServer.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		log.Fatalf("http server error: %v", err)
 	}
+	if <-forced {
+		os.Exit(1)
+	}
 }
@@ -1,31 +1,64 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
 	"sync"
 	"time"
 )
 
+var (
+	errInstanceNotFound = errors.New("instance not found")
+	errInstanceActive   = errors.New("instance is already active")
+)
+
 type Manager struct {
 	cfg       *Config
+	notifier  *Notifier
 	mu        sync.RWMutex
 	instances []*Instance
 	byName    map[string]*Instance
 	wg        sync.WaitGroup
 	stopCh    chan struct{}
+	rolling   rollingRestarts
+	replicas  replicaGroups
+	schedules scheduleRuns
+	history   MetricsHistory
+	metrics   *MetricsCache
+	stateMu   sync.Mutex
+	events    *Broadcaster
+	gpus      *GPUCache
+	// leftover holds the processes the state file says were running, until
+	// StartAll adopts or discards them.
+	leftover map[string]persistedInstance
+	// statePath is the state file configured at startup; an imported
+	// state_file applies on restart.
+	statePath string
+	// detached is set before stopCh closes when shutdown leaves instances
+	// running.
+	detached bool
 }
 
 func NewManager(cfg *Config) *Manager {
 	m := &Manager{
-		cfg:    cfg,
-		byName: make(map[string]*Instance),
-		stopCh: make(chan struct{}),
+		cfg:       cfg,
+		notifier:  NewNotifier(cfg),
+		byName:    make(map[string]*Instance),
+		stopCh:    make(chan struct{}),
+		events:    NewBroadcaster(),
+		gpus:      NewGPUCache(cfg),
+		metrics:   NewMetricsCache(cfg),
+		leftover:  make(map[string]persistedInstance),
+		statePath: cfg.StatePath(),
 	}
 	for _, ic := range cfg.Instances {
-		inst := NewInstance(ic, cfg)
+		inst := NewInstance(ic, cfg, m.events, m.gpus)
 		m.instances = append(m.instances, inst)
 		m.byName[ic.Name] = inst
 	}
+	m.loadState()
 	return m
 }
 
@@ -37,6 +70,22 @@ func (m *Manager) Instances() []*Instance {
 	return result
 }
 
+// InstancesWithTag returns the instances tagged tag, or all of them if tag is
+// empty.
+func (m *Manager) InstancesWithTag(tag string) []*Instance {
+	instances := m.Instances()
+	if tag == "" {
+		return instances
+	}
+	var tagged []*Instance
+	for _, inst := range instances {
+		if inst.conf.HasTag(tag) {
+			tagged = append(tagged, inst)
+		}
+	}
+	return tagged
+}
+
 func (m *Manager) Get(name string) *Instance {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -48,9 +97,64 @@ func (m *Manager) StartAll() {
 	insts := make([]*Instance, len(m.instances))
 	copy(insts, m.instances)
 	m.mu.RUnlock()
+	adopted := m.adoptProcesses()
+	m.stopOrphans(m.findOrphans())
+	var toStart []*Instance
 	for _, inst := range insts {
-		m.supervise(inst)
+		if adopted[inst] {
+			continue
+		}
+		if !inst.conf.ShouldAutoStart() {
+			instanceLogger(inst.conf.Name).Info("auto_start disabled, not starting", "event", "autostart_skipped")
+			continue
+		}
+		toStart = append(toStart, inst)
+	}
+	// loaded is closed for each instance some other one must start_after,
+	// once it has finished loading.
+	loaded := make(map[string]chan struct{})
+	for _, inst := range toStart {
+		for _, name := range inst.conf.StartAfter {
+			if slices.ContainsFunc(toStart, func(i *Instance) bool { return i.conf.Name == name }) {
+				loaded[name] = make(chan struct{})
+			}
+		}
 	}
+	gate := m.newStartupGate()
+	var queued []*Instance
+	for _, inst := range toStart {
+		done := loaded[inst.conf.Name]
+		switch {
+		case len(inst.conf.predecessors()) > 0:
+			m.startAfterDependencies(inst, gate, loaded)
+		case gate != nil:
+			queued = append(queued, inst)
+		case done != nil:
+			m.wg.Add(1)
+			go func() {
+				defer m.wg.Done()
+				defer close(done)
+				m.startGated(inst, nil, true)
+			}()
+		default:
+			m.supervise(inst, nil)
+		}
+	}
+	if len(queued) > 0 {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			for _, inst := range queued {
+				m.startGated(inst, gate, false)
+				if done := loaded[inst.conf.Name]; done != nil {
+					close(done)
+				}
+			}
+		}()
+	}
+	m.startIdleReaper()
+	m.startScheduler()
+	m.startMetricsHistory()
 }
 
 func (m *Manager) StartInstance(name string) error {
@@ -58,51 +162,157 @@ func (m *Manager) StartInstance(name string) error {
 	inst := m.byName[name]
 	m.mu.RUnlock()
 	if inst == nil {
-		return nil
+		return errInstanceNotFound
+	}
+	if s := inst.State(); s == StateRunning || s == StateStarting || s == StateRestarting || s == StateUnhealthy {
+		return fmt.Errorf("%w: %q is %s", errInstanceActive, name, s)
 	}
 	inst.ResetRestarts()
-	m.supervise(inst)
+	if !inst.claimSupervisor() && inst.requestRestart(true) {
+		return nil
+	}
+	exitCh, err := inst.Start()
+	if err != nil {
+		inst.releaseSupervisor()
+		return err
+	}
+	m.runSupervisor(inst, exitCh)
+	m.saveState()
 	return nil
 }
 
-func (m *Manager) StopInstance(name string) error {
+func (m *Manager) StopInstance(name string, force bool) error {
 	m.mu.RLock()
 	inst := m.byName[name]
 	m.mu.RUnlock()
 	if inst == nil {
-		return nil
+		return errInstanceNotFound
 	}
-	return inst.Stop()
+	if !force {
+		m.drain(inst)
+	}
+	err := inst.Stop()
+	m.saveState()
+	return err
 }
 
-func (m *Manager) RestartInstance(name string) error {
+// DrainInstance stops routing new requests to a running instance, waits for
+// its in-flight requests to finish and then stops it. A zero timeout means
+// drain_timeout, or defaultDrainTimeout if that is off. It reports whether the
+// requests finished in time.
+func (m *Manager) DrainInstance(name string, timeout time.Duration) (bool, error) {
+	inst := m.Get(name)
+	if inst == nil {
+		return false, errInstanceNotFound
+	}
+	if timeout <= 0 {
+		m.cfg.mu.RLock()
+		timeout = m.cfg.DrainTimeout.Duration
+		m.cfg.mu.RUnlock()
+	}
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+	drained := true
+	if inst.State() == StateRunning {
+		inst.SetDraining(true)
+		drained = inst.Drain(timeout)
+	}
+	err := inst.Stop()
+	inst.SetDraining(false)
+	m.saveState()
+	return drained, err
+}
+
+func (m *Manager) RestartInstance(name string, force bool) error {
 	m.mu.RLock()
 	inst := m.byName[name]
 	m.mu.RUnlock()
 	if inst == nil {
-		return nil
+		return errInstanceNotFound
 	}
 	inst.ResetRestarts()
-	_ = inst.Stop()
-	time.Sleep(500 * time.Millisecond)
-	m.supervise(inst)
+	if !inst.requestRestart(force) {
+		m.runSupervisor(inst, nil)
+	}
+	m.saveState()
+	return nil
+}
+
+func (m *Manager) drain(inst *Instance) {
+	m.cfg.mu.RLock()
+	timeout := m.cfg.DrainTimeout.Duration
+	m.cfg.mu.RUnlock()
+	if timeout <= 0 || inst.State() != StateRunning {
+		return
+	}
+	inst.Drain(timeout)
+}
+
+// cycle stops the process for a requested restart and waits for it to exit.
+// It returns false if the instance was stopped or the manager is shutting down.
+func (m *Manager) cycle(inst *Instance, force bool, exitCh <-chan struct{}) bool {
+	if !force {
+		m.drain(inst)
+	}
+	_ = inst.stop(StateRestarting)
+	if exitCh != nil {
+		select {
+		case <-exitCh:
+		case <-m.stopCh:
+			if !m.detached {
+				_ = inst.Stop()
+				<-exitCh
+			}
+			return false
+		}
+	}
+	select {
+	case <-time.After(restartSettleDelay):
+	case <-m.stopCh:
+		_ = inst.Stop()
+		return false
+	}
+	return inst.State() != StateStopped
+}
+
+func (m *Manager) PauseInstance(name string) error {
+	inst := m.Get(name)
+	if inst == nil {
+		return errInstanceNotFound
+	}
+	inst.SetPaused(true)
+	instanceLogger(name).Info("supervision paused", "event", "supervision_paused")
+	return nil
+}
+
+func (m *Manager) ResumeInstance(name string) error {
+	inst := m.Get(name)
+	if inst == nil {
+		return errInstanceNotFound
+	}
+	inst.SetPaused(false)
+	instanceLogger(name).Info("supervision resumed", "event", "supervision_resumed")
+	if s := inst.State(); s == StateCrashed || s == StateStopped {
+		return m.StartInstance(name)
+	}
 	return nil
 }
 
 func (m *Manager) AddInstance(ic InstanceConf) {
-	inst := NewInstance(ic, m.cfg)
+	inst := NewInstance(ic, m.cfg, m.events, m.gpus)
 	m.mu.Lock()
 	m.instances = append(m.instances, inst)
 	m.byName[ic.Name] = inst
 	m.mu.Unlock()
 }
 
-func (m *Manager) RemoveInstance(name string) {
+func (m *Manager) RemoveInstance(name string) error {
 	m.mu.Lock()
 	inst := m.byName[name]
 	if inst == nil {
 		m.mu.Unlock()
-		return
+		return errInstanceNotFound
 	}
 	delete(m.byName, name)
 	for i, in := range m.instances {
@@ -112,14 +322,33 @@ func (m *Manager) RemoveInstance(name string) {
 		}
 	}
 	m.mu.Unlock()
-	_ = inst.Stop()
+	return inst.Stop()
 }
 
-func (m *Manager) supervise(inst *Instance) {
+// supervise starts supervising inst unless another goroutine already does.
+func (m *Manager) supervise(inst *Instance, exitCh <-chan struct{}) {
+	if !inst.claimSupervisor() {
+		return
+	}
+	m.runSupervisor(inst, exitCh)
+}
+
+func (m *Manager) runSupervisor(inst *Instance, exitCh <-chan struct{}) {
 	m.wg.Add(1)
 	go func() {
 		defer m.wg.Done()
-		m.runWithRestart(inst)
+		for {
+			m.runWithRestart(inst, exitCh)
+			force, pending := inst.releaseSupervisor()
+			if !pending || m.ShuttingDown() {
+				return
+			}
+			if !m.cycle(inst, force, nil) {
+				inst.releaseSupervisor()
+				return
+			}
+			exitCh = nil
+		}
 	}()
 }
 
@@ -129,46 +358,95 @@ func (m *Manager) isManaged(inst *Instance) bool {
 	return m.byName[inst.conf.Name] == inst
 }
 
-func (m *Manager) runWithRestart(inst *Instance) {
+func (m *Manager) runWithRestart(inst *Instance, exitCh <-chan struct{}) {
 	for {
-		if !m.isManaged(inst) {
-			return
-		}
-		exitCh, err := inst.Start()
-		if err != nil {
-			log.Printf("[%s] failed to start: %v", inst.conf.Name, err)
-			return
+		if exitCh == nil {
+			if !m.isManaged(inst) {
+				return
+			}
+			var err error
+			exitCh, err = inst.Start()
+			if err != nil {
+				instanceLogger(inst.conf.Name).Error("failed to start", "event", "start_failed", "error", err)
+				return
+			}
+			m.saveState()
 		}
 
 		go m.healthCheckLoop(inst)
 
 		select {
 		case <-exitCh:
+		case force := <-inst.restartCh:
+			if !m.cycle(inst, force, exitCh) {
+				return
+			}
+			exitCh = nil
+			continue
 		case <-m.stopCh:
-			_ = inst.Stop()
+			if !m.detached {
+				_ = inst.Stop()
+				<-exitCh
+			}
+			return
+		}
+
+		restart, force, stopped := inst.afterExit()
+		if restart {
+			if !m.cycle(inst, force, nil) {
+				return
+			}
+			exitCh = nil
+			continue
+		}
+		if stopped {
+			return
+		}
+
+		m.notifier.Notify(notifyCrashed, inst.Status())
+		m.saveState()
+
+		if inst.Paused() {
+			instanceLogger(inst.conf.Name).Info("supervision paused, not restarting", "event", "restart_skipped_paused")
 			return
 		}
 
-		if inst.State() == StateStopped {
+		m.cfg.mu.RLock()
+		restartOnOOM := m.cfg.RestartOnOOM
+		m.cfg.mu.RUnlock()
+		if inst.OOM() && !restartOnOOM {
+			instanceLogger(inst.conf.Name).Warn("out of GPU memory, not restarting", "event", "restart_skipped_oom")
+			m.notifier.Notify(notifyOOM, inst.Status())
 			return
 		}
 
 		inst.IncrementRestarts()
+		m.saveState()
 		count := inst.RestartCount()
-		if m.cfg.MaxRestarts > 0 && count >= m.cfg.MaxRestarts {
-			log.Printf("[%s] reached max restarts (%d), giving up", inst.conf.Name, m.cfg.MaxRestarts)
+		eff := m.cfg.Effective(inst.conf)
+		if eff.MaxRestarts > 0 && count >= eff.MaxRestarts {
+			instanceLogger(inst.conf.Name).Warn("reached max restarts, giving up", "event", "restart_gave_up", "max_restarts", eff.MaxRestarts)
+			m.notifier.Notify(notifyGaveUp, inst.Status())
 			return
 		}
 
+		exitCh = nil
 		inst.SetState(StateRestarting)
-		log.Printf("[%s] restarting in %s (restart %d)", inst.conf.Name, m.cfg.RestartDelay.Duration, count)
+		instanceLogger(inst.conf.Name).Info("restart scheduled", "event", "restart_scheduled", "delay", eff.RestartDelay.Duration.String(), "restart_count", count)
 
 		select {
-		case <-time.After(m.cfg.RestartDelay.Duration):
+		case <-time.After(eff.RestartDelay.Duration):
+		case <-inst.restartCh:
 		case <-m.stopCh:
 			inst.SetState(StateStopped)
 			return
 		}
+
+		if inst.Paused() {
+			inst.SetState(StateCrashed)
+			instanceLogger(inst.conf.Name).Info("supervision paused, not restarting", "event", "restart_skipped_paused")
+			return
+		}
 	}
 }
 
@@ -183,13 +461,28 @@ func (m *Manager) healthCheckLoop(inst *Instance) {
 
 	ticker := time.NewTicker(m.cfg.HealthCheckInterval.Duration)
 	defer ticker.Stop()
+	sampleTicker := time.NewTicker(resourceSampleInterval)
+	defer sampleTicker.Stop()
 
+	inst.sampleResources()
 	for {
 		select {
+		case <-sampleTicker.C:
+			inst.sampleResources()
 		case <-ticker.C:
-			if inst.State() == StateStarting || inst.State() == StateRunning {
-				if inst.CheckHealth() {
-					inst.SetState(StateRunning)
+			if inst.startupTimedOut() {
+				m.notifier.Notify(notifyStartupTimeout, inst.Status())
+				_ = inst.terminate()
+				continue
+			}
+			if state := inst.State(); (state == StateStarting || state == StateRunning) && !inst.isProbing() {
+				inst.UpdateReadiness()
+				switch {
+				case inst.State() == StateUnhealthy:
+					m.notifier.Notify(notifyUnhealthy, inst.Status())
+					_ = inst.terminate()
+				case state == StateStarting && inst.State() == StateRunning:
+					m.notifier.Notify(notifyRecovered, inst.Status())
 				}
 			}
 		case <-stopCh:
@@ -198,8 +491,27 @@ func (m *Manager) healthCheckLoop(inst *Instance) {
 	}
 }
 
-func (m *Manager) Shutdown() {
-	log.Println("shutting down all instances...")
+func (m *Manager) ShuttingDown() bool {
+	select {
+	case <-m.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *Manager) Shutdown(timeout time.Duration) bool {
+	m.cfg.mu.RLock()
+	detach := m.cfg.DetachOnShutdown
+	m.cfg.mu.RUnlock()
+	if detach {
+		slog.Info("leaving instances running for the next start to adopt", "event", "shutdown_detached")
+		m.detached = true
+		close(m.stopCh)
+		m.saveState()
+		return true
+	}
+	slog.Info("shutting down all instances", "event", "shutdown_started")
 	close(m.stopCh)
 	m.mu.RLock()
 	insts := make([]*Instance, len(m.instances))
@@ -208,6 +520,21 @@ func (m *Manager) Shutdown() {
 	for _, inst := range insts {
 		_ = inst.Stop()
 	}
-	m.wg.Wait()
-	log.Println("all instances stopped")
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("all instances stopped", "event", "shutdown_complete")
+		return true
+	case <-time.After(timeout):
+		slog.Error("instances still running after shutdown timeout, killing", "event", "shutdown_forced", "timeout", timeout.String())
+		for _, inst := range insts {
+			inst.Kill()
+		}
+		return false
+	}
 }
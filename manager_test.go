@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestRapidRestartsKeepOneSupervisor(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "llama-server")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t, fmt.Sprintf(`
+gpu_backend: cuda
+vram_check: off
+health_check_interval: 1h
+state_file: %s
+instances:
+  - name: a
+    model: /models/a.gguf
+    port: %d
+    gpu_ids: [0]
+`, filepath.Join(dir, "state.json"), freePort(t)))
+	cfg.ServerBin = bin
+	m := NewManager(cfg)
+	t.Cleanup(func() { m.Shutdown(10 * time.Second) })
+	inst := m.Get("a")
+
+	started := time.Now()
+	if err := m.StartInstance("a"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "first start", func() bool { return inst.startedSince(started) && inst.State() == StateStarting })
+	time.Sleep(100 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	for range 3 {
+		restarted := time.Now()
+		for range 20 {
+			if err := m.RestartInstance("a", true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		waitFor(t, "restart", func() bool { return inst.startedSince(restarted) && inst.State() == StateStarting })
+		if inst.claimSupervisor() {
+			t.Fatal("claimSupervisor succeeded while a supervisor is running")
+		}
+	}
+
+	// Let coalesced restart requests finish before counting.
+	waitFor(t, "goroutines to settle", func() bool {
+		time.Sleep(restartSettleDelay)
+		return inst.State() == StateStarting && runtime.NumGoroutine() <= before
+	})
+	if !inst.isSupervised() {
+		t.Error("instance is no longer supervised")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type MetricsReport struct {
+	Metrics map[string]*InstanceMetrics `json:"metrics"`
+	Missing map[string]string           `json:"missing"`
+}
+
+func collectMetrics(ctx context.Context, instances []*Instance, timeout time.Duration) MetricsReport {
+	type metricsResult struct {
+		name    string
+		metrics *InstanceMetrics
+		err     error
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ch := make(chan metricsResult, len(instances))
+	for _, inst := range instances {
+		go func(inst *Instance) {
+			m, err := inst.FetchMetrics(ctx)
+			ch <- metricsResult{name: inst.conf.Name, metrics: m, err: err}
+		}(inst)
+	}
+
+	report := MetricsReport{
+		Metrics: make(map[string]*InstanceMetrics),
+		Missing: make(map[string]string),
+	}
+	pending := make(map[string]bool, len(instances))
+	for _, inst := range instances {
+		pending[inst.conf.Name] = true
+	}
+	for len(pending) > 0 {
+		select {
+		case mr := <-ch:
+			delete(pending, mr.name)
+			if mr.err != nil {
+				report.Missing[mr.name] = mr.err.Error()
+			} else {
+				report.Metrics[mr.name] = mr.metrics
+			}
+		case <-ctx.Done():
+			reason := "timed out"
+			if errors.Is(ctx.Err(), context.Canceled) {
+				reason = "canceled"
+			}
+			for name := range pending {
+				report.Missing[name] = reason
+			}
+			return report
+		}
+	}
+	return report
+}
+
+// MetricsCache reuses the last scrape of every instance for up to
+// metrics_cache_ttl. mu serializes scrapes; the snapshot itself is read
+// without it so callers that must not wait on the network never block.
+type MetricsCache struct {
+	cfg        *Config
+	mu         sync.Mutex
+	last       atomic.Pointer[metricsSnapshot]
+	refreshing atomic.Bool
+}
+
+type metricsSnapshot struct {
+	report    MetricsReport
+	fetchedAt time.Time
+}
+
+func NewMetricsCache(cfg *Config) *MetricsCache {
+	return &MetricsCache{cfg: cfg}
+}
+
+func (mc *MetricsCache) ttl() time.Duration {
+	mc.cfg.mu.RLock()
+	defer mc.cfg.mu.RUnlock()
+	return mc.cfg.MetricsCacheTTL.Duration
+}
+
+func (mc *MetricsCache) Get(ctx context.Context, instances []*Instance, timeout time.Duration, refresh bool) MetricsReport {
+	ttl := mc.ttl()
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if snap := mc.last.Load(); !refresh && snap.fresh(ttl) && snap.covers(instances) {
+		return snap.report
+	}
+	report := collectMetrics(ctx, instances, timeout)
+	if ctx.Err() == nil {
+		mc.last.Store(&metricsSnapshot{report: report, fetchedAt: time.Now()})
+	}
+	return report
+}
+
+// Recent returns the metrics of the last scrape if it is at most one TTL
+// old. Otherwise it returns nil and starts a scrape of instances in the
+// background, so the next call has fresh numbers.
+func (mc *MetricsCache) Recent(instances []*Instance) map[string]*InstanceMetrics {
+	if snap := mc.last.Load(); snap.fresh(mc.ttl()) {
+		return snap.report.Metrics
+	}
+	if mc.refreshing.CompareAndSwap(false, true) {
+		go func() {
+			defer mc.refreshing.Store(false)
+			mc.Get(context.Background(), instances, metricsFanoutTimeout, false)
+		}()
+	}
+	return nil
+}
+
+func (snap *metricsSnapshot) fresh(ttl time.Duration) bool {
+	return snap != nil && ttl > 0 && time.Since(snap.fetchedAt) < ttl
+}
+
+func (snap *metricsSnapshot) covers(instances []*Instance) bool {
+	if len(instances) != len(snap.report.Metrics)+len(snap.report.Missing) {
+		return false
+	}
+	for _, inst := range instances {
+		if _, ok := snap.report.Metrics[inst.conf.Name]; ok {
+			continue
+		}
+		if _, ok := snap.report.Missing[inst.conf.Name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// MetricsTotals adds up the metrics of a set of instances. KV cache usage is
+// a ratio per instance, so it is averaged rather than summed.
+type MetricsTotals struct {
+	Instances          []string `json:"instances"`
+	PromptTokensSec    float64  `json:"prompt_tokens_sec"`
+	PredictedTokensSec float64  `json:"predicted_tokens_sec"`
+	RequestsProcessing float64  `json:"requests_processing"`
+	RequestsDeferred   float64  `json:"requests_deferred"`
+	KVCacheUsage       float64  `json:"kv_cache_usage"`
+	KVCacheUsageMax    float64  `json:"kv_cache_usage_max"`
+}
+
+func (t *MetricsTotals) add(name string, m *InstanceMetrics) {
+	n := float64(len(t.Instances))
+	t.Instances = append(t.Instances, name)
+	t.PromptTokensSec += m.PromptTokensSec
+	t.PredictedTokensSec += m.PredictedTokensSec
+	t.RequestsProcessing += m.RequestsProcessing
+	t.RequestsDeferred += m.RequestsDeferred
+	t.KVCacheUsage = (t.KVCacheUsage*n + m.KVCacheUsage) / (n + 1)
+	t.KVCacheUsageMax = max(t.KVCacheUsageMax, m.KVCacheUsage)
+}
+
+// MetricsSummary totals a metrics report overall and per GPU. An instance
+// split across several GPUs counts fully toward each of them.
+type MetricsSummary struct {
+	Overall MetricsTotals          `json:"overall"`
+	GPUs    map[int]*MetricsTotals `json:"gpus"`
+	Missing map[string]string      `json:"missing"`
+}
+
+func summarizeMetrics(report MetricsReport, instances []*Instance) MetricsSummary {
+	s := MetricsSummary{
+		Overall: MetricsTotals{Instances: []string{}},
+		GPUs:    make(map[int]*MetricsTotals),
+		Missing: report.Missing,
+	}
+	for _, inst := range instances {
+		st := inst.Status()
+		m, ok := report.Metrics[st.Name]
+		if !ok {
+			continue
+		}
+		s.Overall.add(st.Name, m)
+		for _, id := range st.GPUIDs {
+			if s.GPUs[id] == nil {
+				s.GPUs[id] = &MetricsTotals{}
+			}
+			s.GPUs[id].add(st.Name, m)
+		}
+	}
+	return s
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHistoryRange = time.Hour
+	// maxHistoryPoints caps how many samples a history query returns per
+	// instance; longer ranges are averaged into wider steps.
+	maxHistoryPoints = 360
+)
+
+// MetricsSample is one point of an instance's metrics history.
+type MetricsSample struct {
+	Time               time.Time `json:"time"`
+	PromptTokensSec    float64   `json:"prompt_tokens_sec"`
+	PredictedTokensSec float64   `json:"predicted_tokens_sec"`
+	KVCacheUsage       float64   `json:"kv_cache_usage"`
+	RequestsProcessing float64   `json:"requests_processing"`
+	RequestsDeferred   float64   `json:"requests_deferred"`
+}
+
+func (s *MetricsSample) add(o MetricsSample) {
+	s.PromptTokensSec += o.PromptTokensSec
+	s.PredictedTokensSec += o.PredictedTokensSec
+	s.KVCacheUsage += o.KVCacheUsage
+	s.RequestsProcessing += o.RequestsProcessing
+	s.RequestsDeferred += o.RequestsDeferred
+}
+
+func (s *MetricsSample) scale(f float64) {
+	s.PromptTokensSec *= f
+	s.PredictedTokensSec *= f
+	s.KVCacheUsage *= f
+	s.RequestsProcessing *= f
+	s.RequestsDeferred *= f
+}
+
+// MetricsHistory keeps the samples of the last metrics_history_retention in
+// memory, oldest first per instance. Instances that aren't running have no
+// samples for that time.
+type MetricsHistory struct {
+	mu      sync.Mutex
+	samples map[string][]MetricsSample
+}
+
+func (h *MetricsHistory) record(at time.Time, report MetricsReport, keep map[string]bool, retention time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.samples == nil {
+		h.samples = make(map[string][]MetricsSample)
+	}
+	for name, m := range report.Metrics {
+		h.samples[name] = append(h.samples[name], MetricsSample{
+			Time:               at,
+			PromptTokensSec:    m.PromptTokensSec,
+			PredictedTokensSec: m.PredictedTokensSec,
+			KVCacheUsage:       m.KVCacheUsage,
+			RequestsProcessing: m.RequestsProcessing,
+			RequestsDeferred:   m.RequestsDeferred,
+		})
+	}
+	cutoff := at.Add(-retention)
+	for name, samples := range h.samples {
+		if !keep[name] {
+			delete(h.samples, name)
+			continue
+		}
+		i := 0
+		for i < len(samples) && samples[i].Time.Before(cutoff) {
+			i++
+		}
+		if i > 0 {
+			h.samples[name] = append([]MetricsSample(nil), samples[i:]...)
+		}
+	}
+}
+
+// query returns name's samples since the given time, averaged into buckets
+// of step.
+func (h *MetricsHistory) query(name string, since time.Time, step time.Duration) []MetricsSample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := []MetricsSample{}
+	var bucket MetricsSample
+	n := 0
+	flush := func() {
+		if n > 0 {
+			bucket.scale(1 / float64(n))
+			out = append(out, bucket)
+		}
+	}
+	for _, s := range h.samples[name] {
+		if s.Time.Before(since) {
+			continue
+		}
+		start := s.Time.Truncate(step)
+		if n > 0 && start.Equal(bucket.Time) {
+			bucket.add(s)
+			n++
+			continue
+		}
+		flush()
+		bucket, n = s, 1
+		bucket.Time = start
+	}
+	flush()
+	return out
+}
+
+// historyStep is the bucket width for a query over rng: the sampling
+// interval, widened so no more than maxHistoryPoints come back.
+func historyStep(rng, interval, requested time.Duration) time.Duration {
+	step := max(requested, interval)
+	if minStep := rng / maxHistoryPoints; step < minStep {
+		step = minStep
+	}
+	return max(step.Round(time.Second), time.Second)
+}
+
+func (m *Manager) startMetricsHistory() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		for {
+			m.cfg.mu.RLock()
+			interval := m.cfg.MetricsInterval.Duration
+			retention := m.cfg.MetricsRetention.Duration
+			m.cfg.mu.RUnlock()
+			wait := interval
+			if wait <= 0 {
+				// Disabled; check again in case settings change.
+				wait = time.Minute
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-m.stopCh:
+				timer.Stop()
+				return
+			}
+			if interval <= 0 {
+				continue
+			}
+			instances := m.Instances()
+			keep := make(map[string]bool, len(instances))
+			for _, inst := range instances {
+				keep[inst.conf.Name] = true
+			}
+			report := collectMetrics(context.Background(), instances, metricsFanoutTimeout)
+			m.history.record(time.Now(), report, keep, retention)
+		}
+	}()
+}
@@ -1,9 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -12,6 +21,163 @@ type CachedModel struct {
 	FileName string `json:"file_name"`
 	SizeMB   int64  `json:"size_mb"`
 	Path     string `json:"path"`
+	Valid    bool   `json:"valid"`
+	Version  uint32 `json:"gguf_version,omitempty"`
+	Partial  bool   `json:"partial,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	Shards     int `json:"shards,omitempty"`
+	ShardTotal int `json:"shard_total,omitempty"`
+}
+
+const (
+	ggufMagic      = "GGUF"
+	ggufMaxVersion = 3
+)
+
+var errGGUFTruncated = errors.New("truncated GGUF file")
+
+// ggmlTypeSizes is the block length in elements and bytes per block of each
+// ggml tensor type, by type id.
+var ggmlTypeSizes = map[uint32][2]uint64{
+	0: {1, 4}, 1: {1, 2}, 2: {32, 18}, 3: {32, 20}, 6: {32, 22}, 7: {32, 24},
+	8: {32, 34}, 9: {32, 36}, 10: {256, 84}, 11: {256, 110}, 12: {256, 144},
+	13: {256, 176}, 14: {256, 210}, 15: {256, 292}, 16: {256, 66},
+	17: {256, 74}, 18: {256, 98}, 19: {256, 50}, 20: {32, 18}, 21: {256, 110},
+	22: {256, 82}, 23: {256, 136}, 24: {1, 1}, 25: {1, 2}, 26: {1, 4},
+	27: {1, 8}, 28: {1, 8}, 29: {256, 56}, 30: {1, 2}, 34: {256, 54},
+	35: {256, 66}, 39: {32, 17},
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func readGGUFHeader(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var hdr [8]byte
+	if _, err := io.ReadFull(f, hdr[:]); err != nil {
+		return 0, fmt.Errorf("file too short for a GGUF header")
+	}
+	if string(hdr[:4]) != ggufMagic {
+		return 0, fmt.Errorf("missing GGUF magic")
+	}
+	version := binary.LittleEndian.Uint32(hdr[4:])
+	if version == 0 || version > ggufMaxVersion {
+		return version, fmt.Errorf("unsupported GGUF version %d", version)
+	}
+	if version < 2 {
+		return version, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return version, err
+	}
+	want, err := ggufFileSize(f, int64(len(hdr)))
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return version, fmt.Errorf("%w: it ends inside the header", errGGUFTruncated)
+	}
+	if err != nil {
+		return version, err
+	}
+	if info.Size() < want {
+		return version, fmt.Errorf("%w: %d of %d bytes", errGGUFTruncated, info.Size(), want)
+	}
+	return version, nil
+}
+
+// ggufFileSize reads the metadata and tensor infos that follow the first
+// offset bytes of a GGUF (v2/v3) file and returns how large the file must be
+// to hold all tensor data. It returns 0 when a tensor type is unknown.
+func ggufFileSize(r io.Reader, offset int64) (int64, error) {
+	cr := &countingReader{r: r, n: offset}
+	g := &ggufReader{r: bufio.NewReaderSize(cr, 1<<16)}
+	tensors, err := g.u64()
+	if err != nil {
+		return 0, err
+	}
+	kvs, err := g.u64()
+	if err != nil {
+		return 0, err
+	}
+	if tensors > 1<<20 || kvs > 1<<20 {
+		return 0, fmt.Errorf("implausible GGUF header: %d tensors, %d metadata keys", tensors, kvs)
+	}
+	alignment := uint64(32)
+	for range kvs {
+		key, err := g.str()
+		if err != nil {
+			return 0, err
+		}
+		typ, err := g.u32()
+		if err != nil {
+			return 0, err
+		}
+		v, err := g.value(typ)
+		if err != nil {
+			return 0, err
+		}
+		if a, ok := v.(float64); ok && key == "general.alignment" && a > 0 {
+			alignment = uint64(a)
+		}
+	}
+	var end uint64
+	known := true
+	for range tensors {
+		if _, err := g.str(); err != nil {
+			return 0, err
+		}
+		dims, err := g.u32()
+		if err != nil {
+			return 0, err
+		}
+		if dims > 8 {
+			return 0, fmt.Errorf("implausible GGUF header: tensor with %d dimensions", dims)
+		}
+		elems := uint64(1)
+		for range dims {
+			n, err := g.u64()
+			if err != nil {
+				return 0, err
+			}
+			elems *= n
+		}
+		typ, err := g.u32()
+		if err != nil {
+			return 0, err
+		}
+		off, err := g.u64()
+		if err != nil {
+			return 0, err
+		}
+		size, ok := ggmlTypeSizes[typ]
+		if !ok {
+			known = false
+			continue
+		}
+		end = max(end, off+elems/size[0]*size[1])
+	}
+	if !known {
+		return 0, nil
+	}
+	pos := uint64(cr.n - int64(g.r.Buffered()))
+	return int64((pos+alignment-1)/alignment*alignment + end), nil
+}
+
+func isValidGGUF(path string) bool {
+	_, err := readGGUFHeader(path)
+	return err == nil
 }
 
 func getCacheDir() string {
@@ -35,6 +201,61 @@ func getCacheDir() string {
 	}
 }
 
+var shardPattern = regexp.MustCompile(`^(.+)-(\d{5})-of-(\d{5})\.gguf$`)
+
+func parseShardName(fileName string) (base string, index, total int, ok bool) {
+	m := shardPattern.FindStringSubmatch(fileName)
+	if m == nil {
+		return "", 0, 0, false
+	}
+	index, _ = strconv.Atoi(m[2])
+	total, _ = strconv.Atoi(m[3])
+	if index < 1 || total < 1 || index > total {
+		return "", 0, 0, false
+	}
+	return m[1], index, total, true
+}
+
+func shardFileName(base string, index, total int) string {
+	return fmt.Sprintf("%s-%05d-of-%05d.gguf", base, index, total)
+}
+
+func firstShardPath(path string) string {
+	base, index, total, ok := parseShardName(filepath.Base(path))
+	if !ok || index == 1 {
+		return path
+	}
+	return filepath.Join(filepath.Dir(path), shardFileName(base, 1, total))
+}
+
+func modelWarning(model string) string {
+	spec := parseModelSpec(model)
+	if err := spec.Validate(); err != nil {
+		return err.Error()
+	}
+	if !spec.Local {
+		return ""
+	}
+	path := spec.LocalPath()
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Sprintf("model file %s not found", path)
+	}
+	if _, err := readGGUFHeader(path); err != nil {
+		return fmt.Sprintf("model file %s: %v", path, err)
+	}
+	return ""
+}
+
+type shardGroup struct {
+	base    string
+	total   int
+	size    int64
+	present map[int]bool
+	partial bool
+	invalid string
+	version uint32
+}
+
 func scanCachedModels() ([]CachedModel, error) {
 	dir := getCacheDir()
 	entries, err := os.ReadDir(dir)
@@ -46,22 +267,89 @@ func scanCachedModels() ([]CachedModel, error) {
 	}
 
 	var models []CachedModel
+	groups := make(map[string]*shardGroup)
+	var order []string
 	for _, e := range entries {
-		if e.IsDir() || !strings.HasSuffix(e.Name(), ".gguf") {
+		partial := strings.HasSuffix(e.Name(), ".gguf.part")
+		if e.IsDir() || (!strings.HasSuffix(e.Name(), ".gguf") && !partial) {
 			continue
 		}
 		info, err := e.Info()
 		if err != nil {
 			continue
 		}
+		if base, index, total, ok := parseShardName(strings.TrimSuffix(e.Name(), ".part")); ok {
+			key := shardFileName(base, 1, total)
+			g := groups[key]
+			if g == nil {
+				g = &shardGroup{base: base, total: total, present: make(map[int]bool)}
+				groups[key] = g
+				order = append(order, key)
+			}
+			g.size += info.Size()
+			if partial {
+				g.partial = true
+				continue
+			}
+			g.present[index] = true
+			version, err := readGGUFHeader(filepath.Join(dir, e.Name()))
+			if index == 1 {
+				g.version = version
+			}
+			if errors.Is(err, errGGUFTruncated) {
+				g.partial = true
+			}
+			if err != nil && g.invalid == "" {
+				g.invalid = fmt.Sprintf("%s: %v", e.Name(), err)
+			}
+			continue
+		}
 		name := e.Name()
-		name = strings.TrimSuffix(name, ".gguf")
-		models = append(models, CachedModel{
+		name = strings.TrimSuffix(strings.TrimSuffix(name, ".part"), ".gguf")
+		m := CachedModel{
 			Name:     name,
 			FileName: e.Name(),
 			SizeMB:   info.Size() / (1024 * 1024),
 			Path:     filepath.Join(dir, e.Name()),
-		})
+			Partial:  partial,
+		}
+		if partial {
+			m.Error = "incomplete download"
+		} else if version, err := readGGUFHeader(m.Path); err != nil {
+			m.Version = version
+			m.Partial = errors.Is(err, errGGUFTruncated)
+			m.Error = err.Error()
+		} else {
+			m.Version = version
+			m.Valid = true
+		}
+		models = append(models, m)
+	}
+
+	for _, key := range order {
+		g := groups[key]
+		m := CachedModel{
+			Name:       g.base,
+			FileName:   key,
+			SizeMB:     g.size / (1024 * 1024),
+			Path:       filepath.Join(dir, key),
+			Version:    g.version,
+			Partial:    g.partial,
+			Shards:     len(g.present),
+			ShardTotal: g.total,
+		}
+		switch {
+		case g.partial:
+			m.Error = cmp.Or(g.invalid, "incomplete download")
+		case len(g.present) < g.total:
+			m.Error = fmt.Sprintf("missing %d of %d shards", g.total-len(g.present), g.total)
+		case g.invalid != "":
+			m.Error = g.invalid
+		default:
+			m.Valid = true
+		}
+		models = append(models, m)
 	}
+	sort.SliceStable(models, func(i, j int) bool { return models[i].FileName < models[j].FileName })
 	return models, nil
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testGGUF builds a v3 GGUF file with a tokenizer-like string array and one
+// 8x4 F32 tensor, 128 bytes of data after the 32-byte aligned header.
+func testGGUF() []byte {
+	var b bytes.Buffer
+	w := func(v any) { binary.Write(&b, binary.LittleEndian, v) }
+	str := func(s string) { w(uint64(len(s))); b.WriteString(s) }
+	b.WriteString(ggufMagic)
+	w(uint32(3))
+	w(uint64(1)) // tensors
+	w(uint64(2)) // metadata keys
+	str("general.alignment")
+	w(uint32(4))
+	w(uint32(32))
+	str("tokenizer.ggml.tokens")
+	w(uint32(9))
+	w(uint32(8))
+	w(uint64(3))
+	for _, tok := range []string{"a", "bc", "def"} {
+		str(tok)
+	}
+	str("blk.0.weight")
+	w(uint32(2))
+	w(uint64(8))
+	w(uint64(4))
+	w(uint32(0)) // F32
+	w(uint64(0))
+	for b.Len()%32 != 0 {
+		b.WriteByte(0)
+	}
+	b.Write(make([]byte, 8*4*4))
+	return b.Bytes()
+}
+
+func TestReadGGUFHeaderDetectsTruncation(t *testing.T) {
+	data := testGGUF()
+	dir := t.TempDir()
+	tests := []struct {
+		name      string
+		data      []byte
+		truncated bool
+	}{
+		{name: "complete", data: data},
+		{name: "missing last byte", data: data[:len(data)-1], truncated: true},
+		{name: "missing tensor data", data: data[:len(data)-128], truncated: true},
+		{name: "ends inside metadata", data: data[:40], truncated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-")+".gguf")
+			if err := os.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			version, err := readGGUFHeader(path)
+			if version != 3 {
+				t.Errorf("version = %d, want 3", version)
+			}
+			if tt.truncated {
+				if !errors.Is(err, errGGUFTruncated) {
+					t.Errorf("err = %v, want %v", err, errGGUFTruncated)
+				}
+			} else if err != nil {
+				t.Errorf("err = %v", err)
+			}
+		})
+	}
+}
+
+func TestScanCachedModelsFlagsTruncatedFiles(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("LLAMA_CACHE", dir)
+	data := testGGUF()
+	files := map[string][]byte{
+		"good.gguf":                 data,
+		"short.gguf":                data[:len(data)-16],
+		"split-00001-of-00002.gguf": data,
+		"split-00002-of-00002.gguf": data[:len(data)-16],
+		"resumed.gguf.part":         data[:64],
+		"not-a-model.gguf":          []byte("hello world"),
+		"ignored.bin":               data,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	models, err := scanCachedModels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type flags struct{ valid, partial bool }
+	want := map[string]flags{
+		"good.gguf":                 {valid: true},
+		"short.gguf":                {partial: true},
+		"split-00001-of-00002.gguf": {partial: true},
+		"resumed.gguf.part":         {partial: true},
+		"not-a-model.gguf":          {},
+	}
+	if len(models) != len(want) {
+		t.Errorf("got %d models, want %d: %+v", len(models), len(want), models)
+	}
+	for _, m := range models {
+		w, ok := want[m.FileName]
+		if !ok {
+			t.Errorf("unexpected model %s", m.FileName)
+			continue
+		}
+		if m.Valid != w.valid || m.Partial != w.partial {
+			t.Errorf("%s: valid=%v partial=%v (%s), want valid=%v partial=%v", m.FileName, m.Valid, m.Partial, m.Error, w.valid, w.partial)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type ModelSpec struct {
+	Local bool   `json:"local"`
+	Path  string `json:"path,omitempty"`
+	Repo  string `json:"repo,omitempty"`
+	Quant string `json:"quant,omitempty"`
+}
+
+var (
+	windowsPathRe = regexp.MustCompile(`^[A-Za-z]:[\\/]`)
+	hfRepoRe      = regexp.MustCompile(`^[\w.-]+/[\w.-]+$`)
+	hfQuantRe     = regexp.MustCompile(`^[\w.-]+$`)
+)
+
+func parseModelSpec(model string) ModelSpec {
+	model = strings.TrimSpace(model)
+	if isLocalModelPath(model) {
+		return ModelSpec{Local: true, Path: model}
+	}
+	repo, quant, _ := strings.Cut(model, ":")
+	return ModelSpec{Repo: repo, Quant: quant}
+}
+
+func isLocalModelPath(model string) bool {
+	for _, prefix := range []string{"/", "~/", "./", "../", `.\`, `..\`, `\\`} {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return windowsPathRe.MatchString(model) ||
+		strings.Contains(model, `\`) ||
+		strings.HasSuffix(strings.ToLower(model), ".gguf")
+}
+
+func (s ModelSpec) Validate() error {
+	if s.Local {
+		if s.Path == "" {
+			return fmt.Errorf("model path is empty")
+		}
+		return nil
+	}
+	if !hfRepoRe.MatchString(s.Repo) {
+		return fmt.Errorf("model %q is neither a local path nor a HuggingFace owner/repo[:quant] id", s.String())
+	}
+	if s.Quant != "" && !hfQuantRe.MatchString(s.Quant) {
+		return fmt.Errorf("invalid quant %q in model %q", s.Quant, s.String())
+	}
+	return nil
+}
+
+func (s ModelSpec) String() string {
+	if s.Local {
+		return s.Path
+	}
+	if s.Quant != "" {
+		return s.Repo + ":" + s.Quant
+	}
+	return s.Repo
+}
+
+func (s ModelSpec) LocalPath() string {
+	path := s.Path
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, rest)
+		}
+	}
+	return firstShardPath(path)
+}
+
+func (s ModelSpec) Args() []string {
+	if s.Local {
+		return []string{"-m", s.LocalPath()}
+	}
+	return []string{"-hf", s.String()}
+}
@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestParseModelSpec(t *testing.T) {
+	tests := []struct {
+		model string
+		want  ModelSpec
+	}{
+		{"/models/qwen.gguf", ModelSpec{Local: true, Path: "/models/qwen.gguf"}},
+		{"~/models/qwen.gguf", ModelSpec{Local: true, Path: "~/models/qwen.gguf"}},
+		{"./model.gguf", ModelSpec{Local: true, Path: "./model.gguf"}},
+		{"../models/model", ModelSpec{Local: true, Path: "../models/model"}},
+		{"model.gguf", ModelSpec{Local: true, Path: "model.gguf"}},
+		{"MODEL.GGUF", ModelSpec{Local: true, Path: "MODEL.GGUF"}},
+		{`C:\models\x.gguf`, ModelSpec{Local: true, Path: `C:\models\x.gguf`}},
+		{`d:/models/x.gguf`, ModelSpec{Local: true, Path: `d:/models/x.gguf`}},
+		{`.\model.gguf`, ModelSpec{Local: true, Path: `.\model.gguf`}},
+		{`\\server\share\x.gguf`, ModelSpec{Local: true, Path: `\\server\share\x.gguf`}},
+		{`models\x`, ModelSpec{Local: true, Path: `models\x`}},
+		{"bartowski/Qwen-GGUF", ModelSpec{Repo: "bartowski/Qwen-GGUF"}},
+		{"bartowski/Qwen-GGUF:Q4_K_M", ModelSpec{Repo: "bartowski/Qwen-GGUF", Quant: "Q4_K_M"}},
+		{"  bartowski/Qwen-GGUF:Q8_0  ", ModelSpec{Repo: "bartowski/Qwen-GGUF", Quant: "Q8_0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			if got := parseModelSpec(tt.model); got != tt.want {
+				t.Errorf("parseModelSpec(%q) = %+v, want %+v", tt.model, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModelSpecValidate(t *testing.T) {
+	tests := []struct {
+		model string
+		ok    bool
+	}{
+		{"/models/qwen.gguf", true},
+		{"bartowski/Qwen-GGUF", true},
+		{"bartowski/Qwen-GGUF:Q4_K_M", true},
+		{"qwen", false},
+		{"a/b/c", false},
+		{"bartowski/Qwen-GGUF:Q4 K", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			err := parseModelSpec(tt.model).Validate()
+			if (err == nil) != tt.ok {
+				t.Errorf("Validate() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestModelSpecArgs(t *testing.T) {
+	tests := []struct {
+		model string
+		flag  string
+		value string
+	}{
+		{"/models/qwen.gguf", "-m", "/models/qwen.gguf"},
+		{"bartowski/Qwen-GGUF:Q4_K_M", "-hf", "bartowski/Qwen-GGUF:Q4_K_M"},
+	}
+	for _, tt := range tests {
+		args := parseModelSpec(tt.model).Args()
+		if len(args) != 2 || args[0] != tt.flag || args[1] != tt.value {
+			t.Errorf("Args() for %q = %v, want [%s %s]", tt.model, args, tt.flag, tt.value)
+		}
+	}
+}
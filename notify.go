@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	webhookTimeout  = 5 * time.Second
+	webhookDebounce = time.Minute
+)
+
+// Notification events. The instance ones are debounced per instance.
+const (
+	notifyCrashed          = "crashed"
+	notifyOOM              = "oom"
+	notifyGaveUp           = "gave_up"
+	notifyStartupTimeout   = "startup_timeout"
+	notifyUnhealthy        = "unhealthy"
+	notifyRecovered        = "recovered"
+	notifyDownloadFinished = "download_finished"
+	notifyDownloadFailed   = "download_failed"
+)
+
+// Webhook formats: the raw payload, or a chat message rendered from a
+// template.
+const (
+	webhookFormatJSON    = "json"
+	webhookFormatSlack   = "slack"
+	webhookFormatDiscord = "discord"
+
+	discordMessageLimit    = 2000
+	defaultMessageTemplate = `[{{.Host}}] {{if .Instance}}{{.Instance}}{{else}}{{with .Download}}{{.Repo}}{{end}}{{end}}: {{.Event}}` +
+		`{{if .RestartCount}} (restart {{.RestartCount}}){{end}}{{if .LastError}}: {{.LastError}}{{end}}`
+)
+
+var notifyEvents = []string{
+	notifyCrashed, notifyOOM, notifyGaveUp, notifyStartupTimeout, notifyUnhealthy,
+	notifyRecovered, notifyDownloadFinished, notifyDownloadFailed,
+}
+
+type NotificationsConf struct {
+	Webhooks []WebhookConf `yaml:"webhooks,omitempty" json:"webhooks,omitempty"`
+	Email    *EmailConf    `yaml:"email,omitempty" json:"email,omitempty"`
+}
+
+// WebhookConf posts to URL for the listed events, or for all of them when
+// Events is empty. The slack and discord formats send Template, rendered with
+// the WebhookPayload fields plus Host, as a chat message.
+type WebhookConf struct {
+	URL      string   `yaml:"url" json:"url"`
+	Events   []string `yaml:"events,omitempty" json:"events,omitempty"`
+	Format   string   `yaml:"format,omitempty" json:"format,omitempty"`
+	Template string   `yaml:"template,omitempty" json:"template,omitempty"`
+}
+
+func (w WebhookConf) wants(event string) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, event)
+}
+
+func (n NotificationsConf) validate() []error {
+	var errs []error
+	for i, w := range n.Webhooks {
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("notifications.webhooks[%d]: url must be an http or https URL", i))
+		}
+		for _, e := range w.Events {
+			if !slices.Contains(notifyEvents, e) {
+				errs = append(errs, fmt.Errorf("notifications.webhooks[%d]: unknown event %q", i, e))
+			}
+		}
+		switch w.Format {
+		case "", webhookFormatJSON:
+			if w.Template != "" {
+				errs = append(errs, fmt.Errorf("notifications.webhooks[%d]: template needs format slack or discord", i))
+			}
+		case webhookFormatSlack, webhookFormatDiscord:
+			// Rendering a sample also catches unknown fields.
+			if _, err := w.body(WebhookPayload{Event: notifyCrashed}); err != nil {
+				errs = append(errs, fmt.Errorf("notifications.webhooks[%d]: %w", i, err))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("notifications.webhooks[%d]: format must be one of: json, slack, discord", i))
+		}
+	}
+	if n.Email != nil {
+		errs = append(errs, n.Email.validate()...)
+	}
+	return errs
+}
+
+// messageData is what a message template sees.
+type messageData struct {
+	WebhookPayload
+	Host string
+}
+
+func (w WebhookConf) template() (*template.Template, error) {
+	text := w.Template
+	if text == "" {
+		text = defaultMessageTemplate
+	}
+	return template.New("message").Parse(text)
+}
+
+// body renders payload the way w's format expects it.
+func (w WebhookConf) body(payload WebhookPayload) ([]byte, error) {
+	if w.Format == "" || w.Format == webhookFormatJSON {
+		return json.Marshal(payload)
+	}
+	tmpl, err := w.template()
+	if err != nil {
+		return nil, err
+	}
+	var msg strings.Builder
+	if err := tmpl.Execute(&msg, messageData{payload, hostName()}); err != nil {
+		return nil, err
+	}
+	if w.Format == webhookFormatSlack {
+		return json.Marshal(map[string]string{"text": msg.String()})
+	}
+	text := []rune(msg.String())
+	if len(text) > discordMessageLimit {
+		text = append(text[:discordMessageLimit-3], []rune("...")...)
+	}
+	return json.Marshal(map[string]string{"content": string(text)})
+}
+
+type WebhookPayload struct {
+	Instance     string          `json:"instance,omitempty"`
+	Event        string          `json:"event"`
+	State        InstanceState   `json:"state,omitempty"`
+	LastError    string          `json:"last_error,omitempty"`
+	RestartCount int             `json:"restart_count"`
+	Download     *DownloadRecord `json:"download,omitempty"`
+	Timestamp    time.Time       `json:"timestamp"`
+}
+
+type Notifier struct {
+	cfg *Config
+
+	mu       sync.Mutex
+	lastSent map[string]time.Time
+	// failing holds instances that failed since they were last running, so
+	// only those report recovered.
+	failing map[string]bool
+}
+
+func NewNotifier(cfg *Config) *Notifier {
+	return &Notifier{
+		cfg:      cfg,
+		lastSent: make(map[string]time.Time),
+		failing:  make(map[string]bool),
+	}
+}
+
+// targets returns the webhooks and mail settings that want event:
+// webhook_url gets every event.
+func (n *Notifier) targets(event string) ([]WebhookConf, *EmailConf) {
+	n.cfg.mu.RLock()
+	defer n.cfg.mu.RUnlock()
+	var hooks []WebhookConf
+	if n.cfg.WebhookURL != "" {
+		hooks = append(hooks, WebhookConf{URL: n.cfg.WebhookURL})
+	}
+	for _, w := range n.cfg.Notifications.Webhooks {
+		if w.wants(event) {
+			hooks = append(hooks, w)
+		}
+	}
+	var email *EmailConf
+	if e := n.cfg.Notifications.Email; e != nil && e.wants(event) {
+		copied := *e
+		email = &copied
+	}
+	return hooks, email
+}
+
+func (n *Notifier) deliver(hooks []WebhookConf, email *EmailConf, payload WebhookPayload) {
+	for _, w := range hooks {
+		go n.post(w, payload)
+	}
+	if email != nil {
+		go n.mail(email, payload)
+	}
+}
+
+func (n *Notifier) Notify(event string, s InstanceStatus) {
+	n.mu.Lock()
+	if event == notifyRecovered {
+		if !n.failing[s.Name] {
+			n.mu.Unlock()
+			return
+		}
+		delete(n.failing, s.Name)
+	} else {
+		n.failing[s.Name] = true
+	}
+	n.mu.Unlock()
+
+	hooks, email := n.targets(event)
+	if len(hooks) == 0 && email == nil {
+		return
+	}
+
+	key := s.Name + "/" + event
+	n.mu.Lock()
+	if last, ok := n.lastSent[key]; ok && time.Since(last) < webhookDebounce {
+		n.mu.Unlock()
+		return
+	}
+	n.lastSent[key] = time.Now()
+	n.mu.Unlock()
+
+	payload := WebhookPayload{
+		Instance:     s.Name,
+		Event:        event,
+		State:        s.State,
+		LastError:    s.LastError,
+		RestartCount: s.RestartCount,
+		Timestamp:    time.Now(),
+	}
+	n.deliver(hooks, email, payload)
+}
+
+// NotifyDownload reports a finished or failed model download. Stopped
+// downloads are not reported.
+func (n *Notifier) NotifyDownload(rec DownloadRecord) {
+	var event string
+	switch rec.Status {
+	case "done":
+		event = notifyDownloadFinished
+	case "failed":
+		event = notifyDownloadFailed
+	default:
+		return
+	}
+	payload := WebhookPayload{
+		Event:     event,
+		LastError: rec.Error,
+		Download:  &rec,
+		Timestamp: time.Now(),
+	}
+	hooks, email := n.targets(event)
+	n.deliver(hooks, email, payload)
+}
+
+func (n *Notifier) post(w WebhookConf, payload WebhookPayload) {
+	logger := slog.Default()
+	if payload.Instance != "" {
+		logger = instanceLogger(payload.Instance)
+	}
+	body, err := w.body(payload)
+	if err != nil {
+		logger.Warn("webhook delivery failed", "event", "webhook_failed", "webhook_event", payload.Event, "error", err)
+		return
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Warn("webhook delivery failed", "event", "webhook_failed", "webhook_event", payload.Event, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Warn("webhook delivery failed", "event", "webhook_failed", "webhook_event", payload.Event, "status", resp.StatusCode)
+	}
+}
+
+func (n *Notifier) mail(e *EmailConf, payload WebhookPayload) {
+	logger := slog.Default()
+	if payload.Instance != "" {
+		logger = instanceLogger(payload.Instance)
+	}
+	if err := e.send(payload); err != nil {
+		logger.Warn("notification email failed", "event", "email_failed", "notify_event", payload.Event, "error", err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+type orphan struct {
+	name string
+	pid  int
+}
+
+// isServerProcess reports whether args look like a llama-server started by a
+// manager for port: it runs bin (or a script named like it) with --port port.
+func isServerProcess(args []string, bin string, port int) bool {
+	i := slices.Index(args, "--port")
+	if i < 0 || i+1 >= len(args) || args[i+1] != strconv.Itoa(port) {
+		return false
+	}
+	base := filepath.Base(bin)
+	for _, a := range args[:i] {
+		if filepath.Base(a) == base {
+			return true
+		}
+	}
+	return false
+}
+
+func processAlive(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
+
+// findOrphans lists llama-servers left listening on instance ports by a
+// previous manager that didn't get to stop them. Other processes holding a
+// port are logged and left alone.
+func (m *Manager) findOrphans() []orphan {
+	m.cfg.mu.RLock()
+	globalBin := m.cfg.ServerBin
+	m.cfg.mu.RUnlock()
+	var orphans []orphan
+	for _, inst := range m.Instances() {
+		conf := inst.conf
+		port := inst.Port()
+		if port == 0 {
+			continue
+		}
+		pid, err := portListenerPID(port)
+		if err != nil || pid == 0 || inst.PID() == pid {
+			continue
+		}
+		logger := instanceLogger(conf.Name)
+		bin := conf.ServerBin
+		if bin == "" {
+			bin = globalBin
+		}
+		args, err := processArgs(pid)
+		if err != nil || !isServerProcess(args, bin, port) {
+			logger.Warn("port is held by another process", "event", "port_in_use", "port", port, "pid", pid)
+			continue
+		}
+		orphans = append(orphans, orphan{name: conf.Name, pid: pid})
+	}
+	return orphans
+}
+
+// stopOrphans stops leftover llama-servers the way Instance.stop does:
+// SIGTERM to the process group, then SIGKILL after stop_timeout.
+func (m *Manager) stopOrphans(orphans []orphan) {
+	if len(orphans) == 0 {
+		return
+	}
+	m.cfg.mu.RLock()
+	timeout := m.cfg.StopTimeout.Duration
+	m.cfg.mu.RUnlock()
+
+	signal := func(o orphan, sig syscall.Signal) {
+		if pgid, err := syscall.Getpgid(o.pid); err == nil && pgid == o.pid {
+			syscall.Kill(-o.pid, sig)
+		} else {
+			syscall.Kill(o.pid, sig)
+		}
+	}
+	for _, o := range orphans {
+		instanceLogger(o.name).Warn("stopping llama-server left over from a previous run", "event", "orphan_stopping", "pid", o.pid)
+		if timeout == 0 {
+			signal(o, syscall.SIGKILL)
+		} else {
+			signal(o, syscall.SIGTERM)
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	killed := false
+	for {
+		alive := slices.DeleteFunc(slices.Clone(orphans), func(o orphan) bool { return !processAlive(o.pid) })
+		if len(alive) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			if killed {
+				slog.Error("leftover llama-servers survived SIGKILL", "event", "orphan_kill_failed", "count", len(alive))
+				return
+			}
+			for _, o := range alive {
+				instanceLogger(o.name).Warn("leftover process did not exit after SIGTERM, killing", "event", "orphan_killed", "pid", o.pid)
+				signal(o, syscall.SIGKILL)
+			}
+			killed = true
+			deadline = time.Now().Add(5 * time.Second)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,32 @@
+//go:build darwin
+
+package main
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// portListenerPID returns the process listening on TCP port, or 0 if none is.
+func portListenerPID(port int) (int, error) {
+	out, err := exec.Command("lsof", "-nP", "-t", "-iTCP:"+strconv.Itoa(port), "-sTCP:LISTEN").Output()
+	if len(strings.TrimSpace(string(out))) == 0 {
+		// lsof exits 1 when nothing matches.
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.Fields(string(out))[0])
+}
+
+// processArgs splits ps output on spaces, which is good enough to find the
+// binary and --port of a llama-server.
+func processArgs(pid int) ([]string, error) {
+	out, err := exec.Command("ps", "-o", "command=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+)
+
+var errPortInUse = errors.New("port in use")
+
+func portFree(port int) bool {
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+}
+
+func validatePortRange(start, end int) error {
+	if start <= 0 || end > 65535 || end < start {
+		return fmt.Errorf("port range must satisfy 0 < port_range_start <= port_range_end <= 65535")
+	}
+	return nil
+}
+
+// reservePort picks a port in port_range_start..port_range_end for the
+// port: auto instance name, preferring prev so that restarts keep the same
+// address. The port stays reserved for name until it is deleted.
+func (cfg *Config) reservePort(name string, prev int) (int, error) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	used := map[int]bool{cfg.ManagerPort: true}
+	for _, ic := range cfg.Instances {
+		used[ic.Port] = true
+	}
+	for other, port := range cfg.autoPorts {
+		if other != name {
+			used[port] = true
+		}
+	}
+	if cfg.autoPorts == nil {
+		cfg.autoPorts = make(map[string]int)
+	}
+	if prev != 0 && !used[prev] && portFree(prev) {
+		cfg.autoPorts[name] = prev
+		return prev, nil
+	}
+	for port := cfg.PortRangeStart; port <= cfg.PortRangeEnd; port++ {
+		if used[port] {
+			continue
+		}
+		if portFree(port) {
+			cfg.autoPorts[name] = port
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free port in range %d-%d", cfg.PortRangeStart, cfg.PortRangeEnd)
+}
+
+// claimPort reserves the port an adopted port: auto instance is already
+// listening on.
+func (cfg *Config) claimPort(name string, port int) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	if cfg.autoPorts == nil {
+		cfg.autoPorts = make(map[string]int)
+	}
+	cfg.autoPorts[name] = port
+}
+
+// assignPort returns conf with port: auto resolved for a start, remembering
+// the choice for Status, the proxy and the state file.
+func (inst *Instance) assignPort(conf InstanceConf) (InstanceConf, error) {
+	if conf.Port != 0 {
+		return conf, nil
+	}
+	inst.mu.Lock()
+	prev := inst.port
+	inst.mu.Unlock()
+	port, err := inst.cfg.reservePort(conf.Name, prev)
+	if err != nil {
+		inst.SetLastError(err.Error())
+		return conf, err
+	}
+	conf.Port = port
+	inst.mu.Lock()
+	inst.port = port
+	inst.mu.Unlock()
+	if port != prev {
+		instanceLogger(conf.Name).Info("assigned port", "event", "port_auto_assigned", "port", port)
+	}
+	return conf, nil
+}
+
+// checkPort fails fast when another process already listens on port, which
+// would otherwise make llama-server exit on bind and crash-loop. The holder is
+// named when it can be found.
+func (inst *Instance) checkPort(port int) error {
+	if portFree(port) {
+		return nil
+	}
+	err := fmt.Errorf("%w: %d", errPortInUse, port)
+	if pid, _ := portListenerPID(port); pid != 0 {
+		holder := "pid " + strconv.Itoa(pid)
+		if args, aerr := processArgs(pid); aerr == nil && len(args) > 0 {
+			holder += " (" + filepath.Base(args[0]) + ")"
+		}
+		err = fmt.Errorf("%w: %d is held by %s", errPortInUse, port, holder)
+	}
+	instanceLogger(inst.conf.Name).Warn("port is held by another process", "event", "port_in_use", "port", port, "error", err)
+	inst.SetLastError(err.Error())
+	return err
+}
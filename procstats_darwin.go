@@ -0,0 +1,37 @@
+//go:build darwin
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func sampleProcess(pid int, prev procSample) (procSample, error) {
+	s := procSample{at: time.Now()}
+	out, err := exec.Command("ps", "-o", "rss=,pcpu=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return s, err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 {
+		return s, fmt.Errorf("unexpected ps output: %q", string(out))
+	}
+	rssKB, _ := strconv.ParseInt(fields[0], 10, 64)
+	s.rssBytes = rssKB * 1024
+	s.cpuPercent, _ = strconv.ParseFloat(fields[1], 64)
+	return s, nil
+}
+
+// processStartTime returns when pid started, to tell it apart from a later
+// process that reused the PID.
+func processStartTime(pid int) (time.Time, error) {
+	out, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.ParseInLocation(time.ANSIC, strings.TrimSpace(string(out)), time.Local)
+}
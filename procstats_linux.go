@@ -0,0 +1,88 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const clockTicksPerSec = 100
+
+func sampleProcess(pid int, prev procSample) (procSample, error) {
+	s := procSample{at: time.Now()}
+
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return s, err
+	}
+	str := string(stat)
+	idx := strings.LastIndexByte(str, ')')
+	if idx < 0 {
+		return s, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(str[idx+1:])
+	if len(fields) < 13 {
+		return s, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	s.cpuTime = time.Duration(utime+stime) * time.Second / clockTicksPerSec
+
+	statm, err := os.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return s, err
+	}
+	mfields := strings.Fields(string(statm))
+	if len(mfields) < 2 {
+		return s, fmt.Errorf("malformed /proc/%d/statm", pid)
+	}
+	pages, _ := strconv.ParseInt(mfields[1], 10, 64)
+	s.rssBytes = pages * int64(os.Getpagesize())
+
+	if !prev.at.IsZero() {
+		if wall := s.at.Sub(prev.at); wall > 0 {
+			s.cpuPercent = float64(s.cpuTime-prev.cpuTime) / float64(wall) * 100
+		}
+	}
+	return s, nil
+}
+
+// processStartTime returns when pid started, to tell it apart from a later
+// process that reused the PID.
+func processStartTime(pid int) (time.Time, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}, err
+	}
+	str := string(stat)
+	idx := strings.LastIndexByte(str, ')')
+	if idx < 0 {
+		return time.Time{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(str[idx+1:])
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	procStat, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(procStat), "\n") {
+		if v, ok := strings.CutPrefix(line, "btime "); ok {
+			btime, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(btime, 0).Add(time.Duration(ticks) * time.Second / clockTicksPerSec), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no btime in /proc/stat")
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+var errModelNotFound = errors.New("model not found")
+
+type openAIErrorBody struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+func writeOpenAIError(w http.ResponseWriter, code int, typ, msg string) {
+	writeJSONStatus(w, code, map[string]openAIErrorBody{"error": {Message: msg, Type: typ}})
+}
+
+type openAIModel struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// modelNames lists the names a request's model field may use for inst: the
+// instance name, the configured model and, for local files, the file name.
+func modelNames(conf InstanceConf) []string {
+	names := []string{conf.Name, conf.Model}
+	if spec := parseModelSpec(conf.Model); spec.Local {
+		names = append(names, strings.TrimSuffix(filepath.Base(spec.Path), ".gguf"))
+	} else if spec.Repo != "" {
+		names = append(names, spec.Repo)
+	}
+	return names
+}
+
+// aliasErrors reports aliases claimed by more than one instance or shadowing
+// an instance name.
+func aliasErrors(instances []InstanceConf) []error {
+	var errs []error
+	names := make(map[string]bool, len(instances))
+	for _, ic := range instances {
+		names[ic.Name] = true
+	}
+	owners := make(map[string]string)
+	for _, ic := range instances {
+		for _, a := range ic.Aliases {
+			if names[a] {
+				errs = append(errs, fmt.Errorf("instance %q: alias %q is the name of another instance", ic.Name, a))
+			} else if other, ok := owners[a]; ok && other != ic.Name {
+				errs = append(errs, fmt.Errorf("alias %q is used by both %q and %q", a, other, ic.Name))
+			} else {
+				owners[a] = ic.Name
+			}
+		}
+	}
+	return errs
+}
+
+// Route picks the instance serving model. An instance name selects that
+// instance; an alias or model name selects among the running replicas of
+// that model.
+func (m *Manager) Route(model string) (*Instance, error) {
+	if model == "" {
+		var running []*Instance
+		for _, inst := range m.Instances() {
+			if inst.serving() {
+				running = append(running, inst)
+			}
+		}
+		if len(running) == 1 {
+			return running[0], nil
+		}
+		return nil, fmt.Errorf("%w: the model field is required when %d instances are running", errModelNotFound, len(running))
+	}
+	if inst := m.Get(model); inst != nil {
+		return inst, nil
+	}
+	instances := m.Instances()
+	group := model
+	for _, inst := range instances {
+		if slices.Contains(inst.conf.Aliases, model) {
+			group = inst.conf.Model
+			break
+		}
+	}
+	var members, running []*Instance
+	for _, inst := range instances {
+		if !slices.Contains(modelNames(inst.conf), group) {
+			continue
+		}
+		members = append(members, inst)
+		if inst.serving() {
+			running = append(running, inst)
+		}
+	}
+	switch {
+	case len(running) > 0:
+		return m.pickReplica(group, running), nil
+	case len(members) > 0:
+		for _, inst := range members {
+			if inst.conf.OnDemand {
+				return inst, nil
+			}
+		}
+		return members[0], nil
+	default:
+		return nil, fmt.Errorf("%w: %q", errModelNotFound, model)
+	}
+}
+
+func (ws *WebServer) handleProxy(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/models" {
+		ws.handleProxyModels(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method not allowed")
+		return
+	}
+	_, limit := ws.cfg.BodyLimits()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			writeOpenAIError(w, http.StatusRequestEntityTooLarge, "invalid_request_error", fmt.Sprintf("request body exceeds the %d byte limit", mbe.Limit))
+			return
+		}
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	var req struct {
+		Model string `json:"model"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid json: "+err.Error())
+		return
+	}
+	inst, err := ws.mgr.Route(req.Model)
+	if err != nil {
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", err.Error())
+		return
+	}
+	if err := ws.readyForProxy(r, inst); err != nil {
+		writeOpenAIError(w, http.StatusServiceUnavailable, "server_error", err.Error())
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	ws.proxyTo(inst, w, r, "")
+}
+
+// readyForProxy returns nil once inst can take r, waking on-demand instances
+// for callers allowed to start them.
+func (ws *WebServer) readyForProxy(r *http.Request, inst *Instance) error {
+	if inst.Draining() {
+		return fmt.Errorf("instance %q is draining", inst.conf.Name)
+	}
+	if inst.conf.OnDemand && ws.mayWake(r) {
+		return ws.mgr.Wake(r.Context(), inst)
+	}
+	if s := inst.State(); s != StateRunning {
+		return fmt.Errorf("instance %q is %s", inst.conf.Name, s)
+	}
+	return nil
+}
+
+// mayWake reports whether r may start an on-demand instance, which like the
+// start action needs the operator role and is refused in read_only mode.
+func (ws *WebServer) mayWake(r *http.Request) bool {
+	if ws.cfg.IsReadOnly() {
+		return false
+	}
+	if !ws.cfg.AuthRequired() {
+		return true
+	}
+	role, _ := ws.requestRole(r)
+	return role >= roleOperator
+}
+
+// isProxyPath reports whether path is forwarded to an instance rather than
+// handled by the manager itself.
+func isProxyPath(path string) bool {
+	if strings.HasPrefix(path, "/v1/") {
+		return true
+	}
+	rest, ok := strings.CutPrefix(path, "/api/instances/")
+	if !ok {
+		return false
+	}
+	_, action, _ := strings.Cut(rest, "/")
+	return action == "proxy" || strings.HasPrefix(action, "proxy/")
+}
+
+// proxyTo forwards r to inst, replacing the request path with path when set.
+// Responses are flushed as they arrive so streamed completions (SSE) reach
+// the client token by token.
+func (ws *WebServer) proxyTo(inst *Instance, w http.ResponseWriter, r *http.Request, path string) {
+	target, err := url.Parse(inst.baseURL())
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	name := inst.conf.Name
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			if path != "" {
+				pr.Out.URL.Path = path
+				pr.Out.URL.RawPath = ""
+			}
+			pr.SetXForwarded()
+		},
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+				resp.Header.Set("Cache-Control", "no-cache")
+				resp.Header.Set("X-Accel-Buffering", "no")
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			instanceLogger(name).Warn("proxy request failed", "event", "proxy_failed", "path", r.URL.Path, "error", err)
+			writeOpenAIError(w, http.StatusBadGateway, "server_error", fmt.Sprintf("instance %q: %v", name, err))
+		},
+	}
+	slog.Debug("proxying request", "event", "proxy_request", "instance", name, "path", r.URL.Path)
+	inst.inflight.Add(1)
+	defer func() {
+		inst.inflight.Add(-1)
+		inst.Touch()
+	}()
+	proxy.ServeHTTP(w, r)
+}
+
+func (ws *WebServer) handleProxyModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method not allowed")
+		return
+	}
+	data := []openAIModel{}
+	for _, inst := range ws.mgr.Instances() {
+		if inst.State() != StateRunning && !inst.conf.OnDemand {
+			continue
+		}
+		for _, id := range append([]string{inst.conf.Name}, inst.conf.Aliases...) {
+			data = append(data, openAIModel{ID: id, Object: "model", OwnedBy: "llama-manager"})
+		}
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].ID < data[j].ID })
+	writeJSONStatus(w, http.StatusOK, map[string]interface{}{"object": "list", "data": data})
+}
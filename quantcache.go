@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	quantCacheTTL       = 5 * time.Minute
+	maxConcurrentHFCall = 2
+	// quantCacheSize bounds how many repos are cached; the oldest entry
+	// makes room once expired ones are gone.
+	quantCacheSize = 256
+)
+
+type quantEntry struct {
+	quants  []QuantInfo
+	fetched time.Time
+}
+
+type quantCall struct {
+	done   chan struct{}
+	quants []QuantInfo
+	err    error
+}
+
+type QuantCache struct {
+	mu       sync.Mutex
+	entries  map[string]quantEntry
+	inflight map[string]*quantCall
+	limiter  chan struct{}
+}
+
+func NewQuantCache() *QuantCache {
+	return &QuantCache{
+		entries:  make(map[string]quantEntry),
+		inflight: make(map[string]*quantCall),
+		limiter:  make(chan struct{}, maxConcurrentHFCall),
+	}
+}
+
+func (qc *QuantCache) Get(repo, token string, refresh bool) ([]QuantInfo, error) {
+	qc.mu.Lock()
+	if e, ok := qc.entries[repo]; ok && !refresh && time.Since(e.fetched) < quantCacheTTL {
+		qc.mu.Unlock()
+		return e.quants, nil
+	}
+	if call, ok := qc.inflight[repo]; ok {
+		qc.mu.Unlock()
+		<-call.done
+		return call.quants, call.err
+	}
+	call := &quantCall{done: make(chan struct{})}
+	qc.inflight[repo] = call
+	qc.mu.Unlock()
+
+	qc.limiter <- struct{}{}
+	call.quants, call.err = FetchQuants(repo, token)
+	<-qc.limiter
+
+	qc.mu.Lock()
+	delete(qc.inflight, repo)
+	if call.err == nil {
+		qc.storeLocked(repo, call.quants, time.Now())
+	}
+	qc.mu.Unlock()
+	close(call.done)
+	return call.quants, call.err
+}
+
+func (qc *QuantCache) storeLocked(repo string, quants []QuantInfo, now time.Time) {
+	if _, ok := qc.entries[repo]; !ok && len(qc.entries) >= quantCacheSize {
+		oldest := ""
+		for r, e := range qc.entries {
+			if now.Sub(e.fetched) >= quantCacheTTL {
+				delete(qc.entries, r)
+			} else if oldest == "" || e.fetched.Before(qc.entries[oldest].fetched) {
+				oldest = r
+			}
+		}
+		if len(qc.entries) >= quantCacheSize {
+			delete(qc.entries, oldest)
+		}
+	}
+	qc.entries[repo] = quantEntry{quants: quants, fetched: now}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQuantCacheBounded(t *testing.T) {
+	qc := NewQuantCache()
+	start := time.Now()
+	for i := range quantCacheSize {
+		qc.storeLocked("repo"+strconv.Itoa(i), nil, start.Add(time.Duration(i)*time.Millisecond))
+	}
+
+	qc.storeLocked("new", nil, start.Add(time.Minute))
+	if len(qc.entries) != quantCacheSize {
+		t.Fatalf("len = %d, want %d", len(qc.entries), quantCacheSize)
+	}
+	if _, ok := qc.entries["repo0"]; ok {
+		t.Error("oldest entry was kept")
+	}
+
+	qc.storeLocked("later", nil, start.Add(quantCacheTTL+30*time.Second))
+	if len(qc.entries) != 2 {
+		t.Errorf("len = %d after expiry, want only the new and later entries", len(qc.entries))
+	}
+}
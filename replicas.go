@@ -0,0 +1,66 @@
+package main
+
+import "sync"
+
+const (
+	balanceLeastBusy  = "least_busy"
+	balanceRoundRobin = "round_robin"
+)
+
+func validBalanceMode(mode string) bool {
+	return mode == balanceLeastBusy || mode == balanceRoundRobin
+}
+
+// replicaGroups holds the proxy's round-robin cursor for each requested
+// model; instances serving the same model form that model's replica group.
+type replicaGroups struct {
+	mu   sync.Mutex
+	next map[string]int
+}
+
+func (g *replicaGroups) advance(group string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.next == nil {
+		g.next = make(map[string]int)
+	}
+	n := g.next[group]
+	g.next[group] = n + 1
+	return n
+}
+
+// pickReplica chooses one of the running replicas for group. Round robin
+// rotates through them; least busy takes the one with the fewest requests
+// processing according to the cached /metrics scrape, which also counts
+// clients calling llama-server directly. Without a recent scrape of a replica
+// it is judged by the requests this proxy has in flight to it. Equally busy
+// replicas are rotated between. Picking never waits on the network.
+func (m *Manager) pickReplica(group string, replicas []*Instance) *Instance {
+	if len(replicas) == 1 {
+		return replicas[0]
+	}
+	m.cfg.mu.RLock()
+	mode := m.cfg.ProxyBalance
+	m.cfg.mu.RUnlock()
+
+	start := m.replicas.advance(group)
+	if mode == balanceRoundRobin {
+		return replicas[start%len(replicas)]
+	}
+	sampled := m.metrics.Recent(m.Instances())
+	load := func(inst *Instance) float64 {
+		if met, ok := sampled[inst.conf.Name]; ok {
+			return met.RequestsProcessing
+		}
+		return float64(inst.Inflight())
+	}
+	best := replicas[start%len(replicas)]
+	bestLoad := load(best)
+	for i := 1; i < len(replicas); i++ {
+		r := replicas[(start+i)%len(replicas)]
+		if l := load(r); l < bestLoad {
+			best, bestLoad = r, l
+		}
+	}
+	return best
+}
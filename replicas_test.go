@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// metricsServer serves a /metrics reporting processing requests and counts
+// how often it is scraped.
+func metricsServer(t *testing.T, processing int, scrapes *atomic.Int64) int {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scrapes.Add(1)
+		fmt.Fprintf(w, "llamacpp:requests_processing %d\n", processing)
+	}))
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return port
+}
+
+func replicaManager(t *testing.T, ttl string, ports ...int) *Manager {
+	t.Helper()
+	conf := fmt.Sprintf("host: 127.0.0.1\nproxy_balance: least_busy\nmetrics_cache_ttl: %s\ninstances:\n", ttl)
+	for i, port := range ports {
+		conf += fmt.Sprintf("  - name: %c\n    model: /models/a.gguf\n    port: %d\n    gpu_ids: [%d]\n", 'a'+i, port, i)
+	}
+	mgr := NewManager(testConfig(t, conf))
+	for _, inst := range mgr.Instances() {
+		inst.mu.Lock()
+		inst.setStateLocked(StateRunning)
+		inst.mu.Unlock()
+	}
+	return mgr
+}
+
+func TestLeastBusyUsesCachedMetrics(t *testing.T) {
+	var scrapes atomic.Int64
+	mgr := replicaManager(t, "1m", metricsServer(t, 2, &scrapes), metricsServer(t, 1, &scrapes), freePort(t))
+	replicas := mgr.Instances()
+	mgr.metrics.Get(context.Background(), replicas, time.Second, false)
+	if n := scrapes.Load(); n != 2 {
+		t.Fatalf("seeding scraped %d times, want 2", n)
+	}
+	// b has proxied requests in flight, but its /metrics says it is the
+	// least loaded of the two that answer.
+	mgr.Get("b").inflight.Add(5)
+
+	// c has no metrics and nothing in flight, so it counts as idle.
+	for range len(replicas) {
+		if got := mgr.pickReplica("/models/a.gguf", replicas); got.conf.Name != "c" {
+			t.Fatalf("picked %s, want c", got.conf.Name)
+		}
+	}
+	mgr.Get("c").inflight.Add(3)
+	for range len(replicas) {
+		if got := mgr.pickReplica("/models/a.gguf", replicas); got.conf.Name != "b" {
+			t.Fatalf("picked %s, want b", got.conf.Name)
+		}
+	}
+	if n := scrapes.Load(); n != 2 {
+		t.Errorf("picks scraped /metrics %d more times, want none", n-2)
+	}
+}
+
+func TestLeastBusyWithoutSampleFallsBackToInflight(t *testing.T) {
+	var scrapes atomic.Int64
+	mgr := replicaManager(t, "1m", metricsServer(t, 0, &scrapes), metricsServer(t, 5, &scrapes))
+	replicas := mgr.Instances()
+	mgr.Get("a").inflight.Add(1)
+
+	// The first pick has no scrape to go on and mustn't wait for one.
+	if got := mgr.pickReplica("/models/a.gguf", replicas); got.conf.Name != "b" {
+		t.Fatalf("picked %s, want b by inflight", got.conf.Name)
+	}
+	// It started one in the background, which later picks use.
+	waitFor(t, "background scrape", func() bool { return mgr.metrics.Recent(replicas) != nil })
+	if got := mgr.pickReplica("/models/a.gguf", replicas); got.conf.Name != "a" {
+		t.Errorf("picked %s, want a by requests_processing", got.conf.Name)
+	}
+}
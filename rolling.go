@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const maxRollingJobs = 10
+
+type RollingStep struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"` // "pending", "restarting", "healthy", "failed"
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+type RollingRestartJob struct {
+	ID       string        `json:"id"`
+	Status   string        `json:"status"` // "running", "done", "failed"
+	Started  time.Time     `json:"started"`
+	Finished *time.Time    `json:"finished,omitempty"`
+	Steps    []RollingStep `json:"steps"`
+}
+
+type rollingRestarts struct {
+	mu    sync.Mutex
+	jobs  map[string]*RollingRestartJob
+	order []string
+}
+
+func (m *Manager) StartRollingRestart(names []string) (string, error) {
+	rr := &m.rolling
+	rr.mu.Lock()
+	for _, id := range rr.order {
+		if rr.jobs[id].Status == "running" {
+			rr.mu.Unlock()
+			return "", fmt.Errorf("rolling restart %s already in progress", id)
+		}
+	}
+	job := &RollingRestartJob{
+		ID:      strconv.FormatInt(time.Now().UnixNano(), 36),
+		Status:  "running",
+		Started: time.Now(),
+	}
+	for _, name := range names {
+		job.Steps = append(job.Steps, RollingStep{Name: name, Status: "pending"})
+	}
+	if rr.jobs == nil {
+		rr.jobs = make(map[string]*RollingRestartJob)
+	}
+	rr.jobs[job.ID] = job
+	rr.order = append(rr.order, job.ID)
+	if len(rr.order) > maxRollingJobs {
+		delete(rr.jobs, rr.order[0])
+		rr.order = rr.order[1:]
+	}
+	rr.mu.Unlock()
+
+	slog.Info("rolling restart started", "event", "rolling_restart_started", "job", job.ID, "instances", len(names))
+	go m.runRollingRestart(job)
+	return job.ID, nil
+}
+
+func (m *Manager) RollingRestartStatus(id string) *RollingRestartJob {
+	rr := &m.rolling
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	job := rr.jobs[id]
+	if job == nil {
+		return nil
+	}
+	out := *job
+	out.Steps = make([]RollingStep, len(job.Steps))
+	copy(out.Steps, job.Steps)
+	return &out
+}
+
+func (m *Manager) runRollingRestart(job *RollingRestartJob) {
+	m.cfg.mu.RLock()
+	timeout := m.cfg.RollingRestartTimeout.Duration
+	m.cfg.mu.RUnlock()
+
+	setStep := func(i int, status, errMsg string, d time.Duration) {
+		m.rolling.mu.Lock()
+		job.Steps[i].Status = status
+		job.Steps[i].Error = errMsg
+		if d > 0 {
+			job.Steps[i].Duration = d.Round(time.Second).String()
+		}
+		m.rolling.mu.Unlock()
+	}
+
+	failed := false
+	for i, step := range job.Steps {
+		started := time.Now()
+		setStep(i, "restarting", "", 0)
+		inst := m.Get(step.Name)
+		if inst == nil {
+			setStep(i, "failed", "instance not found", 0)
+			failed = true
+			continue
+		}
+		m.drain(inst)
+		if err := m.RestartInstance(step.Name, true); err != nil {
+			setStep(i, "failed", err.Error(), time.Since(started))
+			failed = true
+			continue
+		}
+		if err := m.waitHealthy(inst, timeout); err != nil {
+			instanceLogger(step.Name).Warn("rolling restart step failed", "event", "rolling_restart_step_failed", "job", job.ID, "error", err)
+			setStep(i, "failed", err.Error(), time.Since(started))
+			failed = true
+			continue
+		}
+		setStep(i, "healthy", "", time.Since(started))
+	}
+
+	m.rolling.mu.Lock()
+	now := time.Now()
+	job.Finished = &now
+	job.Status = "done"
+	if failed {
+		job.Status = "failed"
+	}
+	m.rolling.mu.Unlock()
+	slog.Info("rolling restart finished", "event", "rolling_restart_finished", "job", job.ID, "status", job.Status)
+}
+
+// waitHealthy probes inst every second until it is ready, rather than
+// waiting a whole health_check_interval; the health check loop skips its own
+// probes meanwhile.
+func (m *Manager) waitHealthy(inst *Instance, timeout time.Duration) error {
+	inst.setProbing(true)
+	defer inst.setProbing(false)
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			switch inst.State() {
+			case StateStopped:
+				return fmt.Errorf("instance stopped")
+			case StateStarting, StateRunning:
+				if inst.UpdateReadiness() {
+					return nil
+				}
+			}
+		case <-deadline:
+			return fmt.Errorf("not healthy after %s", timeout)
+		case <-m.stopCh:
+			return fmt.Errorf("manager shutting down")
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	scheduleStart   = "start"
+	scheduleStop    = "stop"
+	scheduleRestart = "restart"
+)
+
+// ScheduleEntry runs action on an instance whenever cron matches the local
+// time.
+type ScheduleEntry struct {
+	Cron   string `yaml:"cron" json:"cron"`
+	Action string `yaml:"action" json:"action"`
+}
+
+func (e ScheduleEntry) Validate() error {
+	if _, err := parseCron(e.Cron); err != nil {
+		return fmt.Errorf("schedule %q: %w", e.Cron, err)
+	}
+	switch e.Action {
+	case scheduleStart, scheduleStop, scheduleRestart:
+		return nil
+	}
+	return fmt.Errorf("schedule %q: action must be one of: start, stop, restart", e.Cron)
+}
+
+// cronSchedule is a parsed 5-field cron expression (minute hour
+// day-of-month month day-of-week), with one bit per allowed value.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// As in cron, when both day fields are restricted a day matching either
+	// one is enough.
+	domAny, dowAny bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonths = map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}
+	cronDays   = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+)
+
+func parseCron(expr string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[strings.ToLower(strings.TrimSpace(expr))]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression must have 5 fields: minute hour day-of-month month day-of-week")
+	}
+	var c cronSchedule
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, cronDays); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = strings.HasPrefix(fields[2], "*")
+	c.dowAny = strings.HasPrefix(fields[4], "*")
+	return &c, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges (a-b) and
+// steps (*/n, a-b/n, a/n) between min and max.
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	value := func(s string) (int, error) {
+		if n, ok := names[strings.ToLower(s)]; ok {
+			return n, nil
+		}
+		return strconv.Atoi(s)
+	}
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = value(from); err != nil {
+				return 0, fmt.Errorf("invalid value %q", from)
+			}
+			switch {
+			case isRange:
+				if hi, err = value(to); err != nil {
+					return 0, fmt.Errorf("invalid value %q", to)
+				}
+			case !hasStep:
+				hi = lo
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (c *cronSchedule) matches(t time.Time) bool {
+	return c.minute&(1<<t.Minute()) != 0 && c.hour&(1<<t.Hour()) != 0 &&
+		c.month&(1<<int(t.Month())) != 0 && c.matchesDay(t)
+}
+
+// next returns the first minute after t the schedule matches, or the zero
+// time if there is none within five years (e.g. February 30th).
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+type scheduleRun struct {
+	at     time.Time
+	result string
+}
+
+type scheduleRuns struct {
+	mu   sync.Mutex
+	last map[string]scheduleRun
+}
+
+func scheduleKey(name string, e ScheduleEntry) string {
+	return name + "\x00" + e.Cron + "\x00" + e.Action
+}
+
+func (s *scheduleRuns) record(key, result string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == nil {
+		s.last = make(map[string]scheduleRun)
+	}
+	s.last[key] = scheduleRun{at: at, result: result}
+}
+
+func (s *scheduleRuns) get(key string) (scheduleRun, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.last[key]
+	return r, ok
+}
+
+type ScheduleStatus struct {
+	Instance   string     `json:"instance"`
+	Cron       string     `json:"cron"`
+	Action     string     `json:"action"`
+	Next       *time.Time `json:"next,omitempty"`
+	LastRun    *time.Time `json:"last_run,omitempty"`
+	LastResult string     `json:"last_result,omitempty"`
+}
+
+// Schedules lists every instance's schedule entries with their next and last
+// run.
+func (m *Manager) Schedules() []ScheduleStatus {
+	now := time.Now()
+	result := []ScheduleStatus{}
+	for _, inst := range m.Instances() {
+		conf := inst.conf
+		for _, e := range conf.Schedule {
+			s := ScheduleStatus{Instance: conf.Name, Cron: e.Cron, Action: e.Action}
+			if c, err := parseCron(e.Cron); err == nil {
+				if next := c.next(now); !next.IsZero() {
+					s.Next = &next
+				}
+			}
+			if run, ok := m.schedules.get(scheduleKey(conf.Name, e)); ok {
+				s.LastRun = &run.at
+				s.LastResult = run.result
+			}
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func (m *Manager) startScheduler() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		for {
+			next := time.Now().Truncate(time.Minute).Add(time.Minute)
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-timer.C:
+				m.runSchedules(next)
+			case <-m.stopCh:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// runSchedules starts the scheduled actions due at minute t. Each runs on
+// its own, since a stop may wait for drain_timeout.
+func (m *Manager) runSchedules(t time.Time) {
+	for _, inst := range m.Instances() {
+		conf := inst.conf
+		for _, e := range conf.Schedule {
+			c, err := parseCron(e.Cron)
+			if err != nil || !c.matches(t) {
+				continue
+			}
+			m.wg.Add(1)
+			go func() {
+				defer m.wg.Done()
+				m.runScheduled(conf.Name, e, t)
+			}()
+		}
+	}
+}
+
+func (m *Manager) runScheduled(name string, e ScheduleEntry, t time.Time) {
+	if m.ShuttingDown() {
+		return
+	}
+	log := instanceLogger(name)
+	log.Info("running scheduled action", "event", "schedule_triggered", "action", e.Action, "cron", e.Cron)
+	var err error
+	switch e.Action {
+	case scheduleStart:
+		err = m.StartInstance(name)
+	case scheduleStop:
+		err = m.StopInstance(name, false)
+	case scheduleRestart:
+		err = m.RestartInstance(name, false)
+	}
+	result := "ok"
+	switch {
+	case errors.Is(err, errInstanceActive):
+		result = "already running"
+	case err != nil:
+		result = err.Error()
+		log.Warn("scheduled action failed", "event", "schedule_failed", "action", e.Action, "cron", e.Cron, "error", err)
+	}
+	m.schedules.record(scheduleKey(name, e), result, t)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretPlaceholder stands in for secrets in an exported config. Importing it
+// keeps the secret that is already configured.
+const secretPlaceholder = "<redacted>"
+
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// secretNodes parses a config file and returns the scalars holding its
+// secrets (hf_token, api_keys and the SMTP password) by path. Named API keys
+// are found by name so reordering them doesn't mix them up.
+func secretNodes(data []byte) (*yaml.Node, map[string]*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+	secrets := make(map[string]*yaml.Node)
+	if len(doc.Content) == 0 {
+		return &doc, secrets, nil
+	}
+	root := doc.Content[0]
+	if n := mappingValue(root, "hf_token"); n != nil && n.Kind == yaml.ScalarNode {
+		secrets["hf_token"] = n
+	}
+	if keys := mappingValue(root, "api_keys"); keys != nil && keys.Kind == yaml.SequenceNode {
+		for i, k := range keys.Content {
+			path := fmt.Sprintf("api_keys.%d", i)
+			if name := mappingValue(k, "name"); name != nil && name.Value != "" {
+				path = "api_keys." + name.Value
+			}
+			if k.Kind == yaml.ScalarNode {
+				secrets[path] = k
+			} else if v := mappingValue(k, "key"); v != nil && v.Kind == yaml.ScalarNode {
+				secrets[path] = v
+			}
+		}
+	}
+	email := mappingValue(mappingValue(root, "notifications"), "email")
+	if n := mappingValue(email, "password"); n != nil && n.Kind == yaml.ScalarNode {
+		secrets["notifications.email.password"] = n
+	}
+	return &doc, secrets, nil
+}
+
+// redactSecrets replaces the secrets in a config file with
+// secretPlaceholder.
+func redactSecrets(data []byte) ([]byte, error) {
+	doc, secrets, err := secretNodes(data)
+	if err != nil {
+		return nil, err
+	}
+	redacted := false
+	for _, n := range secrets {
+		if n.Value != "" {
+			n.Value, n.Tag, n.Style = secretPlaceholder, "!!str", 0
+			redacted = true
+		}
+	}
+	if !redacted {
+		return data, nil
+	}
+	return yaml.Marshal(doc)
+}
+
+// restoreSecrets fills in the placeholders of a redacted config with the
+// secrets from current, the config file in use. Configs that don't parse are
+// returned as they are for the caller to report.
+func restoreSecrets(data, current []byte) ([]byte, error) {
+	doc, secrets, err := secretNodes(data)
+	if err != nil {
+		return data, nil
+	}
+	var paths []string
+	for path, n := range secrets {
+		if n.Value == secretPlaceholder {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return data, nil
+	}
+	sort.Strings(paths)
+	_, existing, err := secretNodes(current)
+	if err != nil {
+		return nil, fmt.Errorf("reading current config: %w", err)
+	}
+	for _, path := range paths {
+		old, ok := existing[path]
+		if !ok || old.Value == "" {
+			return nil, fmt.Errorf("%s is %s but the current config has no value for it", path, secretPlaceholder)
+		}
+		n := secrets[path]
+		n.Value, n.Tag, n.Style = old.Value, old.Tag, old.Style
+	}
+	return yaml.Marshal(doc)
+}
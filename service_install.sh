@@ -8,7 +8,8 @@ CURRENT_GROUP="$(id -gn "$CURRENT_USER")"
 if [ ! -f "$SCRIPT_DIR/llama-manager" ]; then
     echo "==> Building llama-manager binary..."
     cd "$SCRIPT_DIR"
-    go build -o llama-manager .
+    VERSION="$(git describe --tags --always --dirty 2>/dev/null || echo dev)"
+    go build -ldflags "-X main.version=$VERSION" -o llama-manager .
 fi
 
 if [ "$(id -u)" -ne 0 ]; then
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	slotStateProcessing = "processing"
+	slotStateIdle       = "idle"
+	// slotPromptMax bounds the prompt text returned per slot; the end of the
+	// prompt is kept since that's where a generation picks up.
+	slotPromptMax = 2000
+)
+
+// SlotInfo is one llama-server slot as reported by its /slots endpoint.
+type SlotInfo struct {
+	ID        int    `json:"id"`
+	TaskID    int    `json:"task_id"`
+	State     string `json:"state"`
+	NCtx      int    `json:"n_ctx"`
+	Decoded   int    `json:"tokens_generated"`
+	Remaining int    `json:"tokens_remaining"`
+	NPredict  int    `json:"n_predict"`
+	Prompt    string `json:"prompt,omitempty"`
+}
+
+type llamaSlot struct {
+	ID           int    `json:"id"`
+	TaskID       int    `json:"id_task"`
+	NCtx         int    `json:"n_ctx"`
+	IsProcessing bool   `json:"is_processing"`
+	Prompt       string `json:"prompt"`
+	Params       struct {
+		NPredict int `json:"n_predict"`
+	} `json:"params"`
+	NextToken []struct {
+		NRemain  int `json:"n_remain"`
+		NDecoded int `json:"n_decoded"`
+	} `json:"next_token"`
+}
+
+// slotsBusy reports whether the server says every slot is processing.
+func (inst *Instance) slotsBusy() bool {
+	slots, err := inst.FetchSlots(context.Background())
+	if err != nil || len(slots) == 0 {
+		return false
+	}
+	for _, s := range slots {
+		if s.State != slotStateProcessing {
+			return false
+		}
+	}
+	return true
+}
+
+func (inst *Instance) FetchSlots(ctx context.Context) ([]SlotInfo, error) {
+	if inst.State() != StateRunning {
+		return nil, errNotRunning
+	}
+	url := inst.baseURL() + "/slots"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 3 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotImplemented {
+		return nil, fmt.Errorf("slots endpoint is disabled; start llama-server with --slots")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("slots endpoint returned %s", resp.Status)
+	}
+	var raw []llamaSlot
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("decoding slots: %w", err)
+	}
+	slots := make([]SlotInfo, len(raw))
+	for i, s := range raw {
+		slot := SlotInfo{
+			ID:       s.ID,
+			TaskID:   s.TaskID,
+			State:    slotStateIdle,
+			NCtx:     s.NCtx,
+			NPredict: s.Params.NPredict,
+			Prompt:   promptTail(s.Prompt),
+		}
+		if s.IsProcessing {
+			slot.State = slotStateProcessing
+		}
+		if len(s.NextToken) > 0 {
+			slot.Decoded = s.NextToken[0].NDecoded
+			slot.Remaining = s.NextToken[0].NRemain
+		}
+		slots[i] = slot
+	}
+	return slots, nil
+}
+
+func promptTail(prompt string) string {
+	r := []rune(prompt)
+	if len(r) <= slotPromptMax {
+		return prompt
+	}
+	return "…" + string(r[len(r)-slotPromptMax:])
+}
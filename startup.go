@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// startupGate limits how many instances StartAll has loading at once and
+// spaces out their launches, so a boot doesn't read every model from disk
+// and fill VRAM at the same time.
+type startupGate struct {
+	slots   chan struct{}
+	stagger time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// newStartupGate returns nil when startup_concurrency and startup_stagger
+// are both off and instances start all at once.
+func (m *Manager) newStartupGate() *startupGate {
+	m.cfg.mu.RLock()
+	concurrency := m.cfg.StartupConcurrency
+	stagger := m.cfg.StartupStagger.Duration
+	m.cfg.mu.RUnlock()
+	if concurrency == 0 && stagger == 0 {
+		return nil
+	}
+	g := &startupGate{stagger: stagger}
+	if concurrency > 0 {
+		g.slots = make(chan struct{}, concurrency)
+	}
+	return g
+}
+
+// acquire waits for a free slot and for the stagger since the previous
+// launch; it returns false if the manager shuts down first.
+func (g *startupGate) acquire(stopCh <-chan struct{}) bool {
+	if g.slots != nil {
+		select {
+		case g.slots <- struct{}{}:
+		case <-stopCh:
+			return false
+		}
+	}
+	g.mu.Lock()
+	now := time.Now()
+	wait := g.next.Sub(now)
+	g.next = now.Add(max(wait, 0) + g.stagger)
+	g.mu.Unlock()
+	if wait <= 0 {
+		return true
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-stopCh:
+		g.release()
+		return false
+	}
+}
+
+func (g *startupGate) release() {
+	if g.slots != nil {
+		<-g.slots
+	}
+}
+
+// startGated starts inst once the gate lets it and holds its slot until the
+// instance is running or has failed to load. With wait set it also returns
+// only then, for instances others start_after.
+func (m *Manager) startGated(inst *Instance, gate *startupGate, wait bool) {
+	if gate != nil {
+		if !gate.acquire(m.stopCh) {
+			return
+		}
+		defer gate.release()
+		wait = true
+	}
+	since := time.Now()
+	m.supervise(inst, nil)
+	if wait {
+		m.waitLoaded(inst, since)
+	}
+}
+
+// waitLoaded returns once inst, started after since, has left starting: it is
+// running, crashed, marked unhealthy (e.g. by startup_timeout) or no longer
+// supervised.
+func (m *Manager) waitLoaded(inst *Instance, since time.Time) {
+	ticker := time.NewTicker(dependencyPollInterval)
+	defer ticker.Stop()
+	for {
+		s := inst.State()
+		if s == StateRunning || !inst.isSupervised() || (s != StateStarting && inst.startedSince(since)) {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-m.stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"time"
+)
+
+type persistedInstance struct {
+	State        InstanceState   `json:"state"`
+	RestartCount int             `json:"restart_count"`
+	LastError    string          `json:"last_error,omitempty"`
+	History      []RestartEvent  `json:"history,omitempty"`
+	Crashes      []CrashSnapshot `json:"crashes,omitempty"`
+	// The running llama-server, for a restarted manager to adopt.
+	PID          int        `json:"pid,omitempty"`
+	ProcessStart *time.Time `json:"process_start,omitempty"`
+	GPUs         []int      `json:"gpus,omitempty"`
+	// Port is the last port a port: auto instance used.
+	Port int `json:"port,omitempty"`
+}
+
+type managerState struct {
+	SavedAt   time.Time                    `json:"saved_at"`
+	Instances map[string]persistedInstance `json:"instances"`
+}
+
+func (inst *Instance) persisted() persistedInstance {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	history := make([]RestartEvent, len(inst.history))
+	copy(history, inst.history)
+	crashes := make([]CrashSnapshot, len(inst.crashes))
+	copy(crashes, inst.crashes)
+	p := persistedInstance{
+		State:        inst.state,
+		RestartCount: inst.restartCount,
+		LastError:    inst.lastError,
+		History:      history,
+		Crashes:      crashes,
+	}
+	if inst.conf.Port == 0 {
+		p.Port = inst.port
+	}
+	if inst.proc != nil && !inst.procStart.IsZero() {
+		start := inst.procStart
+		p.PID, p.ProcessStart = inst.proc.Pid, &start
+		if inst.conf.GPUIDs.Auto() {
+			p.GPUs = inst.assignedGPUs
+		}
+	}
+	return p
+}
+
+func (inst *Instance) restore(p persistedInstance) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	inst.restartCount = p.RestartCount
+	inst.lastError = p.LastError
+	inst.history = p.History
+	if len(inst.history) > restartHistorySize {
+		inst.history = inst.history[len(inst.history)-restartHistorySize:]
+	}
+	inst.crashes = p.Crashes
+	if len(inst.crashes) > crashHistorySize {
+		inst.crashes = inst.crashes[len(inst.crashes)-crashHistorySize:]
+	}
+	if p.State == StateCrashed {
+		inst.state = StateCrashed
+	}
+	if inst.conf.Port == 0 {
+		inst.port = p.Port
+	}
+}
+
+func (m *Manager) loadState() {
+	path := m.statePath
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		slog.Warn("could not read state file, starting fresh", "event", "state_load_failed", "path", path, "error", err)
+		return
+	}
+	var st managerState
+	if err := json.Unmarshal(data, &st); err != nil {
+		slog.Warn("ignoring corrupt state file", "event", "state_load_failed", "path", path, "error", err)
+		return
+	}
+	restored := 0
+	for _, inst := range m.instances {
+		if p, ok := st.Instances[inst.conf.Name]; ok {
+			inst.restore(p)
+			restored++
+			if p.PID != 0 && p.ProcessStart != nil {
+				m.leftover[inst.conf.Name] = p
+			}
+		}
+	}
+	slog.Info("state restored", "event", "state_loaded", "path", path, "instances", restored, "saved_at", st.SavedAt)
+}
+
+func (m *Manager) saveState() {
+	path := m.statePath
+	if path == "" {
+		return
+	}
+	st := managerState{
+		SavedAt:   time.Now(),
+		Instances: make(map[string]persistedInstance),
+	}
+	for _, inst := range m.Instances() {
+		st.Instances[inst.conf.Name] = inst.persisted()
+	}
+
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(path, data, 0644)
+	}
+	if err != nil {
+		slog.Warn("could not write state file", "event", "state_save_failed", "path", path, "error", err)
+	}
+}
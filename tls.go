@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	selfSignedValidity = 365 * 24 * time.Hour
+	// selfSignedRenewal is how long before it expires a self-signed
+	// certificate is replaced at startup.
+	selfSignedRenewal = 30 * 24 * time.Hour
+)
+
+func validateTLS(cert, key string, selfSigned bool) []error {
+	var errs []error
+	if (cert == "") != (key == "") {
+		errs = append(errs, fmt.Errorf("tls_cert and tls_key must be set together"))
+	}
+	if selfSigned && cert != "" {
+		errs = append(errs, fmt.Errorf("tls_self_signed cannot be combined with tls_cert/tls_key"))
+	}
+	return errs
+}
+
+// TLSFiles returns the certificate and key to serve HTTPS with. Relative
+// paths, and the self-signed files, are resolved against the config's directory.
+func (cfg *Config) TLSFiles() (cert, key string, enabled bool) {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	dir := filepath.Dir(cfg.path)
+	if cfg.TLSSelfSigned {
+		return filepath.Join(dir, "llama-manager-selfsigned.crt"), filepath.Join(dir, "llama-manager-selfsigned.key"), true
+	}
+	if cfg.TLSCert == "" {
+		return "", "", false
+	}
+	cert, key = cfg.TLSCert, cfg.TLSKey
+	if !filepath.IsAbs(cert) {
+		cert = filepath.Join(dir, cert)
+	}
+	if !filepath.IsAbs(key) {
+		key = filepath.Join(dir, key)
+	}
+	return cert, key, true
+}
+
+// ensureSelfSigned creates a self-signed certificate for host unless the
+// existing one still covers host and isn't about to expire, so browsers only
+// need to trust it once a year.
+func ensureSelfSigned(certPath, keyPath, host string) error {
+	if reason := selfSignedStale(certPath, keyPath, host); reason == "" {
+		return nil
+	} else if _, err := os.Stat(certPath); err == nil {
+		slog.Info("replacing self-signed certificate", "event", "tls_self_signed_renewed", "cert", certPath, "reason", reason)
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"llama-manager"}, CommonName: "llama-manager"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if name, err := os.Hostname(); err == nil && name != "" {
+		tmpl.DNSNames = append(tmpl.DNSNames, name)
+	}
+	if host != "" && host != "0.0.0.0" && host != "::" {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	slog.Info("generated self-signed certificate", "event", "tls_self_signed", "cert", certPath, "expires", tmpl.NotAfter.Format(time.DateOnly))
+	return nil
+}
+
+// selfSignedStale says why the self-signed certificate at certPath needs
+// replacing, or returns "" when it can be kept.
+func selfSignedStale(certPath, keyPath, host string) string {
+	if _, err := os.Stat(keyPath); err != nil {
+		return "missing key"
+	}
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return "missing certificate"
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "unreadable certificate"
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "unreadable certificate"
+	}
+	if time.Now().Add(selfSignedRenewal).After(cert.NotAfter) {
+		return "expires " + cert.NotAfter.Format(time.DateOnly)
+	}
+	if host != "" && host != "0.0.0.0" && host != "::" && cert.VerifyHostname(host) != nil {
+		return "does not cover " + host
+	}
+	return ""
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnsureSelfSignedRenews(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "c.crt"), filepath.Join(dir, "c.key")
+	if err := ensureSelfSigned(certPath, keyPath, "example.test"); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := os.ReadFile(certPath)
+
+	if err := ensureSelfSigned(certPath, keyPath, "example.test"); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := os.ReadFile(certPath); !bytes.Equal(first, again) {
+		t.Error("a current certificate was replaced")
+	}
+
+	if err := ensureSelfSigned(certPath, keyPath, "other.test"); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := os.ReadFile(certPath); bytes.Equal(first, again) {
+		t.Error("certificate kept after the host changed")
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-selfSignedValidity),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     []string{"other.test"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiring := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certPath, expiring, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureSelfSigned(certPath, keyPath, "other.test"); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := os.ReadFile(certPath); bytes.Equal(expiring, again) {
+		t.Error("certificate kept a day before it expires")
+	}
+	if reason := selfSignedStale(certPath, keyPath, "other.test"); reason != "" {
+		t.Errorf("renewed certificate is stale: %s", reason)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+const serverVersionTimeout = 5 * time.Second
+
+type VersionInfo struct {
+	Version            string `json:"version"`
+	Commit             string `json:"commit,omitempty"`
+	GoVersion          string `json:"go_version"`
+	OS                 string `json:"os"`
+	Arch               string `json:"arch"`
+	ServerBin          string `json:"server_bin"`
+	ServerBinResolved  string `json:"server_bin_resolved,omitempty"`
+	ServerVersion      string `json:"server_version,omitempty"`
+	ServerVersionError string `json:"server_version_error,omitempty"`
+	// Instances lists the instances whose own server_bin overrides the global one.
+	Instances []InstanceServerVersion `json:"instances,omitempty"`
+}
+
+type InstanceServerVersion struct {
+	Name               string `json:"name"`
+	ServerBin          string `json:"server_bin"`
+	ServerBinResolved  string `json:"server_bin_resolved,omitempty"`
+	ServerVersion      string `json:"server_version,omitempty"`
+	ServerVersionError string `json:"server_version_error,omitempty"`
+}
+
+func buildCommit() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	var rev string
+	dirty := false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	if len(rev) > 12 {
+		rev = rev[:12]
+	}
+	if rev != "" && dirty {
+		rev += "-dirty"
+	}
+	return rev
+}
+
+type serverVersion struct {
+	resolved string
+	modTime  time.Time
+	version  string
+	err      string
+}
+
+// ServerVersionCache remembers each server binary's `--version` output until
+// the binary at the resolved path changes.
+type ServerVersionCache struct {
+	mu     sync.Mutex
+	cached map[string]serverVersion
+}
+
+func NewServerVersionCache() *ServerVersionCache {
+	return &ServerVersionCache{cached: make(map[string]serverVersion)}
+}
+
+func (c *ServerVersionCache) Get(bin string) serverVersion {
+	resolved, info, err := resolveServerBin(bin)
+	if err != nil {
+		return serverVersion{err: err.Error()}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.cached[bin]; ok && v.resolved == resolved && v.modTime.Equal(info.ModTime()) {
+		return v
+	}
+	v := serverVersion{resolved: resolved, modTime: info.ModTime()}
+	v.version, err = probeServerVersion(resolved)
+	if err != nil {
+		v.err = err.Error()
+	}
+	c.cached[bin] = v
+	return v
+}
+
+func resolveServerBin(bin string) (string, os.FileInfo, error) {
+	if bin == "" {
+		return "", nil, fmt.Errorf("server_bin is not set")
+	}
+	path, err := exec.LookPath(bin)
+	if err != nil {
+		return "", nil, fmt.Errorf("server_bin not found: %w", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", nil, err
+	}
+	return path, info, nil
+}
+
+func probeServerVersion(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), serverVersionTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, "--version")
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	text := strings.TrimSpace(string(out))
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("%s --version did not finish within %s", filepath.Base(path), serverVersionTimeout)
+	}
+	if err != nil {
+		if text == "" {
+			return "", fmt.Errorf("%s does not support --version: %v", filepath.Base(path), err)
+		}
+		return "", fmt.Errorf("%s --version failed: %v: %s", filepath.Base(path), err, lastLine(text))
+	}
+	if text == "" {
+		return "", fmt.Errorf("%s --version printed nothing", filepath.Base(path))
+	}
+	return text, nil
+}
+
+func lastLine(s string) string {
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		return s[i+1:]
+	}
+	return s
+}
+
+func (ws *WebServer) versionInfo() VersionInfo {
+	ws.cfg.mu.RLock()
+	bin := ws.cfg.ServerBin
+	var overrides []InstanceServerVersion
+	for _, ic := range ws.cfg.Instances {
+		if ic.ServerBin != "" {
+			overrides = append(overrides, InstanceServerVersion{Name: ic.Name, ServerBin: ic.ServerBin})
+		}
+	}
+	ws.cfg.mu.RUnlock()
+	sv := ws.serverVersion.Get(bin)
+	for i := range overrides {
+		v := ws.serverVersion.Get(overrides[i].ServerBin)
+		overrides[i].ServerBinResolved = v.resolved
+		overrides[i].ServerVersion = v.version
+		overrides[i].ServerVersionError = v.err
+	}
+	return VersionInfo{
+		Version:            version,
+		Commit:             buildCommit(),
+		GoVersion:          runtime.Version(),
+		OS:                 runtime.GOOS,
+		Arch:               runtime.GOARCH,
+		ServerBin:          bin,
+		ServerBinResolved:  sv.resolved,
+		ServerVersion:      sv.version,
+		ServerVersionError: sv.err,
+		Instances:          overrides,
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	vramCheckAdvisory = "advisory"
+	vramCheckStrict   = "strict"
+	vramCheckOff      = "off"
+
+	// vramOverheadMB covers llama.cpp's compute buffers and the CUDA/ROCm
+	// context, which the model and KV cache sizes don't account for.
+	vramOverheadMB = 512
+)
+
+var errInsufficientVRAM = errors.New("not enough free VRAM")
+
+func validVRAMCheckMode(mode string) bool {
+	return mode == vramCheckAdvisory || mode == vramCheckStrict || mode == vramCheckOff
+}
+
+// kvCacheTypeBytes is the size of one KV cache element for each -ctk/-ctv type.
+var kvCacheTypeBytes = map[string]float64{
+	"f32":    4,
+	"f16":    2,
+	"bf16":   2,
+	"q8_0":   34.0 / 32,
+	"q4_0":   18.0 / 32,
+	"q4_1":   20.0 / 32,
+	"iq4_nl": 18.0 / 32,
+	"q5_0":   22.0 / 32,
+	"q5_1":   24.0 / 32,
+}
+
+type VRAMEstimate struct {
+	ModelMB    float64 `json:"model_mb"`
+	KVCacheMB  float64 `json:"kv_cache_mb"`
+	OverheadMB float64 `json:"overhead_mb"`
+	RequiredMB float64 `json:"required_mb"`
+}
+
+// ggufReader reads the metadata section of a GGUF (v2/v3) file.
+type ggufReader struct {
+	r *bufio.Reader
+}
+
+func (g *ggufReader) u32() (uint32, error) {
+	var b [4]byte
+	_, err := io.ReadFull(g.r, b[:])
+	return binary.LittleEndian.Uint32(b[:]), err
+}
+
+func (g *ggufReader) u64() (uint64, error) {
+	var b [8]byte
+	_, err := io.ReadFull(g.r, b[:])
+	return binary.LittleEndian.Uint64(b[:]), err
+}
+
+func (g *ggufReader) str() (string, error) {
+	n, err := g.u64()
+	if err != nil {
+		return "", err
+	}
+	if n > 1<<20 {
+		return "", fmt.Errorf("string of %d bytes in GGUF metadata", n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(g.r, b)
+	return string(b), err
+}
+
+var ggufScalarSizes = map[uint32]int{0: 1, 1: 1, 2: 2, 3: 2, 4: 4, 5: 4, 6: 4, 7: 1, 10: 8, 11: 8, 12: 8}
+
+// value reads a value of GGUF type typ. Numbers come back as float64,
+// numeric arrays as []float64 and other arrays (token lists) are skipped.
+func (g *ggufReader) value(typ uint32) (interface{}, error) {
+	switch typ {
+	case 8:
+		return g.str()
+	case 9:
+		elem, err := g.u32()
+		if err != nil {
+			return nil, err
+		}
+		n, err := g.u64()
+		if err != nil {
+			return nil, err
+		}
+		if n > 1<<28 {
+			return nil, fmt.Errorf("array of %d elements in GGUF metadata", n)
+		}
+		if size, ok := ggufScalarSizes[elem]; ok && elem != 7 {
+			if n > 1<<16 {
+				_, err := g.r.Discard(int(n) * size)
+				return nil, err
+			}
+			out := make([]float64, n)
+			for i := range out {
+				v, err := g.value(elem)
+				if err != nil {
+					return nil, err
+				}
+				out[i] = v.(float64)
+			}
+			return out, nil
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, err := g.value(elem); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+	size, ok := ggufScalarSizes[typ]
+	if !ok {
+		return nil, fmt.Errorf("unknown GGUF value type %d", typ)
+	}
+	var b [8]byte
+	if _, err := io.ReadFull(g.r, b[:size]); err != nil {
+		return nil, err
+	}
+	switch typ {
+	case 0:
+		return float64(b[0]), nil
+	case 1:
+		return float64(int8(b[0])), nil
+	case 2:
+		return float64(binary.LittleEndian.Uint16(b[:])), nil
+	case 3:
+		return float64(int16(binary.LittleEndian.Uint16(b[:]))), nil
+	case 4:
+		return float64(binary.LittleEndian.Uint32(b[:])), nil
+	case 5:
+		return float64(int32(binary.LittleEndian.Uint32(b[:]))), nil
+	case 6:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b[:]))), nil
+	case 7:
+		return b[0] != 0, nil
+	case 10:
+		return float64(binary.LittleEndian.Uint64(b[:])), nil
+	case 11:
+		return float64(int64(binary.LittleEndian.Uint64(b[:]))), nil
+	default:
+		return math.Float64frombits(binary.LittleEndian.Uint64(b[:])), nil
+	}
+}
+
+func readGGUFMetadata(path string) (map[string]interface{}, error) {
+	version, err := readGGUFHeader(path)
+	if err != nil {
+		return nil, err
+	}
+	if version < 2 {
+		return nil, fmt.Errorf("GGUF version %d metadata is not supported", version)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	g := &ggufReader{r: bufio.NewReaderSize(f, 1<<16)}
+	if _, err := g.r.Discard(8); err != nil {
+		return nil, err
+	}
+	if _, err := g.u64(); err != nil { // tensor count
+		return nil, err
+	}
+	count, err := g.u64()
+	if err != nil {
+		return nil, err
+	}
+	meta := make(map[string]interface{}, count)
+	for i := uint64(0); i < count; i++ {
+		key, err := g.str()
+		if err != nil {
+			return nil, err
+		}
+		typ, err := g.u32()
+		if err != nil {
+			return nil, err
+		}
+		v, err := g.value(typ)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", key, err)
+		}
+		if v != nil {
+			meta[key] = v
+		}
+	}
+	return meta, nil
+}
+
+// modelFiles returns the GGUF holding model's metadata and the total size of
+// all its files, finding HuggingFace models in the llama.cpp cache.
+func modelFiles(model string) (string, int64, error) {
+	spec := parseModelSpec(model)
+	if !spec.Local {
+		return cachedModelFiles(spec)
+	}
+	path := spec.LocalPath()
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", 0, err
+	}
+	base, _, total, ok := parseShardName(filepath.Base(path))
+	if !ok {
+		return path, info.Size(), nil
+	}
+	var size int64
+	for i := 1; i <= total; i++ {
+		info, err := os.Stat(filepath.Join(filepath.Dir(path), shardFileName(base, i, total)))
+		if err != nil {
+			return "", 0, err
+		}
+		size += info.Size()
+	}
+	return path, size, nil
+}
+
+func cachedModelFiles(spec ModelSpec) (string, int64, error) {
+	models, err := scanCachedModels()
+	if err != nil {
+		return "", 0, err
+	}
+	prefix := strings.ToLower(strings.ReplaceAll(spec.Repo, "/", "_")) + "_"
+	for _, m := range models {
+		name := strings.ToLower(m.FileName)
+		if m.Valid && strings.HasPrefix(name, prefix) && strings.Contains(name, strings.ToLower(spec.Quant)) {
+			info, err := os.Stat(m.Path)
+			if err != nil {
+				return "", 0, err
+			}
+			size := info.Size()
+			if m.Shards > 0 {
+				size = m.SizeMB << 20
+			}
+			return m.Path, size, nil
+		}
+	}
+	return "", 0, fmt.Errorf("%s is not in the model cache", spec)
+}
+
+// estimateVRAM approximates what conf needs on its GPUs: the offloaded share
+// of the weights, the KV cache for the context length and cache types, and a
+// fixed allowance for compute buffers.
+func estimateVRAM(cfg *Config, conf InstanceConf) (VRAMEstimate, error) {
+	cfg.mu.RLock()
+	eff := cfg.effectiveLocked(conf)
+	cfg.mu.RUnlock()
+
+	path, size, err := modelFiles(conf.Model)
+	if err != nil {
+		return VRAMEstimate{}, err
+	}
+	meta, err := readGGUFMetadata(path)
+	if err != nil {
+		return VRAMEstimate{}, err
+	}
+	arch, _ := meta["general.architecture"].(string)
+	num := func(key string) float64 {
+		v, _ := meta[arch+"."+key].(float64)
+		return v
+	}
+	layers := num("block_count")
+	if layers <= 0 {
+		return VRAMEstimate{}, fmt.Errorf("%s has no %s.block_count", filepath.Base(path), arch)
+	}
+	heads := num("attention.head_count")
+	keyLen, valLen := num("attention.key_length"), num("attention.value_length")
+	if heads > 0 && keyLen == 0 {
+		keyLen = num("embedding_length") / heads
+	}
+	if valLen == 0 {
+		valLen = keyLen
+	}
+	var kvHeads float64
+	switch v := meta[arch+".attention.head_count_kv"].(type) {
+	case float64:
+		kvHeads = v * layers
+	case []float64:
+		for _, h := range v {
+			kvHeads += h
+		}
+	default:
+		kvHeads = heads * layers
+	}
+
+	ctx := float64(eff.ContextLength)
+	if ctx <= 0 {
+		ctx = num("context_length")
+	}
+	bytesK, ok := kvCacheTypeBytes[eff.CacheTypeK]
+	if !ok {
+		bytesK = 2
+	}
+	bytesV, ok := kvCacheTypeBytes[eff.CacheTypeV]
+	if !ok {
+		bytesV = 2
+	}
+
+	offload := math.Min(float64(max(eff.NGL, 0)), layers) / layers
+	est := VRAMEstimate{
+		ModelMB:   float64(size) / (1 << 20) * offload,
+		KVCacheMB: kvHeads * ctx * (keyLen*bytesK + valLen*bytesV) / (1 << 20) * offload,
+	}
+	if offload > 0 {
+		est.OverheadMB = vramOverheadMB
+	}
+	est.RequiredMB = est.ModelMB + est.KVCacheMB + est.OverheadMB
+	return est, nil
+}
+
+// checkVRAM compares the instance's estimated VRAM need with the free VRAM
+// on its GPUs. It only refuses in strict mode and stays silent whenever
+// either side can't be determined.
+func (inst *Instance) checkVRAM(conf InstanceConf) error {
+	inst.cfg.mu.RLock()
+	mode := inst.cfg.VRAMCheck
+	gpuEnv := inst.cfg.instanceGPUEnvVar(conf)
+	inst.cfg.mu.RUnlock()
+	if mode == vramCheckOff || inst.gpus == nil || gpuEnv == "" || len(conf.GPUIDs) == 0 {
+		return nil
+	}
+	logger := instanceLogger(conf.Name)
+	est, err := estimateVRAM(inst.cfg, conf)
+	if err != nil {
+		logger.Debug("skipping VRAM check", "event", "vram_check_skipped", "error", err)
+		return nil
+	}
+	report := inst.gpus.Get(context.Background(), true)
+	if report.Error != "" {
+		logger.Debug("skipping VRAM check", "event", "vram_check_skipped", "error", report.Error)
+		return nil
+	}
+	free := 0.0
+	for _, id := range conf.GPUIDs {
+		var gpu *GPUInfo
+		for i := range report.GPUs {
+			if report.GPUs[i].ID == id {
+				gpu = &report.GPUs[i]
+			}
+		}
+		if gpu == nil || gpu.MemoryTotalMB == nil || gpu.MemoryUsedMB == nil {
+			logger.Debug("skipping VRAM check", "event", "vram_check_skipped", "error", fmt.Sprintf("no memory figures for GPU %d", id))
+			return nil
+		}
+		free += *gpu.MemoryTotalMB - *gpu.MemoryUsedMB
+	}
+	if est.RequiredMB <= free {
+		return nil
+	}
+	ids := strings.Join(intsToStrings(conf.GPUIDs), ",")
+	err = fmt.Errorf("%w: %q needs about %.0f MB (model %.0f MB + KV cache %.0f MB + %.0f MB overhead) but GPU %s has %.0f MB free",
+		errInsufficientVRAM, conf.Name, est.RequiredMB, est.ModelMB, est.KVCacheMB, est.OverheadMB, ids, free)
+	if mode == vramCheckStrict {
+		inst.mu.Lock()
+		inst.lastError = err.Error()
+		inst.mu.Unlock()
+		return err
+	}
+	logger.Warn("instance may not fit in VRAM", "event", "vram_insufficient",
+		"required_mb", math.Round(est.RequiredMB), "free_mb", math.Round(free), "gpus", ids)
+	return nil
+}
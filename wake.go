@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	idleCheckInterval = 15 * time.Second
+	wakePollInterval  = 500 * time.Millisecond
+)
+
+// Wake starts an on-demand instance for a proxied request and waits until it
+// is ready, the wake timeout passes or ctx ends.
+func (m *Manager) Wake(ctx context.Context, inst *Instance) error {
+	name := inst.conf.Name
+	inst.Touch()
+	switch inst.State() {
+	case StateRunning:
+		return nil
+	case StateStopped, StateCrashed:
+		instanceLogger(name).Info("starting on request", "event", "wake_started")
+		if err := m.StartInstance(name); err != nil && !errors.Is(err, errInstanceActive) {
+			return err
+		}
+	}
+
+	m.cfg.mu.RLock()
+	timeout := m.cfg.WakeTimeout.Duration
+	m.cfg.mu.RUnlock()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	started := time.Now()
+	ticker := time.NewTicker(wakePollInterval)
+	defer ticker.Stop()
+	for {
+		switch inst.State() {
+		case StateRunning:
+			instanceLogger(name).Info("ready after wake", "event", "wake_ready", "duration", time.Since(started).Round(time.Millisecond).String())
+			return nil
+		case StateStopped:
+			return fmt.Errorf("instance %q was stopped while waking", name)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if err := inst.Status().LastError; err != "" {
+				return fmt.Errorf("instance %q not ready after %s: %s", name, time.Since(started).Round(time.Second), err)
+			}
+			return fmt.Errorf("instance %q not ready after %s", name, time.Since(started).Round(time.Second))
+		case <-m.stopCh:
+			return fmt.Errorf("manager shutting down")
+		}
+	}
+}
+
+func (m *Manager) startIdleReaper() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(idleCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.stopIdle()
+			case <-m.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// stopIdle stops on-demand instances that have served no proxied request
+// for longer than their idle_timeout.
+func (m *Manager) stopIdle() {
+	for _, inst := range m.Instances() {
+		conf := inst.conf
+		if !conf.OnDemand || conf.IdleTimeout == nil || conf.IdleTimeout.Duration <= 0 {
+			continue
+		}
+		if inst.State() != StateRunning || inst.Inflight() > 0 {
+			continue
+		}
+		idle := inst.IdleFor()
+		if idle < conf.IdleTimeout.Duration {
+			continue
+		}
+		instanceLogger(conf.Name).Info("stopping idle instance", "event", "idle_stopped", "idle", idle.Round(time.Second).String())
+		if err := m.StopInstance(conf.Name, false); err != nil {
+			instanceLogger(conf.Name).Warn("failed to stop idle instance", "event", "idle_stop_failed", "error", err)
+		}
+	}
+}
@@ -1,23 +1,35 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
-
-	"gopkg.in/yaml.v3"
+	"time"
 )
 
 const (
 	maxJSONBody   = 1 << 20
 	maxUploadSize = 10 << 20
+
+	metricsFanoutTimeout = 5 * time.Second
+	summaryTimeout       = 2 * time.Second
+
+	// streamInterval is how often /api/stream resends instances and metrics;
+	// state changes go out after streamCoalesce, batching bursts.
+	streamInterval = 5 * time.Second
+	streamCoalesce = 250 * time.Millisecond
 )
 
 //go:embed templates/index.html
@@ -27,8 +39,16 @@ type WebServer struct {
 	mgr     *Manager
 	cfg     *Config
 	dlm     *DownloadManager
+	closing chan struct{}
 	tmpl    *template.Template
 	mux     *http.ServeMux
+	metrics *MetricsCache
+	quants  *QuantCache
+	gpus    *GPUCache
+
+	serverVersion *ServerVersionCache
+	sessions      *sessionStore
+	audit         *AuditLog
 }
 
 type ServerStatus struct {
@@ -40,40 +60,98 @@ type ServerStatus struct {
 func NewWebServer(mgr *Manager, cfg *Config, dlm *DownloadManager) *WebServer {
 	tmpl := template.Must(template.ParseFS(templateFS, "templates/index.html"))
 	ws := &WebServer{
-		mgr:  mgr,
-		cfg:  cfg,
-		dlm:  dlm,
-		tmpl: tmpl,
-		mux:  http.NewServeMux(),
+		mgr:     mgr,
+		cfg:     cfg,
+		dlm:     dlm,
+		closing: make(chan struct{}),
+		tmpl:    tmpl,
+		mux:     http.NewServeMux(),
+		metrics: mgr.metrics,
+		quants:  NewQuantCache(),
+		gpus:    mgr.gpus,
+
+		serverVersion: NewServerVersionCache(),
+		sessions:      newSessionStore(),
+		audit:         NewAuditLog(cfg),
 	}
 	ws.mux.HandleFunc("/", ws.handleIndex)
+	ws.mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		writeJSONError(w, http.StatusNotFound, "not found")
+	})
+	ws.mux.HandleFunc("/healthz", ws.handleHealthz)
+	ws.mux.HandleFunc("/v1/", ws.handleProxy)
 	ws.mux.HandleFunc("/api/status", ws.handleStatus)
+	ws.mux.HandleFunc("/api/version", ws.handleVersion)
+	ws.mux.HandleFunc("/api/login", ws.handleLogin)
+	ws.mux.HandleFunc("/api/logout", ws.handleLogout)
+	ws.mux.HandleFunc("/api/auth", ws.handleAuthStatus)
 	ws.mux.HandleFunc("/api/instances", ws.handleInstances)
 	ws.mux.HandleFunc("/api/metrics", ws.handleMetrics)
+	ws.mux.HandleFunc("/api/metrics/summary", ws.handleMetricsSummary)
+	ws.mux.HandleFunc("/api/metrics/history", ws.handleMetricsHistory)
+	ws.mux.HandleFunc("/api/events", ws.handleEvents)
+	ws.mux.HandleFunc("/api/stream", ws.handleStream)
+	ws.mux.HandleFunc("/api/summary", ws.handleSummary)
+	ws.mux.HandleFunc("/api/schedules", ws.handleSchedules)
 	ws.mux.HandleFunc("/api/instances/all/", ws.handleBulkAction)
+	ws.mux.HandleFunc("/api/instances/batch/", ws.handleBatchAction)
+	ws.mux.HandleFunc("/api/instances/tag/", ws.handleTagAction)
+	ws.mux.HandleFunc("/api/rolling-restarts/", ws.handleRollingRestartStatus)
 	ws.mux.HandleFunc("/api/instances/", ws.handleInstanceAction)
 	ws.mux.HandleFunc("/api/models", ws.handleModels)
 	ws.mux.HandleFunc("/api/models/quants", ws.handleModelQuants)
+	ws.mux.HandleFunc("/api/models/search", ws.handleModelSearch)
 	ws.mux.HandleFunc("/api/models/download", ws.handleModelDownload)
 	ws.mux.HandleFunc("/api/models/download/status", ws.handleModelDownloadStatus)
 	ws.mux.HandleFunc("/api/models/download/stop", ws.handleModelDownloadStop)
+	ws.mux.HandleFunc("/api/models/download/history", ws.handleModelDownloadHistory)
+	ws.mux.HandleFunc("/api/models/download/queue", ws.handleModelDownloadQueue)
+	ws.mux.HandleFunc("/api/models/download/queue/", ws.handleModelDownloadQueue)
 	ws.mux.HandleFunc("/api/config/instances", ws.handleConfigInstances)
 	ws.mux.HandleFunc("/api/config/instances/", ws.handleConfigInstanceAction)
 	ws.mux.HandleFunc("/api/config/export", ws.handleConfigExport)
 	ws.mux.HandleFunc("/api/config/import", ws.handleConfigImport)
+	ws.mux.HandleFunc("/api/config/validate", ws.handleConfigValidate)
+	ws.mux.HandleFunc("/api/gpus", ws.handleGPUs)
+	ws.mux.HandleFunc("/api/gpus/allocation", ws.handleGPUAllocation)
 	ws.mux.HandleFunc("/api/settings", ws.handleSettings)
+	ws.mux.HandleFunc("/api/audit", ws.handleAudit)
 	return ws
 }
 
 func (ws *WebServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if auditable(r) {
+		ws.serveAudited(w, r)
+		return
+	}
+	ws.serve(w, r)
+}
+
+func (ws *WebServer) serve(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	crossOrigin := origin != "" && !sameOrigin(r, origin)
+	corsAllowed := false
+	if crossOrigin {
+		var handled bool
+		corsAllowed, handled = ws.applyCORS(w, r, origin)
+		if handled {
+			return
+		}
+	}
+	if ws.cfg.AuthRequired() && !ws.authorize(w, r) {
+		return
+	}
 	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
-		if origin := r.Header.Get("Origin"); origin != "" {
-			allowed := "http://" + r.Host
-			allowedTLS := "https://" + r.Host
-			if origin != allowed && origin != allowedTLS {
-				http.Error(w, "forbidden: origin mismatch", http.StatusForbidden)
-				return
-			}
+		// Logging in and out changes nothing and /v1 inference is still
+		// served, so read_only leaves those open.
+		exempt := strings.HasPrefix(r.URL.Path, "/v1/") || r.URL.Path == "/api/login" || r.URL.Path == "/api/logout"
+		if ws.cfg.IsReadOnly() && !exempt {
+			writeJSONError(w, http.StatusForbidden, "llama-manager is in read-only mode: changes are disabled (read_only in config)")
+			return
+		}
+		if crossOrigin && !corsAllowed {
+			writeJSONError(w, http.StatusForbidden, "forbidden: origin mismatch")
+			return
 		}
 	}
 	ws.mux.ServeHTTP(w, r)
@@ -87,29 +165,60 @@ func (ws *WebServer) handleIndex(w http.ResponseWriter, r *http.Request) {
 	ws.tmpl.Execute(w, nil)
 }
 
-func (ws *WebServer) handleStatus(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+func serverStatus() ServerStatus {
 	hostname, _ := os.Hostname()
 	uptime := getSystemUptime()
-	status := ServerStatus{
+	return ServerStatus{
 		Name:      hostname,
 		Uptime:    formatDuration(uptime),
 		UptimeSec: uptime.Seconds(),
 	}
+}
+
+func (ws *WebServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(status)
+	json.NewEncoder(w).Encode(serverStatus())
+}
+
+func (ws *WebServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	instances := ws.mgr.Instances()
+	running := 0
+	for _, inst := range instances {
+		if inst.State() == StateRunning {
+			running++
+		}
+	}
+	writeJSONStatus(w, http.StatusOK, map[string]interface{}{
+		"ok":            true,
+		"instances":     len(instances),
+		"running":       running,
+		"shutting_down": ws.mgr.ShuttingDown(),
+	})
+}
+
+func (ws *WebServer) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSONStatus(w, http.StatusOK, ws.versionInfo())
 }
 
 func (ws *WebServer) handleInstances(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	var statuses []InstanceStatus
-	for _, inst := range ws.mgr.Instances() {
+	for _, inst := range ws.mgr.InstancesWithTag(r.URL.Query().Get("tag")) {
 		statuses = append(statuses, inst.Status())
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -120,18 +229,18 @@ func (ws *WebServer) handleInstanceAction(w http.ResponseWriter, r *http.Request
 	path := strings.TrimPrefix(r.URL.Path, "/api/instances/")
 	parts := strings.SplitN(path, "/", 2)
 	if len(parts) < 1 || parts[0] == "" {
-		http.NotFound(w, r)
+		writeJSONError(w, http.StatusNotFound, "not found")
 		return
 	}
 
 	name, err := url.PathUnescape(parts[0])
 	if err != nil {
-		http.Error(w, "invalid instance name", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "invalid instance name")
 		return
 	}
 	inst := ws.mgr.Get(name)
 	if inst == nil {
-		http.Error(w, "instance not found", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, "instance not found")
 		return
 	}
 
@@ -142,134 +251,799 @@ func (ws *WebServer) handleInstanceAction(w http.ResponseWriter, r *http.Request
 	}
 
 	action := parts[1]
+	if action == "proxy" || strings.HasPrefix(action, "proxy/") {
+		if err := ws.readyForProxy(r, inst); err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		ws.proxyTo(inst, w, r, "/"+strings.TrimPrefix(strings.TrimPrefix(action, "proxy"), "/"))
+		return
+	}
 
 	switch action {
 	case "logs":
 		if r.Method != http.MethodGet {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
 			return
 		}
-		lines := inst.Logs()
+		q := r.URL.Query()
+		var f logFilter
+		if v := q.Get("grep"); v != "" {
+			re, err := regexp.Compile(v)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid grep pattern: "+err.Error())
+				return
+			}
+			f.grep = re
+		}
+		level, ok := parseLogLevel(q.Get("level"))
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "level must be error or warn")
+			return
+		}
+		f.level = level
+		if v := q.Get("since"); v != "" {
+			t, err := parseTimeParam(v)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "since must be an RFC 3339 time or a duration like 10m")
+				return
+			}
+			f.since = t
+		}
+		entries := f.apply(inst.LogEntries())
 		n := 100
-		if q := r.URL.Query().Get("n"); q != "" {
-			if parsed, err := strconv.Atoi(q); err == nil && parsed > 0 {
+		if v := q.Get("n"); v != "" {
+			if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
 				n = parsed
 			}
 		}
-		if len(lines) > n {
-			lines = lines[len(lines)-n:]
+		if len(entries) > n {
+			entries = entries[len(entries)-n:]
+		}
+		lines := make([]string, len(entries))
+		for i, l := range entries {
+			lines[i] = l.Text
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(lines)
 
+	case "logs/stream":
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeJSONError(w, http.StatusInternalServerError, "streaming not supported")
+			return
+		}
+		n := 100
+		if q := r.URL.Query().Get("n"); q != "" {
+			if parsed, err := strconv.Atoi(q); err == nil && parsed >= 0 {
+				n = parsed
+			}
+		}
+		backlog, lines, cancel := inst.SubscribeLogs(n)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		for _, line := range backlog {
+			writeLogEvent(w, line)
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(eventHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return
+				}
+				writeLogEvent(w, line)
+				flusher.Flush()
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+	case "logs/download":
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		lines := inst.Logs()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", inst.conf.Name+"-logs.txt"))
+		for _, line := range lines {
+			io.WriteString(w, line+"\n")
+		}
+
+	case "command":
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(buildArgs(ws.cfg, inst.launchConf()))
+
+	case "metrics":
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), metricsFanoutTimeout)
+		defer cancel()
+		m, err := inst.FetchMetrics(ctx)
+		if errors.Is(err, errNotRunning) {
+			writeJSONStatus(w, http.StatusServiceUnavailable, map[string]string{
+				"error": "instance is not running",
+				"state": string(inst.State()),
+			})
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m)
+
+	case "slots":
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), metricsFanoutTimeout)
+		defer cancel()
+		slots, err := inst.FetchSlots(ctx)
+		if errors.Is(err, errNotRunning) {
+			writeJSONStatus(w, http.StatusServiceUnavailable, map[string]string{
+				"error": "instance is not running",
+				"state": string(inst.State()),
+			})
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(slots)
+
+	case "history":
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(inst.History())
+
+	case "crashes":
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(inst.Crashes())
+
 	case "start":
 		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if err := ws.mgr.StartInstance(name); err != nil {
+			writeActionError(w, err)
 			return
 		}
-		ws.mgr.StartInstance(name)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 
 	case "stop":
 		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if err := ws.mgr.StopInstance(name, r.URL.Query().Get("force") == "true"); err != nil {
+			writeActionError(w, err)
 			return
 		}
-		ws.mgr.StopInstance(name)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 
 	case "restart":
 		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if err := ws.mgr.RestartInstance(name, r.URL.Query().Get("force") == "true"); err != nil {
+			writeActionError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+
+	case "drain":
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var timeout time.Duration
+		if q := r.URL.Query().Get("timeout"); q != "" {
+			if timeout, err = time.ParseDuration(q); err != nil || timeout <= 0 {
+				writeJSONError(w, http.StatusBadRequest, "invalid timeout")
+				return
+			}
+		}
+		drained, err := ws.mgr.DrainInstance(name, timeout)
+		if err != nil {
+			writeActionError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "drained": drained})
+
+	case "pause":
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if err := ws.mgr.PauseInstance(name); err != nil {
+			writeActionError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+
+	case "resume":
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if err := ws.mgr.ResumeInstance(name); err != nil {
+			writeActionError(w, err)
 			return
 		}
-		ws.mgr.RestartInstance(name)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 
 	default:
-		http.NotFound(w, r)
+		writeJSONError(w, http.StatusNotFound, "not found")
 	}
 }
 
 func (ws *WebServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	instances := ws.mgr.Instances()
+	refresh := r.URL.Query().Get("refresh") == "true"
+	report := ws.metrics.Get(r.Context(), ws.mgr.Instances(), metricsFanoutTimeout, refresh)
+	if r.Context().Err() != nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
 
-	type metricsResult struct {
-		name    string
-		metrics *InstanceMetrics
+func (ws *WebServer) handleMetricsSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	instances := ws.mgr.Instances()
+	report := ws.metrics.Get(r.Context(), instances, metricsFanoutTimeout, r.URL.Query().Get("refresh") == "true")
+	if r.Context().Err() != nil {
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summarizeMetrics(report, instances))
+}
 
-	ch := make(chan metricsResult, len(instances))
-	var wg sync.WaitGroup
+type MetricsHistoryResponse struct {
+	Range     string                     `json:"range"`
+	Step      string                     `json:"step"`
+	Instances map[string][]MetricsSample `json:"instances"`
+}
+
+func (ws *WebServer) handleMetricsHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	rng := defaultHistoryRange
+	if v := q.Get("range"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "range must be a positive duration like 1h")
+			return
+		}
+		rng = d
+	}
+	var step time.Duration
+	if v := q.Get("step"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "step must be a positive duration like 1m")
+			return
+		}
+		step = d
+	}
+	instances := ws.mgr.Instances()
+	if name := q.Get("instance"); name != "" {
+		inst := ws.mgr.Get(name)
+		if inst == nil {
+			writeJSONError(w, http.StatusNotFound, "instance not found")
+			return
+		}
+		instances = []*Instance{inst}
+	}
+	ws.cfg.mu.RLock()
+	interval := ws.cfg.MetricsInterval.Duration
+	ws.cfg.mu.RUnlock()
+	step = historyStep(rng, interval, step)
+	since := time.Now().Add(-rng)
+	resp := MetricsHistoryResponse{
+		Range:     rng.String(),
+		Step:      step.String(),
+		Instances: make(map[string][]MetricsSample, len(instances)),
+	}
 	for _, inst := range instances {
-		wg.Add(1)
-		go func(inst *Instance) {
-			defer wg.Done()
-			m := inst.FetchMetrics()
-			if m != nil {
-				ch <- metricsResult{name: inst.conf.Name, metrics: m}
+		resp.Instances[inst.conf.Name] = ws.mgr.history.query(inst.conf.Name, since, step)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type Summary struct {
+	Host               ServerStatus          `json:"host"`
+	Instances          int                   `json:"instances"`
+	States             map[InstanceState]int `json:"states"`
+	TotalRestarts      int                   `json:"total_restarts"`
+	PromptTokensSec    float64               `json:"prompt_tokens_sec"`
+	PredictedTokensSec float64               `json:"predicted_tokens_sec"`
+	RequestsProcessing float64               `json:"requests_processing"`
+	Download           DownloadStatus        `json:"download"`
+}
+
+func (ws *WebServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		ws.queryEvents(w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	events, cancel := ws.mgr.events.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
 			}
-		}(inst)
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-ws.closing:
+			return
+		}
 	}
-	wg.Wait()
-	close(ch)
+}
+
+// handleStream pushes what the dashboard shows as Server-Sent Events: an
+// "instances" event with every instance's status whenever one changes state,
+// and "instances" and "metrics" every streamInterval.
+func (ws *WebServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	events, cancel := ws.mgr.events.Subscribe()
+	defer cancel()
 
-	result := make(map[string]*InstanceMetrics)
-	for mr := range ch {
-		result[mr.name] = mr.metrics
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event string, v any) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		flusher.Flush()
+	}
+	sendInstances := func() {
+		statuses := []InstanceStatus{}
+		for _, inst := range ws.mgr.Instances() {
+			statuses = append(statuses, inst.Status())
+		}
+		send("instances", statuses)
+	}
+	sendMetrics := func() {
+		report := ws.metrics.Get(r.Context(), ws.mgr.Instances(), metricsFanoutTimeout, false)
+		if r.Context().Err() == nil {
+			send("metrics", report)
+		}
+	}
+
+	sendMetrics()
+	sendInstances()
+	ticker := time.NewTicker(streamInterval)
+	defer ticker.Stop()
+	// changed fires streamCoalesce after the first of a burst of state
+	// changes.
+	changed := time.NewTimer(streamCoalesce)
+	changed.Stop()
+	pending := false
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+			if !pending {
+				pending = true
+				changed.Reset(streamCoalesce)
+			}
+		case <-changed.C:
+			pending = false
+			sendInstances()
+		case <-ticker.C:
+			sendMetrics()
+			sendInstances()
+		case <-r.Context().Done():
+			return
+		case <-ws.closing:
+			return
+		}
+	}
+}
+
+// queryEvents serves the recorded event log, newest first.
+func (ws *WebServer) queryEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := EventFilter{
+		Instance: q.Get("instance"),
+		Type:     q.Get("type"),
+		Limit:    eventDefaultLimit,
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > eventHistorySize {
+			writeJSONError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(eventHistorySize))
+			return
+		}
+		f.Limit = n
+	}
+	if v := q.Get("since"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "since must be an RFC 3339 time or a duration like 24h")
+			return
+		}
+		f.Since = t
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
+	json.NewEncoder(w).Encode(ws.mgr.events.Query(f))
+}
+
+func (ws *WebServer) configChanged(instance, change string) {
+	ws.mgr.events.Publish(Event{Type: eventConfigChanged, Instance: instance, Change: change})
+}
+
+func (ws *WebServer) closeStreams() {
+	close(ws.closing)
+}
+
+func (ws *WebServer) handleSchedules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ws.mgr.Schedules())
+}
+
+func (ws *WebServer) handleSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	instances := ws.mgr.Instances()
+	report := ws.metrics.Get(r.Context(), instances, summaryTimeout, r.URL.Query().Get("refresh") == "true")
+
+	s := Summary{
+		Host:      serverStatus(),
+		Instances: len(instances),
+		States:    make(map[InstanceState]int),
+		Download:  ws.dlm.GetStatus(),
+	}
+	for _, inst := range instances {
+		st := inst.Status()
+		s.States[st.State]++
+		s.TotalRestarts += st.RestartCount
+	}
+	for _, m := range report.Metrics {
+		s.PromptTokensSec += m.PromptTokensSec
+		s.PredictedTokensSec += m.PredictedTokensSec
+		s.RequestsProcessing += m.RequestsProcessing
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
 }
 
 func (ws *WebServer) handleBulkAction(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	action := strings.TrimPrefix(r.URL.Path, "/api/instances/all/")
+	ws.bulkAction(w, r, action, ws.mgr.InstancesWithTag(r.URL.Query().Get("tag")))
+}
+
+// handleTagAction runs a bulk action on the instances with a tag:
+// /api/instances/tag/{tag}/{action}.
+func (ws *WebServer) handleTagAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	rawTag, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/instances/tag/"), "/")
+	tag, err := url.PathUnescape(rawTag)
+	if !ok || err != nil || tag == "" {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	instances := ws.mgr.InstancesWithTag(tag)
+	if len(instances) == 0 {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no instances tagged %q", tag))
+		return
+	}
+	ws.bulkAction(w, r, action, instances)
+}
+
+func (ws *WebServer) bulkAction(w http.ResponseWriter, r *http.Request, action string, instances []*Instance) {
+	force := r.URL.Query().Get("force") == "true"
+	var results map[string]string
 	switch action {
 	case "start":
-		for _, inst := range ws.mgr.Instances() {
+		var names []string
+		for _, inst := range instances {
+			if !force && !inst.conf.ShouldAutoStart() {
+				continue
+			}
 			s := inst.State()
 			if s == StateStopped || s == StateCrashed {
-				ws.mgr.StartInstance(inst.conf.Name)
+				names = append(names, inst.conf.Name)
 			}
 		}
-	case "stop":
-		for _, inst := range ws.mgr.Instances() {
-			ws.mgr.StopInstance(inst.conf.Name)
+		results = ws.runBulk(action, names, force)
+	case "stop", "restart":
+		var names []string
+		for _, inst := range instances {
+			names = append(names, inst.conf.Name)
 		}
-	case "restart":
-		instances := ws.mgr.Instances()
-		go func() {
-			for _, inst := range instances {
-				ws.mgr.RestartInstance(inst.conf.Name)
-			}
-		}()
+		results = ws.runBulk(action, names, force)
+	case "rolling-restart":
+		var names []string
+		for _, inst := range instances {
+			names = append(names, inst.conf.Name)
+		}
+		id, err := ws.mgr.StartRollingRestart(names)
+		if err != nil {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok", "job_id": id})
+		return
 	default:
-		http.NotFound(w, r)
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	writeBulkResults(w, results)
+}
+
+func (ws *WebServer) handleBatchAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	action := strings.TrimPrefix(r.URL.Path, "/api/instances/batch/")
+	if action != "start" && action != "stop" && action != "restart" {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("unknown batch action %q, expected start, stop or restart", action))
+		return
+	}
+	var req struct {
+		Names []string `json:"names"`
+	}
+	if !ws.decodeJSONBody(w, r, &req) {
+		return
+	}
+	if len(req.Names) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "names must list at least one instance")
+		return
+	}
+
+	results := make(map[string]string)
+	var names []string
+	for _, name := range req.Names {
+		if _, seen := results[name]; seen {
+			continue
+		}
+		if ws.mgr.Get(name) == nil {
+			results[name] = "not found"
+			continue
+		}
+		results[name] = ""
+		names = append(names, name)
+	}
+	for name, res := range ws.runBulk(action, names, r.URL.Query().Get("force") == "true") {
+		results[name] = res
+	}
+	writeBulkResults(w, results)
+}
+
+func (ws *WebServer) runBulk(action string, names []string, force bool) map[string]string {
+	results := make(map[string]string, len(names))
+	var mu sync.Mutex
+	record := func(name string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			results[name] = err.Error()
+		} else {
+			results[name] = "ok"
+		}
+	}
+
+	if action == "start" {
+		for _, name := range names {
+			record(name, ws.mgr.StartInstance(name))
+		}
+		return results
+	}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if action == "stop" {
+				record(name, ws.mgr.StopInstance(name, force))
+			} else {
+				record(name, ws.mgr.RestartInstance(name, force))
+			}
+		}(name)
+	}
+	wg.Wait()
+	return results
+}
+
+func writeBulkResults(w http.ResponseWriter, results map[string]string) {
+	status := "ok"
+	code := http.StatusOK
+	for _, res := range results {
+		if res != "ok" {
+			status = "partial"
+			code = http.StatusMultiStatus
+			break
+		}
+	}
+	writeJSONStatus(w, code, map[string]interface{}{"status": status, "results": results})
+}
+
+func writeJSONStatus(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSONStatus(w, code, map[string]string{"error": msg})
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, err error) bool {
+	var mbe *http.MaxBytesError
+	if !errors.As(err, &mbe) {
+		return false
+	}
+	writeJSONStatus(w, http.StatusRequestEntityTooLarge, map[string]interface{}{
+		"error": fmt.Sprintf("request body exceeds the %d byte limit", mbe.Limit),
+		"limit": mbe.Limit,
+	})
+	return true
+}
+
+func (ws *WebServer) decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	limit, _ := ws.cfg.BodyLimits()
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		if !writeBodyTooLarge(w, err) {
+			writeJSONError(w, http.StatusBadRequest, "invalid json: "+err.Error())
+		}
+		return false
+	}
+	return true
+}
+
+// writeLogEvent sends one output line as an SSE message. A bare CR would end
+// the SSE line early, so it is dropped.
+func writeLogEvent(w io.Writer, line string) {
+	fmt.Fprintf(w, "data: %s\n\n", strings.ReplaceAll(line, "\r", ""))
+}
+
+func writeActionError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errInstanceNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, errInstanceActive), errors.Is(err, errInsufficientVRAM), errors.Is(err, errPortInUse):
+		code = http.StatusConflict
+	}
+	writeJSONError(w, code, err.Error())
+}
+
+func (ws *WebServer) handleRollingRestartStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/rolling-restarts/")
+	job := ws.mgr.RollingRestartStatus(id)
+	if job == nil {
+		writeJSONError(w, http.StatusNotFound, "rolling restart not found")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	json.NewEncoder(w).Encode(job)
 }
 
 func (ws *WebServer) handleModels(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	models, err := scanCachedModels()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -281,52 +1055,157 @@ func (ws *WebServer) handleModels(w http.ResponseWriter, r *http.Request) {
 
 func (ws *WebServer) handleModelQuants(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	repo := r.URL.Query().Get("repo")
 	if repo == "" {
-		http.Error(w, "repo parameter is required", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "repo parameter is required")
+		return
+	}
+	quants, err := ws.quants.Get(repo, ws.cfg.HuggingFaceToken(), r.URL.Query().Get("refresh") == "true")
+	if writeRateLimited(w, err) {
 		return
 	}
-	quants, err := FetchQuants(repo)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		writeJSONError(w, http.StatusBadGateway, err.Error())
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(quants)
 }
 
+func writeRateLimited(w http.ResponseWriter, err error) bool {
+	var rl *hfRateLimitError
+	if !errors.As(err, &rl) {
+		return false
+	}
+	if rl.RetryAfter != "" {
+		w.Header().Set("Retry-After", rl.RetryAfter)
+	}
+	writeJSONError(w, http.StatusTooManyRequests, rl.Error())
+	return true
+}
+
+func (ws *WebServer) handleModelSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		writeJSONError(w, http.StatusBadRequest, "q parameter is required")
+		return
+	}
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+	results, err := SearchModels(q, ws.cfg.HuggingFaceToken(), limit)
+	if writeRateLimited(w, err) {
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
 func (ws *WebServer) handleModelDownload(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	var req struct {
-		Repo  string `json:"repo"`
-		Quant string `json:"quant"`
+		Repo     string `json:"repo"`
+		Quant    string `json:"quant"`
+		URL      string `json:"url"`
+		FileName string `json:"file_name"`
 	}
-	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBody)
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+	if !ws.decodeJSONBody(w, r, &req) {
 		return
 	}
-	if req.Repo == "" {
-		http.Error(w, "repo is required", http.StatusBadRequest)
+	var queued *QueuedDownload
+	var err error
+	switch {
+	case req.URL != "":
+		queued, err = ws.dlm.StartURL(req.URL, req.FileName)
+	case req.Repo != "":
+		queued, err = ws.dlm.Start(req.Repo, req.Quant)
+	default:
+		writeJSONError(w, http.StatusBadRequest, "repo or url is required")
 		return
 	}
-	if err := ws.dlm.Start(req.Repo, req.Quant); err != nil {
-		http.Error(w, err.Error(), http.StatusConflict)
+	if err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, errDownloadActive) || errors.Is(err, errDownloadQueued) {
+			code = http.StatusConflict
+		}
+		writeJSONError(w, code, err.Error())
+		return
+	}
+	if queued != nil {
+		writeJSONStatus(w, http.StatusAccepted, map[string]interface{}{
+			"status":   "queued",
+			"id":       queued.ID,
+			"position": queued.Position,
+		})
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
+// handleModelDownloadQueue lists (GET) or clears (DELETE) the download
+// queue; /queue/{id} moves (POST {"position": n}) or removes (DELETE) one
+// entry.
+func (ws *WebServer) handleModelDownloadQueue(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/models/download/queue"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ws.dlm.Queue())
+		return
+	case id == "" && r.Method == http.MethodDelete:
+		ws.dlm.ClearQueue()
+	case id != "" && r.Method == http.MethodPost:
+		var req struct {
+			Position int `json:"position"`
+		}
+		if !ws.decodeJSONBody(w, r, &req) {
+			return
+		}
+		if req.Position < 1 {
+			writeJSONError(w, http.StatusBadRequest, "position must be 1 or more")
+			return
+		}
+		if err := ws.dlm.MoveQueued(id, req.Position); err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+	case id != "" && r.Method == http.MethodDelete:
+		if err := ws.dlm.RemoveQueued(id); err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ws.dlm.Queue())
+}
+
 func (ws *WebServer) handleModelDownloadStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -335,7 +1214,7 @@ func (ws *WebServer) handleModelDownloadStatus(w http.ResponseWriter, r *http.Re
 
 func (ws *WebServer) handleModelDownloadStop(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
 	ws.dlm.Stop()
@@ -343,6 +1222,37 @@ func (ws *WebServer) handleModelDownloadStop(w http.ResponseWriter, r *http.Requ
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
+func (ws *WebServer) handleModelDownloadHistory(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ws.dlm.History())
+	case http.MethodDelete:
+		ws.dlm.ClearHistory()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+type instanceConfResponse struct {
+	InstanceConf
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+type instanceCheckResponse struct {
+	Valid    bool         `json:"valid"`
+	Instance InstanceConf `json:"instance"`
+	Errors   []string     `json:"errors,omitempty"`
+	Warnings []string     `json:"warnings,omitempty"`
+}
+
+type instanceConfDetail struct {
+	Config    InstanceConf      `json:"config"`
+	Effective EffectiveInstance `json:"effective"`
+}
+
 func (ws *WebServer) handleConfigInstances(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
@@ -351,81 +1261,137 @@ func (ws *WebServer) handleConfigInstances(w http.ResponseWriter, r *http.Reques
 
 	case http.MethodPost:
 		var ic InstanceConf
-		r.Body = http.MaxBytesReader(w, r.Body, maxJSONBody)
-		if err := json.NewDecoder(r.Body).Decode(&ic); err != nil {
-			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		if !ws.decodeJSONBody(w, r, &ic) {
 			return
 		}
-		if ic.Name == "" || ic.Model == "" || ic.Port == 0 {
-			http.Error(w, "name, model, and port are required", http.StatusBadRequest)
+		if r.URL.Query().Get("dry_run") == "true" {
+			checked, warnings, err := ws.cfg.CheckInstance(ic)
+			res := instanceCheckResponse{Valid: err == nil, Instance: checked, Warnings: warnings}
+			if err != nil {
+				res.Errors = strings.Split(err.Error(), "\n")
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(res)
 			return
 		}
-		if len(ic.GPUIDs) == 0 {
-			http.Error(w, "gpu_ids must contain at least one GPU ID", http.StatusBadRequest)
+		if err := ic.Validate(); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		if err := ws.cfg.AddInstance(ic); err != nil {
-			http.Error(w, err.Error(), http.StatusConflict)
+		ic, warnings, err := ws.cfg.AddInstance(ic)
+		if err != nil {
+			writeJSONError(w, http.StatusConflict, err.Error())
 			return
 		}
 		ws.mgr.AddInstance(ic)
+		ws.configChanged(ic.Name, configChangeAdded)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(ic)
+		json.NewEncoder(w).Encode(instanceConfResponse{ic, warnings})
 
 	default:
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
 	}
 }
 
 func (ws *WebServer) handleConfigInstanceAction(w http.ResponseWriter, r *http.Request) {
 	rawName := strings.TrimPrefix(r.URL.Path, "/api/config/instances/")
 	if rawName == "" {
-		http.NotFound(w, r)
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if source, ok := strings.CutSuffix(rawName, "/clone"); ok {
+		ws.handleConfigInstanceClone(w, r, source)
 		return
 	}
 	name, err := url.PathUnescape(rawName)
 	if err != nil {
-		http.Error(w, "invalid instance name", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, "invalid instance name")
 		return
 	}
 
 	switch r.Method {
+	case http.MethodGet:
+		ic, err := ws.cfg.GetInstance(name)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(instanceConfDetail{
+			Config:    ic,
+			Effective: ws.cfg.Effective(ic),
+		})
+
 	case http.MethodPut:
 		var ic InstanceConf
-		r.Body = http.MaxBytesReader(w, r.Body, maxJSONBody)
-		if err := json.NewDecoder(r.Body).Decode(&ic); err != nil {
-			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		if !ws.decodeJSONBody(w, r, &ic) {
 			return
 		}
-		if ic.Name == "" || ic.Model == "" || ic.Port == 0 {
-			http.Error(w, "name, model, and port are required", http.StatusBadRequest)
+		if err := ic.Validate(); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		if len(ic.GPUIDs) == 0 {
-			http.Error(w, "gpu_ids must contain at least one GPU ID", http.StatusBadRequest)
+		ic, warnings, err := ws.cfg.UpdateInstance(name, ic)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
 			return
 		}
 		ws.mgr.RemoveInstance(name)
-		if err := ws.cfg.UpdateInstance(name, ic); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
 		ws.mgr.AddInstance(ic)
+		ws.configChanged(name, configChangeUpdated)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(ic)
+		json.NewEncoder(w).Encode(instanceConfResponse{ic, warnings})
 
 	case http.MethodDelete:
-		ws.mgr.RemoveInstance(name)
 		if err := ws.cfg.DeleteInstance(name); err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
+			code := http.StatusConflict
+			if errors.Is(err, errInstanceNotFound) {
+				code = http.StatusNotFound
+			}
+			writeJSONError(w, code, err.Error())
 			return
 		}
+		ws.mgr.RemoveInstance(name)
+		ws.configChanged(name, configChangeDeleted)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 
 	default:
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (ws *WebServer) handleConfigInstanceClone(w http.ResponseWriter, r *http.Request, rawSource string) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	source, err := url.PathUnescape(rawSource)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid instance name")
+		return
+	}
+	var opts CloneOptions
+	if !ws.decodeJSONBody(w, r, &opts) {
+		return
+	}
+	if err := opts.Validate(source); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ic, warnings, err := ws.cfg.CloneInstance(source, opts)
+	if err != nil {
+		code := http.StatusConflict
+		if errors.Is(err, errInstanceNotFound) {
+			code = http.StatusNotFound
+		}
+		writeJSONError(w, code, err.Error())
+		return
 	}
+	ws.mgr.AddInstance(ic)
+	ws.configChanged(ic.Name, configChangeAdded)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(instanceConfResponse{ic, warnings})
 }
 
 func (ws *WebServer) handleConfigExport(w http.ResponseWriter, r *http.Request) {
@@ -437,6 +1403,9 @@ func (ws *WebServer) handleConfigExport(w http.ResponseWriter, r *http.Request)
 	path := ws.cfg.path
 	ws.cfg.mu.RUnlock()
 	data, err := os.ReadFile(path)
+	if err == nil {
+		data, err = redactSecrets(data)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -446,71 +1415,160 @@ func (ws *WebServer) handleConfigExport(w http.ResponseWriter, r *http.Request)
 	w.Write(data)
 }
 
-func (ws *WebServer) handleConfigImport(w http.ResponseWriter, r *http.Request) {
+// readConfigUpload reads an uploaded config, with any redacted secrets
+// filled in from the config in use.
+func (ws *WebServer) readConfigUpload(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	_, limit := ws.cfg.BodyLimits()
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	var data []byte
+	var err error
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		data, err = io.ReadAll(r.Body)
+	} else {
+		file, _, ferr := r.FormFile("file")
+		if ferr != nil {
+			return nil, fmt.Errorf("file upload required: %w", ferr)
+		}
+		defer file.Close()
+		data, err = io.ReadAll(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ws.cfg.mu.RLock()
+	path := ws.cfg.path
+	ws.cfg.mu.RUnlock()
+	current, err := os.ReadFile(path)
+	if err != nil {
+		current = nil
+	}
+	return restoreSecrets(data, current)
+}
+
+// parseUploadedConfig parses an uploaded config as if it replaced the config
+// file in use, so relative paths resolve the same way and the instances in
+// instances_dir are validated along with the inline ones.
+func (ws *WebServer) parseUploadedConfig(data []byte) (*Config, error) {
+	ws.cfg.mu.RLock()
+	path := ws.cfg.path
+	ws.cfg.mu.RUnlock()
+	cfg, err := parseConfig(data, path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.loadInstancesDir(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func errorStrings(errs []error) []string {
+	out := make([]string, len(errs))
+	for i, err := range errs {
+		out[i] = err.Error()
+	}
+	return out
+}
+
+func (ws *WebServer) handleConfigValidate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
-	file, _, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "file upload required: "+err.Error(), http.StatusBadRequest)
+	data, err := ws.readConfigUpload(w, r)
+	if writeBodyTooLarge(w, err) {
 		return
 	}
-	defer file.Close()
-
-	data, err := io.ReadAll(file)
 	if err != nil {
-		http.Error(w, "reading file: "+err.Error(), http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	var test Config
-	if err := yaml.Unmarshal(data, &test); err != nil {
-		http.Error(w, "invalid yaml: "+err.Error(), http.StatusBadRequest)
-		return
+	problems := []string{}
+	if parsed, err := ws.parseUploadedConfig(data); err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		problems = append(problems, errorStrings(validateConfig(parsed))...)
 	}
 
-	ws.cfg.mu.Lock()
-	if err := os.WriteFile(ws.cfg.path, data, 0644); err != nil {
-		ws.cfg.mu.Unlock()
-		http.Error(w, "writing config: "+err.Error(), http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"valid":  len(problems) == 0,
+		"errors": problems,
+	})
+}
+
+func (ws *WebServer) handleConfigImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
 		return
 	}
-	if test.ServerBin != "" {
-		ws.cfg.ServerBin = test.ServerBin
-	}
-	if test.Host != "" {
-		ws.cfg.Host = test.Host
+	data, err := ws.readConfigUpload(w, r)
+	if writeBodyTooLarge(w, err) {
+		return
 	}
-	if test.GPUBackend != "" {
-		ws.cfg.GPUBackend = test.GPUBackend
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	if test.RestartDelay.Duration > 0 {
-		ws.cfg.RestartDelay = test.RestartDelay
+
+	test, err := ws.parseUploadedConfig(data)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid yaml: "+err.Error())
+		return
 	}
-	if test.HealthCheckInterval.Duration > 0 {
-		ws.cfg.HealthCheckInterval = test.HealthCheckInterval
+	if errs := validateConfig(test); len(errs) > 0 {
+		msgs := errorStrings(errs)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "error",
+			"error":   "invalid config: " + strings.Join(msgs, "; "),
+			"message": "invalid config: " + strings.Join(msgs, "; "),
+			"errors":  msgs,
+		})
+		return
 	}
-	if test.MaxRestarts > 0 {
-		ws.cfg.MaxRestarts = test.MaxRestarts
+
+	ws.cfg.mu.Lock()
+	if err := writeFileAtomic(ws.cfg.path, data, 0644); err != nil {
+		ws.cfg.mu.Unlock()
+		writeJSONError(w, http.StatusInternalServerError, "writing config: "+err.Error())
+		return
 	}
-	if test.NGL > 0 {
-		ws.cfg.NGL = test.NGL
+	keysChanged := !slices.Equal(ws.cfg.APIKeys, test.APIKeys)
+	formatChanged := ws.cfg.LogFormat != test.LogFormat
+	pending := ws.cfg.restartOnlyChangesLocked(test)
+	ws.cfg.applyImportedLocked(test)
+	ws.cfg.mu.Unlock()
+	// A session keeps the role of the key it logged in with, so drop them
+	// all rather than let a revoked key live on in someone's cookie.
+	if keysChanged {
+		ws.sessions.clear()
 	}
-	if test.ContextLength > 0 {
-		ws.cfg.ContextLength = test.ContextLength
+	for _, inst := range ws.mgr.Instances() {
+		inst.SetLogBufferSize(ws.cfg.Effective(inst.conf).LogBufferSize)
 	}
-	if test.CacheTypeK != "" {
-		ws.cfg.CacheTypeK = test.CacheTypeK
+	if formatChanged {
+		setupLogging(test.LogFormat)
 	}
-	if test.CacheTypeV != "" {
-		ws.cfg.CacheTypeV = test.CacheTypeV
+	ws.configChanged("", configChangeImported)
+
+	msg := "config imported, settings applied. restart to apply instance changes"
+	if len(pending) > 0 {
+		msg += " and " + strings.Join(pending, ", ")
 	}
-	ws.cfg.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "message": msg})
+}
 
+func (ws *WebServer) handleGPUAllocation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "message": "config imported, settings applied. restart to apply instance changes"})
+	json.NewEncoder(w).Encode(ws.cfg.GPUAllocations())
 }
 
 func (ws *WebServer) handleSettings(w http.ResponseWriter, r *http.Request) {
@@ -521,19 +1579,18 @@ func (ws *WebServer) handleSettings(w http.ResponseWriter, r *http.Request) {
 
 	case http.MethodPut:
 		var s Settings
-		r.Body = http.MaxBytesReader(w, r.Body, maxJSONBody)
-		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
-			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		if !ws.decodeJSONBody(w, r, &s) {
 			return
 		}
 		if err := ws.cfg.UpdateSettings(s); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeJSONError(w, http.StatusBadRequest, err.Error())
 			return
 		}
+		ws.configChanged("", configChangeSettings)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(ws.cfg.GetSettings())
 
 	default:
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
 	}
 }
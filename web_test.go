@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// sizedJSON returns a JSON object body exactly n bytes long.
+func sizedJSON(n int) string {
+	return `{"a":"` + strings.Repeat("x", n-len(`{"a":""}`)) + `"}`
+}
+
+func TestBodyLimits(t *testing.T) {
+	const limit = 256
+	cfg := testConfig(t, "")
+	cfg.MaxJSONBody = limit
+	cfg.MaxUploadSize = limit
+	ws := &WebServer{cfg: cfg}
+
+	jsonHandler := func(w http.ResponseWriter, r *http.Request) {
+		var v map[string]string
+		if ws.decodeJSONBody(w, r, &v) {
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+	// A YAML comment pads the upload without changing the config.
+	upload := func(n int) string {
+		head := "server_bin: llama-server\n#"
+		return head + strings.Repeat("x", n-len(head))
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		want    int
+	}{
+		{"json at limit", jsonHandler, sizedJSON(limit), http.StatusOK},
+		{"json just under limit", jsonHandler, sizedJSON(limit - 1), http.StatusOK},
+		{"json just over limit", jsonHandler, sizedJSON(limit + 1), http.StatusRequestEntityTooLarge},
+		{"upload just under limit", ws.handleConfigValidate, upload(limit - 1), http.StatusOK},
+		{"upload just over limit", ws.handleConfigValidate, upload(limit + 1), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			tt.handler(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if tt.want == http.StatusRequestEntityTooLarge && !strings.Contains(rec.Body.String(), `"limit":256`) {
+				t.Errorf("413 body = %s, want the limit in JSON", rec.Body)
+			}
+		})
+	}
+}
+
+func TestConfigValidateChecksInstancesDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "instances.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := os.WriteFile(filepath.Join(dir, "instances.d", "chat.yaml"), []byte("name: chat\nmodel: /models/b.gguf\nport: 9001\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t, "")
+	cfg.path = filepath.Join(dir, "config.yaml")
+	ws := &WebServer{cfg: cfg}
+
+	upload := `server_bin: llama-server
+instances_dir: instances.d
+instances:
+  - name: chat
+    model: /models/a.gguf
+    port: 9000
+`
+	rec := httptest.NewRecorder()
+	ws.handleConfigValidate(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(upload)))
+	var resp struct {
+		Valid  bool     `json:"valid"`
+		Errors []string `json:"errors"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding %s: %v", rec.Body, err)
+	}
+	if resp.Valid || !strings.Contains(strings.Join(resp.Errors, "; "), "duplicate instance name") {
+		t.Errorf("validate = %+v, want the duplicate from instances_dir reported", resp)
+	}
+}
+
+func TestReadOnlyAllowsLogin(t *testing.T) {
+	cfg := testConfig(t, "read_only: true\napi_keys:\n  - name: admin\n    key: secret-key\n    role: admin\n")
+	ws := NewWebServer(NewManager(cfg), cfg, nil)
+
+	tests := []struct {
+		path string
+		body string
+		want int
+	}{
+		{"/api/login", `{"key":"secret-key"}`, http.StatusOK},
+		{"/api/logout", "", http.StatusOK},
+		{"/api/instances/all/stop", "", http.StatusForbidden},
+		{"/api/instances/a/proxy/slots/0?action=erase", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+		req.Header.Set("X-API-Key", "secret-key")
+		rec := httptest.NewRecorder()
+		ws.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("POST %s = %d, want %d: %s", tt.path, rec.Code, tt.want, rec.Body)
+		}
+	}
+}
+
+func TestViewerCannotWakeOnDemand(t *testing.T) {
+	const lazy = `instances:
+  - name: lazy
+    model: /models/a.gguf
+    port: 9000
+    gpu_ids: [0]
+    on_demand: true
+`
+	tests := []struct {
+		name   string
+		config string
+		method string
+		path   string
+		key    string
+	}{
+		{"viewer key", "api_keys:\n  - name: viewer\n    key: viewer-key\n    role: viewer\n" + lazy,
+			http.MethodGet, "/api/instances/lazy/proxy/health", "viewer-key"},
+		{"read_only proxy", "read_only: true\n" + lazy,
+			http.MethodGet, "/api/instances/lazy/proxy/health", ""},
+		{"read_only v1", "read_only: true\n" + lazy,
+			http.MethodPost, "/v1/chat/completions", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, tt.config)
+			mgr := NewManager(cfg)
+			ws := NewWebServer(mgr, cfg, nil)
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"model":"lazy"}`))
+			if tt.key != "" {
+				req.Header.Set("X-API-Key", tt.key)
+			}
+			rec := httptest.NewRecorder()
+			ws.ServeHTTP(rec, req)
+			if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "stopped") {
+				t.Errorf("status = %d %s, want 503 with the state", rec.Code, rec.Body)
+			}
+			if s := mgr.Get("lazy").State(); s != StateStopped {
+				t.Errorf("state = %s, want the instance left stopped", s)
+			}
+		})
+	}
+}
+
+func TestConfigImportAppliesAuthSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	initial := "server_bin: llama-server\napi_keys:\n  - name: old\n    key: old-key\n    role: admin\n"
+	if err := os.WriteFile(path, []byte(initial), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWebServer(NewManager(cfg), cfg, nil)
+	sessionID, err := ws.sessions.create(roleAdmin, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload := `server_bin: llama-server
+api_keys:
+  - name: new
+    key: new-key
+    role: admin
+anonymous_role: none
+read_only: true
+allowed_origins: [https://ui.example.com]
+`
+	rec := httptest.NewRecorder()
+	ws.handleConfigImport(rec, httptest.NewRequest(http.MethodPost, "/api/config/import", strings.NewReader(upload)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("import = %d: %s", rec.Code, rec.Body)
+	}
+
+	if _, ok := cfg.lookupAPIKey("old-key"); ok {
+		t.Error("revoked key still accepted after import")
+	}
+	if _, ok := cfg.lookupAPIKey("new-key"); !ok {
+		t.Error("imported key not accepted")
+	}
+	if _, ok := ws.sessions.lookup(sessionID); ok {
+		t.Error("session from before the key change survived the import")
+	}
+	if !cfg.IsReadOnly() || cfg.anonymousRole() != roleNone || cfg.corsOrigin("https://ui.example.com") == "" {
+		t.Error("read_only, anonymous_role or allowed_origins not applied")
+	}
+
+	cfg.mu.Lock()
+	err = cfg.saveLocked()
+	cfg.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.APIKeys) != 1 || saved.APIKeys[0].Key != "new-key" {
+		t.Errorf("saved api_keys = %+v, want only new-key", saved.APIKeys)
+	}
+}
+
+func TestConfigImportAppliesZeroAndShutdownSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("server_bin: llama-server\nmax_restarts: 5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWebServer(NewManager(cfg), cfg, nil)
+
+	upload := "server_bin: llama-server\nmax_restarts: 0\ndetach_on_shutdown: true\nmanager_port: 8181\n"
+	rec := httptest.NewRecorder()
+	ws.handleConfigImport(rec, httptest.NewRequest(http.MethodPost, "/api/config/import", strings.NewReader(upload)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("import = %d: %s", rec.Code, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), "manager_port") {
+		t.Errorf("response %s doesn't say manager_port needs a restart", rec.Body)
+	}
+
+	cfg.mu.RLock()
+	maxRestarts, detach, port := cfg.MaxRestarts, cfg.DetachOnShutdown, cfg.ManagerPort
+	cfg.mu.RUnlock()
+	if maxRestarts != 0 {
+		t.Errorf("max_restarts = %d, want 0", maxRestarts)
+	}
+	if !detach {
+		t.Error("detach_on_shutdown not applied")
+	}
+	if port != 8181 {
+		t.Errorf("manager_port = %d, want 8181 kept for the next save", port)
+	}
+}
+
+func TestConfigImportDropsReplacedEnvTemplates(t *testing.T) {
+	t.Setenv("LM_TEST_HOOK", "https://hooks.example.com/x")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("server_bin: llama-server\nwebhook_url: ${LM_TEST_HOOK}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWebServer(NewManager(cfg), cfg, nil)
+
+	upload := "server_bin: llama-server\nwebhook_url: https://hooks.example.com/x\n"
+	rec := httptest.NewRecorder()
+	ws.handleConfigImport(rec, httptest.NewRequest(http.MethodPost, "/api/config/import", strings.NewReader(upload)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("import = %d: %s", rec.Code, rec.Body)
+	}
+	cfg.mu.Lock()
+	err = cfg.saveLocked()
+	cfg.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "${LM_TEST_HOOK}") {
+		t.Errorf("save wrote the replaced template back:\n%s", data)
+	}
+}
+
+func TestConfigImportKeepsServerKnobsOnSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("server_bin: llama-server\nparallel: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWebServer(NewManager(cfg), cfg, nil)
+
+	upload := "server_bin: llama-server\nparallel: 4\nbatch_size: 1024\nubatch_size: 256\nthreads: 8\ntimeout: 600\n"
+	rec := httptest.NewRecorder()
+	ws.handleConfigImport(rec, httptest.NewRequest(http.MethodPost, "/api/config/import", strings.NewReader(upload)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("import = %d: %s", rec.Code, rec.Body)
+	}
+	cfg.mu.Lock()
+	err = cfg.saveLocked()
+	cfg.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []int{saved.Parallel, saved.BatchSize, saved.UBatchSize, saved.Threads, saved.Timeout}
+	if want := []int{4, 1024, 256, 8, 600}; !slices.Equal(got, want) {
+		t.Errorf("saved parallel, batch_size, ubatch_size, threads, timeout = %v, want %v", got, want)
+	}
+}